@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var adaptive bool
+
+// aimdLimiter bounds the requests in flight, raising the bound by one per
+// round trip while the server keeps up and halving it on a 429 or 503, a
+// timeout, or a reply much slower than the quickest seen
+type aimdLimiter struct {
+	mu       sync.Mutex
+	wake     chan struct{} // closed and replaced on each release
+	limit    float64
+	max      int
+	inflight int
+	slow     bool // past slow start, after the first cut
+	minRTT   time.Duration
+	lastCut  time.Time
+}
+
+// adaptiveSlowdown is how many times the quickest reply a reply may take
+// before it counts as the server falling behind
+const adaptiveSlowdown = 3
+
+func newAIMDLimiter(max int) *aimdLimiter {
+	return &aimdLimiter{limit: 1, max: max, wake: make(chan struct{})}
+}
+
+// acquire waits for room under the limit, giving up when ctx is done
+func (l *aimdLimiter) acquire(ctx context.Context) (time.Time, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for l.inflight >= int(l.limit) {
+		wake := l.wake
+		l.mu.Unlock()
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			l.mu.Lock()
+			return time.Time{}, ctx.Err()
+		}
+		l.mu.Lock()
+	}
+	l.inflight++
+	return time.Now(), nil
+}
+
+// release adjusts the limit from the outcome of a request sent at start
+func (l *aimdLimiter) release(start time.Time, resp *http.Response, err error) {
+	rtt := time.Since(start)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	defer func() {
+		close(l.wake)
+		l.wake = make(chan struct{})
+	}()
+	l.inflight--
+
+	var netErr net.Error
+	overloaded := false
+	switch {
+	case err != nil:
+		overloaded = errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout()
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable:
+		overloaded = true
+	default:
+		if l.minRTT == 0 || rtt < l.minRTT {
+			l.minRTT = rtt
+		}
+		overloaded = rtt > adaptiveSlowdown*l.minRTT && rtt > 10*time.Millisecond
+	}
+
+	before := int(l.limit)
+	if overloaded {
+		// a request sent before the last cut saw the old limit, so only cut
+		// once per round
+		if start.Before(l.lastCut) {
+			return
+		}
+		l.limit /= 2
+		if l.limit < 1 {
+			l.limit = 1
+		}
+		l.slow = true
+		l.lastCut = time.Now()
+	} else if err == nil {
+		if l.slow {
+			l.limit += 1 / l.limit
+		} else {
+			l.limit++
+		}
+		if l.limit > float64(l.max) {
+			l.limit = float64(l.max)
+		}
+	}
+	if debug && int(l.limit) != before {
+		log.Printf("Adaptive concurrency %d -> %d", before, int(l.limit))
+	}
+}
+
+// adaptiveTransport holds each request to the limiter
+type adaptiveTransport struct {
+	next    http.RoundTripper
+	limiter *aimdLimiter
+}
+
+func (t adaptiveTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start, err := t.limiter.acquire(req.Context())
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	resp, err := t.next.RoundTrip(req)
+	t.limiter.release(start, resp, err)
+	return resp, err
+}
+
+// adaptiveClient is a copy of the client whose requests in flight follow
+// the server's replies, up to max at once
+func adaptiveClient(client *http.Client, max int) *http.Client {
+	c := *client
+	c.Transport = adaptiveTransport{next: client.Transport, limiter: newAIMDLimiter(max)}
+	return &c
+}
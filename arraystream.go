@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+var arrayStream bool
+
+// streamArray runs the query on each element of a top-level JSON array as it
+// is decoded, so only one element at a time is held rather than the whole
+// body.  A body which isn't an array is queried whole.
+func streamArray(client *http.Client) {
+	opts := fetchOptions(client)
+	opts.Stream = true
+	res, err := fetchDo(opts)
+	if err != nil {
+		log.Fatalf("Error fetching: %s", err)
+	}
+	defer res.Response.Body.Close()
+
+	rdr := bufio.NewReader(saveStream(res.Response.Body))
+	dec := json.NewDecoder(rdr)
+	first, err := firstByte(rdr)
+	if err != nil {
+		log.Fatalf("Error reading body: %s", err)
+	}
+	if first != '[' {
+		var v interface{}
+		if err := dec.Decode(&v); err != nil {
+			log.Fatalf("Error decoding body: %s", err)
+		}
+		queryInput(respEnvelope(res.URL, res.Response, "", v))
+		finishQuery()
+		return
+	}
+
+	if _, err := dec.Token(); err != nil {
+		log.Fatalf("Error decoding body: %s", err)
+	}
+	n := 0
+	for dec.More() {
+		var v interface{}
+		if err := dec.Decode(&v); err != nil {
+			log.Fatalf("Error decoding element %d: %s", n, err)
+		}
+		queryInput(respEnvelope(res.URL, res.Response, "", v))
+		n++
+	}
+	if _, err := dec.Token(); err != nil {
+		log.Fatalf("Error decoding body after element %d: %s", n, err)
+	}
+	keepTrailers(res.Response)
+	finishQuery()
+}
+
+// firstByte peeks past any white space at the first byte of a body
+func firstByte(rdr *bufio.Reader) (byte, error) {
+	for {
+		b, err := rdr.Peek(1)
+		if err != nil {
+			return 0, err
+		}
+		switch b[0] {
+		case ' ', '\t', '\r', '\n':
+			rdr.ReadByte()
+		default:
+			return b[0], nil
+		}
+	}
+}
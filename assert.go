@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pschou/jqURL/pkg/jqurl"
+)
+
+var (
+	assertHeaders []string
+	assertStatus  string
+	assertMaxTime time.Duration
+
+	headerChecks []headerCheck
+	statusCheck  func(code int) bool
+)
+
+// Exit codes for a reply which breaks an --assert-status, --assert-header
+// or --assert-max-time check, apart from those of --exit-status and --fail
+const (
+	exitAssertStatus = 5
+	exitAssertHeader = 6
+	exitAssertTime   = 7
+)
+
+// headerCheck is one --assert-header, a header which must be present with a
+// value matching the pattern
+type headerCheck struct {
+	name    string
+	pattern *regexp.Regexp
+}
+
+// loadAssertions compiles the --assert-header and --assert-status checks
+func loadAssertions() error {
+	for _, spec := range assertHeaders {
+		parts := strings.SplitN(spec, ":", 2)
+		name := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || name == "" {
+			return fmt.Errorf("invalid --assert-header %q, use 'NAME: REGEX'", spec)
+		}
+		re, err := regexp.Compile(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return fmt.Errorf("invalid --assert-header %q: %s", spec, err)
+		}
+		headerChecks = append(headerChecks, headerCheck{name: http.CanonicalHeaderKey(name), pattern: re})
+	}
+	if assertStatus == "" {
+		return nil
+	}
+	codes := map[int]bool{}
+	classes := map[int]bool{}
+	for _, item := range strings.Split(assertStatus, ",") {
+		switch item = strings.ToLower(strings.TrimSpace(item)); {
+		case item == "":
+		case len(item) == 3 && strings.HasSuffix(item, "xx") && item[0] >= '1' && item[0] <= '5':
+			classes[int(item[0]-'0')] = true
+		default:
+			code, err := strconv.Atoi(item)
+			if err != nil || code < 100 || code > 599 {
+				return fmt.Errorf("unknown --assert-status entry %q, use status codes or classes such as 2xx", item)
+			}
+			codes[code] = true
+		}
+	}
+	statusCheck = func(code int) bool {
+		return codes[code] || classes[code/100]
+	}
+	return nil
+}
+
+// withAssertions keeps the last reply of a fetch, whether or not the fetch
+// succeeded, so it can be checked once the fetch is done
+func withAssertions(opts *jqurl.Options) *http.Response {
+	if statusCheck == nil && len(headerChecks) == 0 {
+		return nil
+	}
+	last := &http.Response{}
+	onResponse := opts.OnResponse
+	opts.OnResponse = func(resp *http.Response) bool {
+		*last = http.Response{StatusCode: resp.StatusCode, Status: resp.Status, Header: resp.Header, Request: resp.Request}
+		if onResponse != nil {
+			return onResponse(resp)
+		}
+		return false
+	}
+	return last
+}
+
+// checkAssertions ends the run when the last reply of a fetch breaks an
+// assertion, listing all it breaks
+func checkAssertions(resp *http.Response) {
+	if resp == nil || resp.StatusCode == 0 {
+		return
+	}
+	target := ""
+	if resp.Request != nil {
+		target = resp.Request.URL.String()
+	}
+	if useCache && resp.StatusCode == http.StatusNotModified {
+		// revalidated, the reply checked was the one cached
+		return
+	}
+	code := 0
+	if statusCheck != nil && !statusCheck(resp.StatusCode) {
+		fmt.Fprintf(os.Stderr, "Assertion failed for %s: status %s is not in %s\n", target, resp.Status, assertStatus)
+		code = exitAssertStatus
+	}
+	for _, check := range headerChecks {
+		vals, ok := resp.Header[check.name]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "Assertion failed for %s: no %s header\n", target, check.name)
+		} else if !anyMatch(check.pattern, vals) {
+			fmt.Fprintf(os.Stderr, "Assertion failed for %s: %s: %s does not match %q\n", target, check.name, strings.Join(vals, ", "), check.pattern)
+		} else {
+			continue
+		}
+		if code == 0 {
+			code = exitAssertHeader
+		}
+	}
+	if code != 0 {
+		os.Exit(code)
+	}
+}
+
+// checkMaxTime ends the run when a successful fetch took longer than
+// --assert-max-time
+func checkMaxTime(res *jqurl.Result, took time.Duration) {
+	if assertMaxTime <= 0 || res == nil || took <= assertMaxTime {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Assertion failed for %s: took %s, over %s\n", res.URL, took.Round(time.Millisecond), assertMaxTime)
+	os.Exit(exitAssertTime)
+}
+
+func anyMatch(re *regexp.Regexp, vals []string) bool {
+	for _, v := range vals {
+		if re.MatchString(v) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	auditLog   string
+	auditChain bool
+
+	auditMu   sync.Mutex
+	auditFile *os.File
+
+	// who is running jqurl, and as which job, looked up once
+	auditUser, auditJob string
+)
+
+// auditGenesis is the prev hash of the first entry of a chained log
+var auditGenesis = strings.Repeat("0", 64)
+
+// auditEntry is one line of the --audit-log, headers and bodies are left
+// out as they may hold credentials
+type auditEntry struct {
+	Time     string  `json:"time"`
+	PID      int     `json:"pid"`
+	User     string  `json:"user,omitempty"`
+	Job      string  `json:"job,omitempty"`
+	Method   string  `json:"method"`
+	URL      string  `json:"url"`
+	Sent     int64   `json:"bytes_sent,omitempty"`
+	Status   int     `json:"status,omitempty"`
+	Error    string  `json:"error,omitempty"`
+	Duration float64 `json:"duration_ms"`
+	Prev     string  `json:"prev,omitempty"`
+}
+
+// openAuditLog opens the --audit-log for appending, it is only ever added to
+func openAuditLog() error {
+	if auditLog == "" {
+		if auditChain {
+			return fmt.Errorf("--audit-chain needs --audit-log")
+		}
+		return nil
+	}
+	if err := checkWrite(auditLog); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(auditLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	auditFile = f
+	auditUser, auditJob = expandUserAgent("{user}"), expandUserAgent("{job}")
+	return nil
+}
+
+// auditTransport records every request sent, including each redirect and
+// retry, once its reply (or failure) is in
+type auditTransport struct {
+	next http.RoundTripper
+}
+
+func withAudit(next http.RoundTripper) http.RoundTripper {
+	if auditLog == "" {
+		return next
+	}
+	return auditTransport{next: next}
+}
+
+func (t auditTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+
+	u := *req.URL
+	u.User = nil
+	e := auditEntry{
+		Time:     start.UTC().Format(time.RFC3339Nano),
+		PID:      os.Getpid(),
+		User:     auditUser,
+		Job:      auditJob,
+		Method:   req.Method,
+		URL:      u.String(),
+		Duration: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if req.ContentLength > 0 {
+		e.Sent = req.ContentLength
+	}
+	if err != nil {
+		e.Error = err.Error()
+	} else {
+		e.Status = resp.StatusCode
+	}
+	if aerr := writeAudit(req.Context(), e); aerr != nil {
+		// unaccounted egress is worse than a failed request
+		if resp != nil {
+			resp.Body.Close()
+		}
+		return nil, fmt.Errorf("writing audit log: %s", aerr)
+	}
+	return resp, err
+}
+
+// writeAudit appends an entry as one line.  When chained, the entry holds the
+// SHA-256 of the line before it, read back under a lock as other runs may
+// share the log.
+func writeAudit(ctx context.Context, e auditEntry) error {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	if auditChain {
+		release, err := acquireLock(ctx, auditLog+".lock")
+		if err != nil {
+			return err
+		}
+		defer release()
+		last, err := lastLine(auditLog)
+		if err != nil {
+			return err
+		}
+		e.Prev = auditGenesis
+		if last != "" {
+			sum := sha256.Sum256([]byte(last))
+			e.Prev = hex.EncodeToString(sum[:])
+		}
+	}
+	byt, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = auditFile.Write(append(byt, '\n'))
+	return err
+}
+
+// lastLine returns the last line of a file, without its newline
+func lastLine(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	// lines are short, so the tail of the file is enough
+	size := stat.Size()
+	off := size - 64*1024
+	if off < 0 {
+		off = 0
+	}
+	buf := make([]byte, size-off)
+	if _, err = f.ReadAt(buf, off); err != nil && err != io.EOF {
+		return "", err
+	}
+	tail := strings.TrimSuffix(string(buf), "\n")
+	if i := strings.LastIndex(tail, "\n"); i >= 0 {
+		tail = tail[i+1:]
+	} else if off > 0 {
+		return "", fmt.Errorf("last line of %q is too long", name)
+	}
+	return tail, nil
+}
+
+// auditCommand handles "audit verify FILE", checking the hash chain of a
+// log written with --audit-chain
+func auditCommand(args []string) {
+	if len(args) != 2 || args[0] != "verify" {
+		log.Fatalf("Usage: audit verify FILE")
+	}
+	if err := checkRead(args[1]); err != nil {
+		log.Fatal(err)
+	}
+	f, err := os.Open(args[1])
+	if err != nil {
+		log.Fatalf("Error opening audit log: %s", err)
+	}
+	defer f.Close()
+	prev := auditGenesis
+	n := 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		n++
+		var e auditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			fmt.Fprintf(dataOut, "Line %d: not an audit entry: %s\n", n, err)
+			os.Exit(1)
+		}
+		if e.Prev != prev {
+			fmt.Fprintf(dataOut, "Line %d: chain broken, the line before was changed or removed\n", n)
+			os.Exit(1)
+		}
+		sum := sha256.Sum256(scanner.Bytes())
+		prev = hex.EncodeToString(sum[:])
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatalf("Error reading audit log: %s", err)
+	}
+	fmt.Fprintf(dataOut, "OK, %d entries\n", n)
+}
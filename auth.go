@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pschou/jqURL/pkg/jqurl"
+)
+
+var (
+	basicUser, bearerToken, tokenFile string
+	useNetrc                          bool
+	netrcFile                         string
+
+	netrcMachines map[string]netrcEntry
+	netrcDefault  *netrcEntry
+)
+
+// netrcEntry is the login of one machine in a .netrc file
+type netrcEntry struct {
+	login, password string
+}
+
+// applyAuth turns --user, --bearer and --token-file into the Authorization
+// header, which like one given with -H is dropped on redirects to another
+// host unless --location-trusted
+func applyAuth() error {
+	given := 0
+	for _, v := range []string{basicUser, bearerToken, tokenFile} {
+		if v != "" {
+			given++
+		}
+	}
+	if given > 1 {
+		return fmt.Errorf("use only one of --user, --bearer and --token-file")
+	}
+	switch {
+	case basicUser != "":
+		if !strings.Contains(basicUser, ":") {
+			return fmt.Errorf("--user needs USER:PASSWORD, or keep the password in --netrc")
+		}
+		Headers["authorization"] = "Basic " + base64.StdEncoding.EncodeToString([]byte(basicUser))
+	case bearerToken != "":
+		Headers["authorization"] = "Bearer " + bearerToken
+	case tokenFile != "":
+		if err := checkRead(tokenFile); err != nil {
+			return err
+		}
+		byt, err := ioutil.ReadFile(tokenFile)
+		if err != nil {
+			return err
+		}
+		token := strings.TrimSpace(string(byt))
+		if token == "" || strings.ContainsAny(token, "\r\n") {
+			return fmt.Errorf("%q does not hold a single token", tokenFile)
+		}
+		Headers["authorization"] = "Bearer " + token
+	}
+
+	if netrcFile != "" {
+		useNetrc = true
+	}
+	if !useNetrc {
+		return nil
+	}
+	if netrcFile == "" {
+		netrcFile = os.Getenv("NETRC")
+	}
+	if netrcFile == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return err
+		}
+		netrcFile = filepath.Join(home, ".netrc")
+	}
+	return loadNetrc(netrcFile)
+}
+
+// loadNetrc reads the machine, default, login and password tokens of a
+// .netrc file, skipping the bodies of macdef
+func loadNetrc(file string) error {
+	if err := checkRead(file); err != nil {
+		return err
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	netrcMachines = make(map[string]netrcEntry)
+	var cur *netrcEntry
+	var machine string
+	done := func() {
+		if cur == nil {
+			return
+		}
+		if machine == "" {
+			netrcDefault = cur
+		} else if _, ok := netrcMachines[machine]; !ok {
+			// the first entry for a machine wins, as with curl
+			netrcMachines[machine] = *cur
+		}
+	}
+	inMacro := false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if inMacro {
+			inMacro = strings.TrimSpace(line) != ""
+			continue
+		}
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		for i := 0; i < len(fields); i++ {
+			next := func() string {
+				if i+1 < len(fields) {
+					i++
+					return fields[i]
+				}
+				return ""
+			}
+			switch fields[i] {
+			case "machine":
+				done()
+				cur, machine = &netrcEntry{}, strings.ToLower(next())
+			case "default":
+				done()
+				cur, machine = &netrcEntry{}, ""
+			case "login":
+				if cur != nil {
+					cur.login = next()
+				}
+			case "password":
+				if cur != nil {
+					cur.password = next()
+				}
+			case "account":
+				next()
+			case "macdef":
+				inMacro = true
+				i = len(fields)
+			}
+		}
+	}
+	done()
+	return scanner.Err()
+}
+
+// netrcTransport logs in with the .netrc entry of each request's host, for
+// requests without credentials of their own
+type netrcTransport struct {
+	next http.RoundTripper
+}
+
+func withNetrc(next http.RoundTripper) http.RoundTripper {
+	if netrcMachines == nil {
+		return next
+	}
+	return netrcTransport{next: next}
+}
+
+func (t netrcTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("Authorization") != "" {
+		return t.next.RoundTrip(req)
+	}
+	entry, ok := netrcMachines[strings.ToLower(req.URL.Hostname())]
+	if !ok && netrcDefault != nil {
+		entry, ok = *netrcDefault, true
+	}
+	if !ok || entry.login == "" {
+		return t.next.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	req.SetBasicAuth(entry.login, entry.password)
+	return t.next.RoundTrip(req)
+}
+
+// sensitiveHeaders are kept out of --debug output
+var sensitiveHeaders = append([]string{"Proxy-Authorization", "X-Api-Key", "X-Auth-Token"}, jqurl.CredentialHeaders...)
+
+// redactHeader hides the value of a credential header for logging, keeping
+// the auth scheme
+func redactHeader(key, val string) string {
+	for _, h := range sensitiveHeaders {
+		if strings.EqualFold(key, h) {
+			if i := strings.Index(val, " "); i > 0 && !strings.EqualFold(h, "Cookie") {
+				return val[:i] + " [redacted]"
+			}
+			return "[redacted]"
+		}
+	}
+	return val
+}
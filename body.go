@@ -0,0 +1,46 @@
+package main
+
+import (
+	"os"
+	"strings"
+
+	"github.com/pschou/jqURL/pkg/jqurl"
+)
+
+var postBodies = map[string]jqurl.Body{}
+
+// postBody returns the request body for --data, "@file" sends a file and
+// "@-" standard input.  Bodies are kept for the run, so standard input is
+// only read once and every retry sends the same bytes.
+func postBody(data string) (jqurl.Body, error) {
+	if b, ok := postBodies[data]; ok {
+		return b, nil
+	}
+	var b jqurl.Body
+	var err error
+	switch {
+	case data == "@-":
+		b, err = jqurl.ReaderBody(os.Stdin)
+	case strings.HasPrefix(data, "@"):
+		if err = checkRead(data[1:]); err == nil {
+			b, err = jqurl.FileBody(data[1:])
+		}
+	default:
+		b = jqurl.BytesBody([]byte(data))
+	}
+	if err != nil {
+		return nil, err
+	}
+	postBodies[data] = b
+	return b, nil
+}
+
+// closeBodies removes any spooled request bodies
+func closeBodies() {
+	for _, b := range postBodies {
+		b.Close()
+	}
+	if formBody != nil {
+		formBody.Close()
+	}
+}
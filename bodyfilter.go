@@ -0,0 +1,29 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+var bodyFilter string
+
+// filterBody pipes the response body through the --body-filter command,
+// whose output is parsed as JSON in place of the original body.  The command
+// line is split on spaces and run directly, not through a shell.
+func filterBody(body []byte) ([]byte, error) {
+	args := strings.Fields(bodyFilter)
+	if len(args) == 0 {
+		return body, nil
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("body filter %q: %s", args[0], err)
+	}
+	return out, nil
+}
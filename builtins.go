@@ -0,0 +1,51 @@
+package main
+
+import (
+	"math/big"
+
+	"github.com/itchyny/gojq"
+)
+
+// jqFunctions are the custom builtins made available to every jq query
+var jqFunctions = []gojq.CompilerOption{
+	gojq.WithFunction("state_get", 1, 1, funcStateGet),
+	gojq.WithFunction("state_set", 2, 2, funcStateSet),
+	gojq.WithFunction("fromepoch_ms", 0, 0, funcFromEpochMs),
+	gojq.WithFunction("toepoch_ms", 0, 0, funcToEpochMs),
+	gojq.WithFunction("strftime_tz", 2, 2, funcStrftimeTZ),
+	gojq.WithFunction("strptime_tz", 2, 2, funcStrptimeTZ),
+	gojq.WithFunction("mktime_tz", 1, 1, funcMktimeTZ),
+	gojq.WithFunction("percentile", 1, 1, funcPercentile),
+	gojq.WithFunction("variance", 0, 0, funcVariance),
+	gojq.WithFunction("stddev", 0, 0, funcStddev),
+	gojq.WithFunction("histogram", 1, 1, funcHistogram),
+	gojq.WithFunction("moving_avg", 1, 1, funcMovingAvg),
+	gojq.WithFunction("uuid", 0, 0, funcUUID),
+	gojq.WithFunction("randbytes", 1, 1, funcRandBytes),
+	gojq.WithFunction("md5", 0, 0, hashFunc("md5")),
+	gojq.WithFunction("sha1", 0, 0, hashFunc("sha1")),
+	gojq.WithFunction("sha256", 0, 0, hashFunc("sha256")),
+	gojq.WithFunction("sha512", 0, 0, hashFunc("sha512")),
+	gojq.WithFunction("hmac", 2, 2, funcHMAC),
+	gojq.WithFunction("ip_in_cidr", 1, 1, funcIPInCIDR),
+	gojq.WithFunction("cidr_contains", 1, 1, funcCIDRContains),
+	gojq.WithFunction("ip_sort", 0, 0, funcIPSort),
+	gojq.WithFunction("semver_cmp", 1, 1, funcSemverCmp),
+	gojq.WithFunction("semver_satisfies", 1, 1, funcSemverSatisfies),
+	gojq.WithFunction("fetch", 1, 2, funcFetch),
+	gojq.WithFunction("trailers", 0, 0, funcTrailers),
+}
+
+// toFloat converts any of the gojq number types into a float64
+func toFloat(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case int:
+		return float64(v), true
+	case float64:
+		return v, true
+	case *big.Int:
+		f, _ := new(big.Float).SetInt(v).Float64()
+		return f, true
+	}
+	return 0, false
+}
@@ -0,0 +1,25 @@
+//go:build cabundles
+// +build cabundles
+
+package main
+
+import (
+	"embed"
+	"path"
+	"strings"
+)
+
+//go:embed cabundles
+var caBundleFS embed.FS
+
+func init() {
+	files, _ := caBundleFS.ReadDir("cabundles")
+	for _, f := range files {
+		if name := f.Name(); strings.HasSuffix(name, ".pem") {
+			pem, err := caBundleFS.ReadFile(path.Join("cabundles", name))
+			if err == nil {
+				embeddedCABundles[strings.TrimSuffix(name, ".pem")] = pem
+			}
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var cacheNamespace string
+
+// validNamespace keeps namespaces safe to use in a file name
+func validNamespace(ns string) bool {
+	for _, c := range ns {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("._-", c)) {
+			return false
+		}
+	}
+	return ns != ""
+}
+
+// cacheEntries lists the cache files in cachedir, keyed by namespace
+func cacheEntries() (map[string][]os.FileInfo, error) {
+	files, err := ioutil.ReadDir(cacheDir)
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[string][]os.FileInfo)
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || !strings.HasPrefix(name, "jqurl_") || strings.HasPrefix(name, "jqurl_state_") {
+			continue
+		}
+		// jqurl_<namespace>_<sha1 hex>
+		sep := strings.LastIndexByte(name, '_')
+		if sep <= len("jqurl_") || len(name)-sep-1 != 40 {
+			continue
+		}
+		ns := name[len("jqurl_"):sep]
+		entries[ns] = append(entries[ns], f)
+	}
+	return entries, nil
+}
+
+// cacheCommand handles the "cache" subcommands
+func cacheCommand(args []string) {
+	if len(args) == 0 {
+		args = []string{"namespaces"}
+	}
+	check := checkRead
+	if args[0] == "rm" || args[0] == "prune" {
+		check = checkWrite
+	}
+	if err := check(cacheDir); err != nil {
+		log.Fatal(err)
+	}
+	entries, err := cacheEntries()
+	if err != nil {
+		log.Fatalf("Error reading cache directory %q: %s", cacheDir, err)
+	}
+	switch args[0] {
+	case "namespaces":
+		var names []string
+		for ns := range entries {
+			names = append(names, ns)
+		}
+		sort.Strings(names)
+		for _, ns := range names {
+			var size int64
+			for _, f := range entries[ns] {
+				size += f.Size()
+			}
+			fmt.Fprintf(dataOut, "%s\t%d entries\t%d bytes\n", ns, len(entries[ns]), size)
+		}
+	case "ls":
+		files := entries[cacheNamespace]
+		sort.Slice(files, func(i, j int) bool { return files[i].ModTime().After(files[j].ModTime()) })
+		for _, f := range files {
+			source := "-"
+			if meta, err := readCacheMeta(filepath.Join(cacheDir, f.Name())); err == nil {
+				source = meta.URL
+			}
+			fmt.Fprintf(dataOut, "%s\t%s\t%s\n", cacheAge(f), humanSize(f.Size()), source)
+		}
+	case "stat":
+		if len(args) < 2 {
+			log.Fatalf("Usage: cache stat URL...")
+		}
+		for _, arg := range args[1:] {
+			file := cacheURLFile(arg)
+			f, err := os.Stat(file)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s is not cached\n", arg)
+				continue
+			}
+			fmt.Fprintf(dataOut, "URL: %s\nFile: %s\nSize: %d\nAge: %s\n", arg, file, f.Size(), cacheAge(f))
+			if since(f.ModTime()) < maxAge {
+				fmt.Fprintf(dataOut, "Fresh: true\n")
+			} else {
+				fmt.Fprintf(dataOut, "Fresh: false\n")
+			}
+			if meta, err := readCacheMeta(file); err == nil {
+				if meta.ETag != "" {
+					fmt.Fprintf(dataOut, "ETag: %s\n", meta.ETag)
+				}
+				if meta.LastModified != "" {
+					fmt.Fprintf(dataOut, "Last-Modified: %s\n", meta.LastModified)
+				}
+			}
+			fmt.Fprintln(dataOut)
+		}
+	case "rm":
+		if len(args) < 2 {
+			log.Fatalf("Usage: cache rm URL...")
+		}
+		failed := false
+		for _, arg := range args[1:] {
+			file := cacheURLFile(arg)
+			if err := os.Remove(file); err != nil {
+				fmt.Fprintf(os.Stderr, "Unable to remove %s: %s\n", arg, err)
+				failed = true
+			}
+			os.Remove(file + ".meta")
+		}
+		if failed {
+			os.Exit(1)
+		}
+	case "prune":
+		// entries older than the given age, by default --max-age
+		age := maxAge
+		if len(args) > 1 {
+			if age, err = time.ParseDuration(args[1]); err != nil {
+				log.Fatalf("Invalid age %q: %s", args[1], err)
+			}
+		}
+		var count int
+		var size int64
+		for _, f := range entries[cacheNamespace] {
+			if since(f.ModTime()) < age {
+				continue
+			}
+			file := filepath.Join(cacheDir, f.Name())
+			if err := os.Remove(file); err != nil {
+				fmt.Fprintf(os.Stderr, "Unable to remove %s: %s\n", file, err)
+				continue
+			}
+			os.Remove(file + ".meta")
+			count++
+			size += f.Size()
+		}
+		fmt.Fprintf(dataOut, "Removed %d entries, %s\n", count, humanSize(size))
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown cache command %q, use namespaces, ls, stat, rm or prune\n", args[0])
+		os.Exit(1)
+	}
+}
+
+// cacheAge formats how long ago a cache entry was written
+func cacheAge(f os.FileInfo) string {
+	return since(f.ModTime()).Round(time.Second).String()
+}
+
+// cacheURLFile finds the cache entry of a URL the way a query would
+func cacheURLFile(arg string) string {
+	arg = presetURL(fixIPv6Zone(arg))
+	if u, err := url.Parse(arg); err == nil && idnURL(u) == nil {
+		arg = u.String()
+	}
+	return cacheFileName(arg)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/pschou/jqURL/pkg/jqurl"
+)
+
+// cacheMeta is kept beside each cache entry, in the same name with a .meta
+// suffix, so an expired entry can be revalidated instead of downloaded again
+type cacheMeta struct {
+	URL          string    `json:"url"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	Fetched      time.Time `json:"fetched"`
+
+	// the response, for --with-metadata
+	Final  string            `json:"final_url,omitempty"`
+	Status int               `json:"status,omitempty"`
+	Header map[string]string `json:"headers,omitempty"`
+}
+
+// readCacheMeta loads the metadata of a cache entry
+func readCacheMeta(cacheFile string) (*cacheMeta, error) {
+	byt, err := ioutil.ReadFile(cacheFile + ".meta")
+	if err != nil {
+		return nil, err
+	}
+	meta := &cacheMeta{}
+	return meta, json.Unmarshal(byt, meta)
+}
+
+// writeCacheMeta saves the validators of the response which filled a cache
+// entry, a 304 without them keeps the ones already stored
+func writeCacheMeta(cacheFile, target string, resp *http.Response) {
+	meta, err := readCacheMeta(cacheFile)
+	if err != nil || meta.URL != target {
+		meta = &cacheMeta{}
+	}
+	meta.URL, meta.Fetched = target, clock.Now().UTC()
+	if resp != nil {
+		if etag := resp.Header.Get("ETag"); etag != "" || resp.StatusCode != http.StatusNotModified {
+			meta.ETag = etag
+		}
+		if mod := resp.Header.Get("Last-Modified"); mod != "" || resp.StatusCode != http.StatusNotModified {
+			meta.LastModified = mod
+		}
+		if resp.StatusCode != http.StatusNotModified {
+			meta.Final, meta.Status, meta.Header = target, resp.StatusCode, headerObject(resp.Header)
+			if resp.Request != nil {
+				meta.Final = resp.Request.URL.String()
+			}
+		}
+	}
+	byt, _ := json.Marshal(meta)
+	if err := writeAtomic(cacheFile+".meta", byt, 0644); err != nil && debug {
+		log.Printf("Error writing cache metadata: %s", err)
+	}
+}
+
+// conditionalFetch makes the fetch of an expired cache entry conditional on
+// its ETag or Last-Modified, so a 304 Not Modified reuses the cached body
+func conditionalFetch(opts *jqurl.Options, cacheFile string) {
+	if !useCache || flush || followPages || len(opts.URLs) != 1 {
+		return
+	}
+	if _, err := os.Stat(cacheFile); err != nil {
+		return
+	}
+	meta, err := readCacheMeta(cacheFile)
+	if err != nil || meta.URL != opts.URLs[0] || meta.ETag == "" && meta.LastModified == "" {
+		return
+	}
+	if _, ok := opts.Headers["if-none-match"]; !ok && meta.ETag != "" {
+		opts.Headers["if-none-match"] = meta.ETag
+	}
+	if _, ok := opts.Headers["if-modified-since"]; !ok && meta.LastModified != "" {
+		opts.Headers["if-modified-since"] = meta.LastModified
+	}
+	filter := opts.Filter
+	opts.Filter = func(resp *http.Response, body []byte) ([]byte, error) {
+		if resp.StatusCode == http.StatusNotModified {
+			if debug {
+				log.Println("not modified, reusing cache", cacheFile)
+			}
+			return ioutil.ReadFile(cacheFile)
+		}
+		if filter == nil {
+			return body, nil
+		}
+		return filter(resp, body)
+	}
+}
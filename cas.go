@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	casDir string
+	casMu  sync.Mutex
+)
+
+// casEntry is one line of the --cas-dir index, the history of what each URL
+// served
+type casEntry struct {
+	Time   string `json:"time"`
+	Method string `json:"method"`
+	URL    string `json:"url"`
+	SHA256 string `json:"sha256"`
+	Status int    `json:"status,omitempty"`
+	Size   int    `json:"size"`
+}
+
+// casObject is where a body with the given hash is kept
+func casObject(hash string) string {
+	return filepath.Join(casDir, "objects", hash[:2], hash[2:])
+}
+
+// recordCAS stores a fetched body under its SHA-256, once, and adds the
+// fetch to the index.  A failure is reported but doesn't stop the run.
+func recordCAS(reqMethod, target string, resp *http.Response, byt []byte) {
+	if casDir == "" {
+		return
+	}
+	if err := storeCAS(reqMethod, target, resp, byt); err != nil {
+		fmt.Fprintf(os.Stderr, "Error storing body of %s in %q: %s\n", target, casDir, err)
+	}
+}
+
+func storeCAS(reqMethod, target string, resp *http.Response, byt []byte) error {
+	sum := sha256.Sum256(byt)
+	hash := hex.EncodeToString(sum[:])
+	casMu.Lock()
+	defer casMu.Unlock()
+
+	obj := casObject(hash)
+	if _, err := os.Stat(obj); os.IsNotExist(err) {
+		if err = os.MkdirAll(filepath.Dir(obj), 0755); err != nil {
+			return err
+		}
+		// written aside and renamed, so a reader never sees part of a body
+		tmp, err := ioutil.TempFile(filepath.Dir(obj), ".tmp-")
+		if err != nil {
+			return err
+		}
+		_, err = tmp.Write(byt)
+		if cerr := tmp.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = os.Rename(tmp.Name(), obj)
+		}
+		if err != nil {
+			os.Remove(tmp.Name())
+			return err
+		}
+	}
+
+	e := casEntry{
+		Time:   clock.Now().UTC().Format(time.RFC3339),
+		Method: reqMethod,
+		URL:    target,
+		SHA256: hash,
+		Size:   len(byt),
+	}
+	if resp != nil {
+		e.Status = resp.StatusCode
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(casDir, "index.jsonl"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(line, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// casIndex reads the index, oldest first
+func casIndex() ([]casEntry, error) {
+	f, err := os.Open(filepath.Join(casDir, "index.jsonl"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries []casEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		var e casEntry
+		if json.Unmarshal(scanner.Bytes(), &e) == nil && len(e.SHA256) == 64 {
+			entries = append(entries, e)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// casResolve expands a hash prefix of at least 4 characters, as git does
+func casResolve(prefix string) (string, error) {
+	prefix = strings.ToLower(prefix)
+	if len(prefix) < 4 {
+		return "", fmt.Errorf("hash %q is too short, give at least 4 characters", prefix)
+	}
+	if strings.Trim(prefix, "0123456789abcdef") != "" {
+		return "", fmt.Errorf("%q is not a hash", prefix)
+	}
+	dir := filepath.Join(casDir, "objects", prefix[:2])
+	files, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	var found []string
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), prefix[2:]) && !strings.HasPrefix(f.Name(), ".") {
+			found = append(found, prefix[:2]+f.Name())
+		}
+	}
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("no body with hash %s in %q", prefix, casDir)
+	case 1:
+		return found[0], nil
+	}
+	return "", fmt.Errorf("hash %s is ambiguous, it matches %d bodies", prefix, len(found))
+}
+
+// casCommand handles "cas show HASH [QUERY]", "cas log [URL]" and "cas ls"
+func casCommand(args []string) {
+	if casDir == "" {
+		casDir = os.Getenv("JQURL_CAS_DIR")
+	}
+	if casDir == "" {
+		log.Fatal("Give the store with --cas-dir DIR or $JQURL_CAS_DIR")
+	}
+	if err := checkRead(casDir); err != nil {
+		log.Fatal(err)
+	}
+	if len(args) == 0 {
+		args = []string{"ls"}
+	}
+	switch args[0] {
+	case "show":
+		if len(args) < 2 || len(args) > 3 {
+			log.Fatalf("Usage: cas show HASH [QUERY]")
+		}
+		hash, err := casResolve(args[1])
+		if err != nil {
+			log.Fatal(err)
+		}
+		byt, err := ioutil.ReadFile(casObject(hash))
+		if err != nil {
+			log.Fatalf("Error reading body %s: %s", hash, err)
+		}
+		var v interface{}
+		if err = json.Unmarshal(byt, &v); err != nil {
+			log.Fatalf("Body %s is not JSON: %s", hash, err)
+		}
+		JQString = "."
+		if len(args) == 3 {
+			JQString = args[2]
+		}
+		runQuery(v)
+	case "log":
+		entries, err := casIndex()
+		if err != nil {
+			log.Fatalf("Error reading index: %s", err)
+		}
+		for _, e := range entries {
+			if len(args) > 1 && e.URL != args[1] {
+				continue
+			}
+			fmt.Fprintf(dataOut, "%s\t%s\t%d\t%s\t%s %s\n", e.Time, e.SHA256[:12], e.Status, humanSize(int64(e.Size)), e.Method, e.URL)
+		}
+	case "ls":
+		entries, err := casIndex()
+		if err != nil {
+			log.Fatalf("Error reading index: %s", err)
+		}
+		// the latest body of each URL and how many it has served
+		type urlSummary struct {
+			last   casEntry
+			bodies map[string]bool
+		}
+		var order []string
+		urls := make(map[string]*urlSummary)
+		for _, e := range entries {
+			u, ok := urls[e.URL]
+			if !ok {
+				u = &urlSummary{bodies: make(map[string]bool)}
+				urls[e.URL] = u
+				order = append(order, e.URL)
+			}
+			u.last = e
+			u.bodies[e.SHA256] = true
+		}
+		for _, target := range order {
+			u := urls[target]
+			fmt.Fprintf(dataOut, "%s\t%s\t%d bodies\t%s\n", u.last.Time, u.last.SHA256[:12], len(u.bodies), target)
+		}
+	default:
+		log.Fatalf("Usage: cas show HASH [QUERY] | log [URL] | ls")
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	certType   string
+	keyPass    string
+	keyPassEnv string
+)
+
+// opensslTool reads PKCS#12 bundles and decrypts keys, Go only has the
+// legacy PEM encryption built in and no PKCS#12 at all
+var opensslTool = "openssl"
+
+// loadCertFile reads a client certificate and key from files, a PEM pair or
+// a PKCS#12 bundle, decrypting the key with --pass, --key-pass-env or else
+// the passphrase openssl asks for on the terminal
+func loadCertFile(certFile, keyFile string) (tls.Certificate, error) {
+	typ := strings.ToUpper(certType)
+	if typ == "" {
+		switch strings.ToLower(filepath.Ext(certFile)) {
+		case ".p12", ".pfx":
+			typ = "P12"
+		default:
+			typ = "PEM"
+		}
+	}
+	if err := checkRead(certFile); err != nil {
+		return tls.Certificate{}, err
+	}
+	switch typ {
+	case "P12", "PKCS12":
+		out, err := openssl("pkcs12", "-in", certFile, "-nodes")
+		if oerr, ok := err.(opensslError); ok && bytes.Contains(oerr.out, []byte("unsupported")) {
+			// RC2 and 3DES bundles, as older tools make, need the legacy
+			// provider of OpenSSL 3
+			out, err = openssl("pkcs12", "-in", certFile, "-nodes", "-legacy")
+		}
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+		return leafFirstKeyPair(out)
+	case "PEM":
+	default:
+		return tls.Certificate{}, fmt.Errorf("unknown --cert-type %q, use PEM or P12", certType)
+	}
+
+	if keyFile == "" {
+		// Just in case the cert and key are in the same file
+		keyFile = certFile
+	}
+	if err := checkRead(keyFile); err != nil {
+		return tls.Certificate{}, err
+	}
+	certPEM, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyPEM, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if encryptedPEM(keyPEM) {
+		if keyPEM, err = openssl("pkey", "-in", keyFile); err != nil {
+			return tls.Certificate{}, err
+		}
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// encryptedPEM tells if the key in a PEM file needs a passphrase, as PKCS#8
+// or with the older Proc-Type header
+func encryptedPEM(byt []byte) bool {
+	for {
+		var block *pem.Block
+		if block, byt = pem.Decode(byt); block == nil {
+			return false
+		}
+		if block.Type == "ENCRYPTED PRIVATE KEY" || strings.Contains(block.Headers["Proc-Type"], "ENCRYPTED") {
+			return true
+		}
+	}
+}
+
+// leafFirstKeyPair makes a certificate of the PEM openssl wrote out of a
+// bundle, which lists the key and the certificates in no set order
+func leafFirstKeyPair(out []byte) (tls.Certificate, error) {
+	var keyPEM []byte
+	var certs [][]byte
+	for rest := out; ; {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			certs = append(certs, pem.EncodeToMemory(block))
+		} else if strings.HasSuffix(block.Type, "PRIVATE KEY") && keyPEM == nil {
+			keyPEM = pem.EncodeToMemory(block)
+		}
+	}
+	if keyPEM == nil || len(certs) == 0 {
+		return tls.Certificate{}, fmt.Errorf("the bundle has no certificate with a private key")
+	}
+	for i, leaf := range certs {
+		chain := append([][]byte{leaf}, certs[:i]...)
+		chain = append(chain, certs[i+1:]...)
+		if pair, err := tls.X509KeyPair(bytes.Join(chain, nil), keyPEM); err == nil {
+			return pair, nil
+		}
+	}
+	return tls.Certificate{}, fmt.Errorf("no certificate in the bundle is for its private key")
+}
+
+// opensslError keeps what openssl said, to tell why it failed
+type opensslError struct {
+	err   error
+	out   []byte
+	shown bool // out went to stderr as well
+}
+
+func (e opensslError) Error() string {
+	if e.shown {
+		return fmt.Sprintf("%s: %s", opensslTool, e.err)
+	}
+	return fmt.Sprintf("%s: %s: %s", opensslTool, e.err, strings.TrimSpace(string(e.out)))
+}
+
+// openssl runs an openssl command which reads a passphrase, handing it over
+// in the environment rather than on the command line where ps shows it
+func openssl(args ...string) ([]byte, error) {
+	if _, err := exec.LookPath(opensslTool); err != nil {
+		return nil, fmt.Errorf("PKCS#12 bundles and encrypted keys need %s, which was not found", opensslTool)
+	}
+	cmd := exec.Command(opensslTool, args...)
+	cmd.Env = os.Environ()
+	pass, ok := keyPass, keyPass != ""
+	if keyPassEnv != "" {
+		pass, ok = os.LookupEnv(keyPassEnv)
+		if !ok {
+			return nil, fmt.Errorf("$%s, given with --key-pass-env, is not set", keyPassEnv)
+		}
+	}
+	if ok {
+		cmd.Env = append(cmd.Env, "JQURL_KEY_PASS="+pass)
+		cmd.Args = append(cmd.Args, "-passin", "env:JQURL_KEY_PASS")
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if !ok {
+		// openssl asks for the passphrase on the terminal
+		cmd.Stdin, cmd.Stderr = os.Stdin, io.MultiWriter(os.Stderr, &stderr)
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, opensslError{err: err, out: stderr.Bytes(), shown: !ok}
+	}
+	return out, nil
+}
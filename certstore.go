@@ -0,0 +1,39 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// certStorePrefix picks a client certificate from the OS certificate store
+// by name in --cert, such as store:MySubjectName, instead of a PEM file
+const certStorePrefix = "store:"
+
+// storeCertMatch reports whether a certificate from the OS store is the one
+// asked for, by subject common name, any part of the subject, or SHA-1
+// thumbprint, and is valid now
+func storeCertMatch(c *x509.Certificate, name string) bool {
+	now := time.Now()
+	if now.Before(c.NotBefore) || now.After(c.NotAfter) {
+		return false
+	}
+	sum := sha1.Sum(c.Raw)
+	thumb := strings.ToLower(strings.NewReplacer(" ", "", ":", "").Replace(name))
+	return strings.EqualFold(c.Subject.CommonName, name) || thumb == hex.EncodeToString(sum[:]) ||
+		strings.Contains(strings.ToLower(c.Subject.String()), strings.ToLower(name))
+}
+
+// derECDSASig turns an ECDSA signature given as r and s side by side, as CNG
+// and PKCS#11 give them, into the DER encoding TLS wants
+func derECDSASig(sig []byte) ([]byte, error) {
+	half := len(sig) / 2
+	return asn1.Marshal(struct{ R, S *big.Int }{
+		new(big.Int).SetBytes(sig[:half]),
+		new(big.Int).SetBytes(sig[half:]),
+	})
+}
@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+)
+
+// storeCert is only possible on Windows, the macOS Keychain can only be
+// reached through cgo which the static build leaves out
+func storeCert(name string) (tls.Certificate, error) {
+	return tls.Certificate{}, errors.New("client certificates from the OS certificate store are only supported on Windows")
+}
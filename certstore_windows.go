@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	crypt32 = syscall.NewLazyDLL("crypt32.dll")
+	ncrypt  = syscall.NewLazyDLL("ncrypt.dll")
+
+	procCryptAcquireCertificatePrivateKey = crypt32.NewProc("CryptAcquireCertificatePrivateKey")
+	procNCryptSignHash                    = ncrypt.NewProc("NCryptSignHash")
+)
+
+const (
+	certStoreProvSystem         = 10
+	certSystemStoreCurrentUser  = 1 << 16
+	certSystemStoreLocalMachine = 2 << 16
+	certStoreReadOnly           = 0x00008000
+
+	cryptAcquireSilent          = 0x00000040
+	cryptAcquirePreferNCryptKey = 0x00020000
+	certNCryptKeySpec           = 0xFFFFFFFF
+
+	bcryptPadPKCS1 = 0x2
+	bcryptPadPSS   = 0x8
+)
+
+type bcryptPKCS1PaddingInfo struct {
+	algID *uint16
+}
+
+type bcryptPSSPaddingInfo struct {
+	algID *uint16
+	salt  uint32
+}
+
+// storeCert finds a client certificate by name in the personal ("My") store
+// of the current user, then of the machine, leaving its private key in the
+// store and signing through CNG
+func storeCert(name string) (tls.Certificate, error) {
+	for _, location := range []uint32{certSystemStoreCurrentUser, certSystemStoreLocalMachine} {
+		c, err := storeCertIn(location, name)
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+		if c != nil {
+			return *c, nil
+		}
+	}
+	return tls.Certificate{}, fmt.Errorf("no valid certificate matching %q in the personal certificate stores", name)
+}
+
+func storeCertIn(location uint32, name string) (*tls.Certificate, error) {
+	storeName, _ := syscall.UTF16PtrFromString("MY")
+	store, err := syscall.CertOpenStore(certStoreProvSystem, 0, 0, location|certStoreReadOnly, uintptr(unsafe.Pointer(storeName)))
+	if err != nil {
+		return nil, fmt.Errorf("opening certificate store: %s", err)
+	}
+	defer syscall.CertCloseStore(store, 0)
+
+	// of the matches, the one valid the longest is likely the newest
+	var best *x509.Certificate
+	var ctx *syscall.CertContext
+	for {
+		if ctx, err = syscall.CertEnumCertificatesInStore(store, ctx); ctx == nil {
+			break
+		}
+		c, err := x509.ParseCertificate(certContextBytes(ctx))
+		if err == nil && storeCertMatch(c, name) && (best == nil || c.NotAfter.After(best.NotAfter)) {
+			best = c
+		}
+	}
+	if best == nil {
+		return nil, nil
+	}
+
+	for {
+		if ctx, err = syscall.CertEnumCertificatesInStore(store, ctx); ctx == nil {
+			return nil, fmt.Errorf("certificate %q went missing from the store", best.Subject)
+		}
+		if bytes.Equal(certContextBytes(ctx), best.Raw) {
+			break
+		}
+	}
+	defer syscall.CertFreeCertificateContext(ctx)
+
+	var key uintptr
+	var keySpec uint32
+	var callerFree int32
+	ok, _, err := procCryptAcquireCertificatePrivateKey.Call(uintptr(unsafe.Pointer(ctx)),
+		cryptAcquireSilent|cryptAcquirePreferNCryptKey, 0,
+		uintptr(unsafe.Pointer(&key)), uintptr(unsafe.Pointer(&keySpec)), uintptr(unsafe.Pointer(&callerFree)))
+	if ok == 0 {
+		return nil, fmt.Errorf("no usable private key for %q: %s", best.Subject, err)
+	}
+	if keySpec != certNCryptKeySpec {
+		return nil, fmt.Errorf("the private key of %q is held by a legacy CryptoAPI provider, only CNG keys are supported", best.Subject)
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{best.Raw},
+		PrivateKey:  &cngSigner{key: key, pub: best.PublicKey},
+		Leaf:        best,
+	}, nil
+}
+
+func certContextBytes(ctx *syscall.CertContext) []byte {
+	return unsafe.Slice(ctx.EncodedCert, ctx.Length)
+}
+
+// cngSigner signs TLS handshakes with a private key kept in the certificate
+// store, which never leaves it
+type cngSigner struct {
+	key uintptr
+	pub crypto.PublicKey
+}
+
+func (s *cngSigner) Public() crypto.PublicKey { return s.pub }
+
+func (s *cngSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	var padding unsafe.Pointer
+	var flags uint32
+	switch s.pub.(type) {
+	case *rsa.PublicKey:
+		var algID *uint16
+		if opts.HashFunc() != crypto.MD5SHA1 {
+			alg, ok := map[crypto.Hash]string{crypto.SHA1: "SHA1", crypto.SHA256: "SHA256", crypto.SHA384: "SHA384", crypto.SHA512: "SHA512"}[opts.HashFunc()]
+			if !ok {
+				return nil, fmt.Errorf("unsupported hash %s", opts.HashFunc())
+			}
+			algID, _ = syscall.UTF16PtrFromString(alg)
+		}
+		if _, ok := opts.(*rsa.PSSOptions); ok {
+			// TLS always uses a salt as long as the hash
+			padding, flags = unsafe.Pointer(&bcryptPSSPaddingInfo{algID: algID, salt: uint32(opts.HashFunc().Size())}), bcryptPadPSS
+		} else {
+			padding, flags = unsafe.Pointer(&bcryptPKCS1PaddingInfo{algID: algID}), bcryptPadPKCS1
+		}
+	case *ecdsa.PublicKey:
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", s.pub)
+	}
+
+	var size uint32
+	if status, _, _ := procNCryptSignHash.Call(s.key, uintptr(padding), uintptr(unsafe.Pointer(&digest[0])), uintptr(len(digest)),
+		0, 0, uintptr(unsafe.Pointer(&size)), uintptr(flags)); status != 0 {
+		return nil, fmt.Errorf("NCryptSignHash: status 0x%x", status)
+	}
+	sig := make([]byte, size)
+	if status, _, _ := procNCryptSignHash.Call(s.key, uintptr(padding), uintptr(unsafe.Pointer(&digest[0])), uintptr(len(digest)),
+		uintptr(unsafe.Pointer(&sig[0])), uintptr(size), uintptr(unsafe.Pointer(&size)), uintptr(flags)); status != 0 {
+		return nil, fmt.Errorf("NCryptSignHash: status 0x%x", status)
+	}
+	sig = sig[:size]
+
+	if _, ok := s.pub.(*ecdsa.PublicKey); ok {
+		return derECDSASig(sig)
+	}
+	return sig, nil
+}
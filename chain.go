@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/itchyny/gojq"
+	"github.com/pschou/jqURL/pkg/jqurl"
+)
+
+var (
+	thenURLs    []string
+	thenHeaders []string
+	thenData    string
+	thenQuery   = "."
+
+	templateCode = map[string]*gojq.Code{}
+)
+
+// fillTemplate replaces each {{EXPR}} in s with the first output of the jq
+// expression run on v.  Strings go in as they are (use @uri to escape one for
+// a URL), anything else as JSON.
+func fillTemplate(s string, v interface{}) (string, error) {
+	var out strings.Builder
+	for {
+		start := strings.Index(s, "{{")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(s[start:], "}}")
+		if end < 0 {
+			return "", fmt.Errorf("unclosed {{ in %q", s)
+		}
+		expr := strings.TrimSpace(s[start+2 : start+end])
+		code, ok := templateCode[expr]
+		if !ok {
+			var err error
+			if code, err = compileJQ(expr); err != nil {
+				return "", err
+			}
+			templateCode[expr] = code
+		}
+		val, _ := runJQ(code, v).Next()
+		if err, ok := val.(error); ok {
+			return "", fmt.Errorf("{{%s}}: %s", expr, err)
+		}
+		out.WriteString(s[:start])
+		switch val := val.(type) {
+		case nil:
+		case string:
+			out.WriteString(val)
+		default:
+			byt, _ := json.Marshal(val)
+			out.Write(byt)
+		}
+		s = s[start+end+2:]
+	}
+	out.WriteString(s)
+	return out.String(), nil
+}
+
+// thenStage splits a --then value into its method and URL template, the
+// method defaults to GET, or POST with --then-data
+func thenStage(stage string) (string, string) {
+	if parts := strings.Fields(stage); len(parts) == 2 && strings.ToUpper(parts[0]) == parts[0] {
+		return parts[0], parts[1]
+	}
+	if thenData != "" {
+		return "POST", stage
+	}
+	return "GET", stage
+}
+
+// runChain sends a --then request for each output of the query, filling its
+// URL, --then-header and --then-data templates from the output.  Each further
+// --then stage is filled from the body fetched by the one before, and the
+// bodies of the last stage are run through --then-query for the output.
+func runChain(client *http.Client, input interface{}) {
+	code, err := compileJQ(JQString)
+	if err != nil {
+		log.Fatalf("Error %s", err)
+	}
+	var values []interface{}
+	for _, in := range inputDocs(input) {
+		iter := runJQ(code, graphqlData(in))
+		for {
+			v, ok := iter.Next()
+			if !ok {
+				break
+			}
+			if err, ok := v.(error); ok {
+				log.Fatalf("Error running jq query %q: %s", JQString, err)
+			}
+			values = append(values, v)
+		}
+	}
+
+	failed := 0
+	for n, stage := range thenURLs {
+		var next []interface{}
+		for _, v := range values {
+			body, err := chainFetch(client, stage, v)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error in --then stage %d: %s\n", n+1, err)
+				failed++
+				continue
+			}
+			next = append(next, body)
+		}
+		values = next
+	}
+
+	JQString, queryCode = thenQuery, nil
+	for _, v := range values {
+		queryInput(v)
+	}
+	finishQuery()
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// chainFetch makes one --then request from a value
+func chainFetch(client *http.Client, stage string, v interface{}) (interface{}, error) {
+	reqMethod, tmpl := thenStage(stage)
+	target, err := fillTemplate(tmpl, v)
+	if err != nil {
+		return nil, err
+	}
+	if err = validateRequest(reqMethod, Headers, []string{target}); err != nil {
+		return nil, err
+	}
+	opts := fetchOptions(client)
+	opts.URLs, opts.Method, opts.Body = []string{target}, reqMethod, nil
+	delete(opts.Headers, "content-type")
+	for _, h := range thenHeaders {
+		filled, err := fillTemplate(h, v)
+		if err != nil {
+			return nil, err
+		}
+		parts := strings.SplitN(filled, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("malformed --then-header %q", h)
+		}
+		opts.Headers[strings.ToLower(strings.TrimSpace(parts[0]))] = strings.TrimSpace(parts[1])
+	}
+	if thenData != "" {
+		data, err := fillTemplate(thenData, v)
+		if err != nil {
+			return nil, err
+		}
+		opts.Body = jqurl.BytesBody([]byte(data))
+		if _, ok := opts.Headers["content-type"]; !ok {
+			if val, ok := Headers["content-type"]; ok {
+				opts.Headers["content-type"] = val
+			} else if json.Valid([]byte(data)) {
+				opts.Headers["content-type"] = "application/json"
+			}
+		}
+	}
+	res, err := fetchDo(opts)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %s", reqMethod, target, err)
+	}
+	keepTrailers(res.Response)
+	var body interface{}
+	if err = json.Unmarshal(res.Body, &body); err != nil {
+		return nil, err
+	}
+	if followPages {
+		if body, err = getPages(client, res.Response, body); err != nil {
+			return nil, err
+		}
+	}
+	recordFreeze(reqMethod, target, res.Response, res.Body)
+	recordCAS(reqMethod, target, res.Response, res.Body)
+	return body, nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/itchyny/gojq"
+	"github.com/pschou/jqURL/pkg/jqurl"
+)
+
+var (
+	fakeTime string
+
+	// clock is the time used for cache ages, waits between tries and the
+	// timestamps written to files, a jqurl.FakeClock with --fake-time
+	clock jqurl.Clock = jqurl.SystemClock
+)
+
+// loadClock starts a clock standing still at --fake-time, or
+// $JQURL_FAKE_TIME, given as RFC 3339 or in seconds since the epoch.  It
+// only moves on when jqurl waits, which it then does at once.
+func loadClock() error {
+	if fakeTime == "" {
+		fakeTime = os.Getenv("JQURL_FAKE_TIME")
+	}
+	if fakeTime == "" {
+		return nil
+	}
+	start, err := time.Parse(time.RFC3339, fakeTime)
+	if err != nil {
+		secs, serr := strconv.ParseFloat(fakeTime, 64)
+		if serr != nil {
+			return fmt.Errorf("bad --fake-time %q, give an RFC 3339 time or epoch seconds", fakeTime)
+		}
+		start = time.Unix(0, int64(secs*1e9)).UTC()
+	}
+	clock = jqurl.NewFakeClock(start)
+	return nil
+}
+
+// since is the time elapsed from t by the clock
+func since(t time.Time) time.Duration {
+	return clock.Now().Sub(t)
+}
+
+// compileFakeNow is jqurl.Compile with "now" defined from the fake clock, as
+// gojq's own reads the system time
+func compileFakeNow(expr string, opts []gojq.CompilerOption) (*gojq.Code, error) {
+	query, err := gojq.Parse(expr)
+	if err != nil {
+		return nil, fmt.Errorf("parsing jq query %q: %s", expr, err)
+	}
+	def, _ := gojq.Parse("def now: _clock_now; .")
+	query.FuncDefs = append(def.FuncDefs, query.FuncDefs...)
+	opts = append(opts, gojq.WithFunction("_clock_now", 0, 0, func(interface{}, []interface{}) interface{} {
+		return float64(clock.Now().UnixNano()) / 1e9
+	}))
+	code, err := gojq.Compile(query, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("compiling jq query %q: %s", expr, err)
+	}
+	return code, nil
+}
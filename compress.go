@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+var (
+	compressed bool
+
+	// errEncoding is not worth retrying, the next reply will be no different
+	errEncoding = errors.New("unsupported Content-Encoding")
+)
+
+// externalDecoders are the content codings Go has no decoder for, handed to
+// the command line tools when they are installed
+var externalDecoders = map[string][]string{
+	"br":   {"brotli", "-dc"},
+	"zstd": {"zstd", "-dc"},
+}
+
+// acceptEncoding lists the codings --compressed asks for, brotli and zstd
+// only when their tools are found
+func acceptEncoding() string {
+	codings := []string{"gzip", "deflate"}
+	for _, coding := range []string{"br", "zstd"} {
+		if _, err := exec.LookPath(externalDecoders[coding][0]); err == nil {
+			codings = append(codings, coding)
+		}
+	}
+	return strings.Join(codings, ", ")
+}
+
+// decodeTransport undoes the Content-Encoding of every response, so bodies
+// are parsed, paged and cached decoded whichever request fetched them.  Go
+// only does this itself for gzip, and only when it asked for it.
+type decodeTransport struct {
+	next http.RoundTripper
+}
+
+func withDecoding(next http.RoundTripper) http.RoundTripper {
+	return &decodeTransport{next: next}
+}
+
+func (t *decodeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if compressed && req.Header.Get("Accept-Encoding") == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("Accept-Encoding", acceptEncoding())
+	}
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || resp.Header.Get("Content-Encoding") == "" {
+		return resp, err
+	}
+	var codings []string
+	for _, coding := range strings.Split(resp.Header.Get("Content-Encoding"), ",") {
+		if coding = strings.ToLower(strings.TrimSpace(coding)); coding != "" && coding != "identity" {
+			codings = append(codings, coding)
+		}
+	}
+	// the last coding applied is the first to undo
+	body := resp.Body
+	for i := len(codings) - 1; i >= 0; i-- {
+		if body, err = decodeBody(codings[i], body); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+	}
+	resp.Body = body
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return resp, nil
+}
+
+// decodeBody wraps a body in the decoder for one content coding
+func decodeBody(coding string, body io.ReadCloser) (io.ReadCloser, error) {
+	var open func(r *bufio.Reader) (io.Reader, error)
+	switch coding {
+	case "gzip", "x-gzip":
+		open = func(r *bufio.Reader) (io.Reader, error) { return gzip.NewReader(r) }
+	case "deflate":
+		open = func(r *bufio.Reader) (io.Reader, error) {
+			// meant to be zlib wrapped, but some servers send raw deflate
+			if head, err := r.Peek(2); err == nil && (uint(head[0])<<8|uint(head[1]))%31 == 0 && head[0]&0x0f == 8 {
+				return zlib.NewReader(r)
+			}
+			return flate.NewReader(r), nil
+		}
+	default:
+		tool, ok := externalDecoders[coding]
+		if !ok {
+			return nil, fmt.Errorf("%w %q", errEncoding, coding)
+		}
+		if _, err := exec.LookPath(tool[0]); err != nil {
+			return nil, fmt.Errorf("%w %q, the %s command was not found", errEncoding, coding, tool[0])
+		}
+		open = func(r *bufio.Reader) (io.Reader, error) {
+			cmd := exec.Command(tool[0], tool[1:]...)
+			cmd.Stdin, cmd.Stderr = r, os.Stderr
+			out, err := cmd.StdoutPipe()
+			if err != nil {
+				return nil, err
+			}
+			if err = cmd.Start(); err != nil {
+				return nil, err
+			}
+			return &cmdReader{out: out, cmd: cmd}, nil
+		}
+	}
+	return &decodedBody{body: body, open: open}, nil
+}
+
+// decodedBody starts its decoder on the first read, so an empty body, as
+// sent with a HEAD or 304, is not an error
+type decodedBody struct {
+	body io.ReadCloser
+	open func(r *bufio.Reader) (io.Reader, error)
+	r    io.Reader
+}
+
+func (d *decodedBody) Read(p []byte) (int, error) {
+	if d.r == nil {
+		r, err := d.open(bufio.NewReader(d.body))
+		if err != nil {
+			return 0, fmt.Errorf("decoding body: %s", err)
+		}
+		d.r = r
+	}
+	return d.r.Read(p)
+}
+
+func (d *decodedBody) Close() error {
+	if c, ok := d.r.(io.Closer); ok {
+		c.Close()
+	}
+	return d.body.Close()
+}
+
+// cmdReader reads the output of a decoder command, reporting its failure
+// rather than a short body
+type cmdReader struct {
+	out  io.ReadCloser
+	cmd  *exec.Cmd
+	done bool
+}
+
+func (c *cmdReader) Read(p []byte) (int, error) {
+	n, err := c.out.Read(p)
+	if err == io.EOF && !c.done {
+		c.done = true
+		if werr := c.cmd.Wait(); werr != nil {
+			return n, fmt.Errorf("%s: %s", c.cmd.Path, werr)
+		}
+	}
+	return n, err
+}
+
+func (c *cmdReader) Close() error {
+	c.out.Close()
+	if !c.done {
+		c.done = true
+		c.cmd.Process.Kill()
+		c.cmd.Wait()
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pschou/go-params"
+)
+
+var (
+	configFile  string
+	profileName string
+
+	// configLoaded is the config file the profile came from, checked
+	// against --read-allow once the flags are parsed
+	configLoaded string
+)
+
+// configPaths are where the config file is looked for, unless --config or
+// $JQURL_CONFIG says otherwise
+func configPaths() []string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return nil
+	}
+	dir = filepath.Join(dir, "jqurl")
+	return []string{filepath.Join(dir, "config.yaml"), filepath.Join(dir, "config.yml"), filepath.Join(dir, "config.toml")}
+}
+
+// flagValue finds the value of a flag in the raw arguments, before they are
+// parsed
+func flagValue(args []string, name string) string {
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		if arg == name && i+1 < len(args) {
+			return args[i+1]
+		}
+		if strings.HasPrefix(arg, name+"=") {
+			return strings.TrimPrefix(arg, name+"=")
+		}
+	}
+	return ""
+}
+
+// withProfile puts the flags of the chosen profile (--profile, or
+// $JQURL_PROFILE, or else the one named "default") in front of the command
+// line ones, so those given on the command line win
+func withProfile(args []string) ([]string, error) {
+	file := flagValue(args, "--config")
+	if file == "" {
+		file = os.Getenv("JQURL_CONFIG")
+	}
+	name := flagValue(args, "--profile")
+	if name == "" {
+		name = os.Getenv("JQURL_PROFILE")
+	}
+	explicit := file != ""
+	paths := []string{file}
+	if !explicit {
+		paths = configPaths()
+	}
+
+	var byt []byte
+	var err error
+	for _, file = range paths {
+		if byt, err = ioutil.ReadFile(file); err == nil || !os.IsNotExist(err) {
+			break
+		}
+	}
+	if err != nil {
+		if explicit || !os.IsNotExist(err) {
+			return nil, fmt.Errorf("reading config: %s", err)
+		}
+		if name != "" {
+			return nil, fmt.Errorf("no config file found for profile %q, looked for %s", name, strings.Join(paths, ", "))
+		}
+		return args, nil
+	}
+	configLoaded = file
+
+	var conf interface{}
+	if strings.HasSuffix(file, ".toml") {
+		conf, err = tomlUnmarshal(byt)
+	} else {
+		conf, err = yamlUnmarshal(byt)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading config %q: %s", file, err)
+	}
+	root, _ := conf.(map[string]interface{})
+	profiles, _ := root["profiles"].(map[string]interface{})
+	if name == "" {
+		if _, ok := profiles["default"]; !ok {
+			return args, nil
+		}
+		name = "default"
+	}
+	profile, ok := profiles[name].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("no profile %q in %q", name, file)
+	}
+
+	keys := make([]string, 0, len(profile))
+	for key := range profile {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	out := []string{args[0]}
+	for _, key := range keys {
+		flag := params.Lookup(key)
+		if flag == nil || len(key) < 2 || key == "profile" || key == "config" {
+			return nil, fmt.Errorf("unknown option %q in profile %q of %q", key, name, file)
+		}
+		switch val := profile[key].(type) {
+		case bool:
+			if val {
+				out = append(out, "--"+key)
+			}
+		case []interface{}:
+			for _, item := range val {
+				out = append(out, "--"+key, configString(item))
+			}
+		case map[string]interface{}:
+			// headers as HEADER: VALUE, or --arg style NAME=VALUE pairs
+			sep := "="
+			if strings.Contains(flag.TypeExpected, ":") {
+				sep = ": "
+			}
+			names := make([]string, 0, len(val))
+			for n := range val {
+				names = append(names, n)
+			}
+			sort.Strings(names)
+			for _, n := range names {
+				out = append(out, "--"+key, n+sep+configString(val[n]))
+			}
+		default:
+			out = append(out, "--"+key, configString(val))
+		}
+	}
+	return append(out, args[1:]...), nil
+}
+
+// configString turns a config value into a flag argument
+func configString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case nil:
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+// tomlUnmarshal decodes the part of TOML a config file needs: [tables] with
+// dotted names, and key = value lines holding strings, numbers, booleans and
+// arrays on one line
+func tomlUnmarshal(data []byte) (interface{}, error) {
+	root := map[string]interface{}{}
+	table := root
+	for n, line := range strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n") {
+		line = strings.TrimSpace(stripTomlComment(line))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			table = root
+			for _, part := range strings.Split(strings.Trim(line, "[]"), ".") {
+				part = strings.Trim(strings.TrimSpace(part), `"`)
+				next, ok := table[part].(map[string]interface{})
+				if !ok {
+					next = map[string]interface{}{}
+					table[part] = next
+				}
+				table = next
+			}
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("toml: line %d: expected key = value", n+1)
+		}
+		key := strings.Trim(strings.TrimSpace(parts[0]), `"`)
+		// TOML strings, numbers, booleans and arrays read the same as YAML
+		// flow values
+		val, err := parseYamlScalar(strings.TrimSpace(parts[1]), n+1)
+		if err != nil {
+			return nil, fmt.Errorf("toml: line %d: bad value %s", n+1, strings.TrimSpace(parts[1]))
+		}
+		table[key] = val
+	}
+	return root, nil
+}
+
+// stripTomlComment cuts a # comment off a line, outside of quotes
+func stripTomlComment(line string) string {
+	var quote rune
+	for i, r := range line {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote == 0 && (r == '"' || r == '\''):
+			quote = r
+		case quote == 0 && r == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// containerRuntimes are tried in turn to find a container when
+// --container-runtime doesn't pick one
+var containerRuntimes = []string{"docker", "podman", "nerdctl"}
+
+// errNoRuntime is returned when a container runtime isn't on this host
+var errNoRuntime = fmt.Errorf("not installed or not running")
+
+// containerPid finds the main process of a running container, by ID or
+// name, asking the Docker daemon over its socket or the podman or nerdctl
+// (containerd) command line
+func containerPid(container string) (int, error) {
+	runtimes := containerRuntimes
+	if containerRuntime != "" {
+		runtimes = []string{containerRuntime}
+	}
+	var errs []string
+	for _, rt := range runtimes {
+		var pid int
+		var err error
+		switch rt {
+		case "docker":
+			pid, err = dockerPid(container)
+		case "podman", "nerdctl":
+			pid, err = inspectPid(rt, container)
+		default:
+			return 0, fmt.Errorf("unknown container runtime %q, use docker, podman or nerdctl", rt)
+		}
+		if err == nil {
+			return pid, nil
+		}
+		if err != errNoRuntime || containerRuntime != "" {
+			errs = append(errs, rt+": "+err.Error())
+		}
+	}
+	if len(errs) == 0 {
+		return 0, fmt.Errorf("no container runtime found, tried %s", strings.Join(runtimes, ", "))
+	}
+	return 0, fmt.Errorf("%s", strings.Join(errs, "; "))
+}
+
+// dockerPid asks the Docker daemon, at $DOCKER_HOST or the usual socket
+func dockerPid(container string) (int, error) {
+	sock := "/var/run/docker.sock"
+	if host := os.Getenv("DOCKER_HOST"); host != "" {
+		if !strings.HasPrefix(host, "unix://") {
+			return 0, fmt.Errorf("only unix:// DOCKER_HOST is supported, not %q", host)
+		}
+		sock = strings.TrimPrefix(host, "unix://")
+	}
+	if _, err := os.Stat(sock); err != nil {
+		return 0, errNoRuntime
+	}
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", sock)
+			},
+		},
+	}
+	resp, err := client.Get("http://docker/containers/" + url.PathEscape(container) + "/json")
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return 0, fmt.Errorf("no such container %q", container)
+	} else if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("daemon answered %s", resp.Status)
+	}
+	var info struct {
+		State struct {
+			Pid int
+		}
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return 0, err
+	}
+	return runningPid(container, info.State.Pid)
+}
+
+// inspectPid runs "inspect" with the podman or nerdctl command line, which
+// both take the docker format
+func inspectPid(tool, container string) (int, error) {
+	if _, err := exec.LookPath(tool); err != nil {
+		return 0, errNoRuntime
+	}
+	cmd := exec.Command(tool, "inspect", "--type", "container", "--format", "{{.State.Pid}}", container)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return 0, fmt.Errorf("%s inspect %q: %s", tool, container, err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(out)))
+	if err != nil {
+		return 0, fmt.Errorf("%s inspect %q gave %q", tool, container, strings.TrimSpace(string(out)))
+	}
+	return runningPid(container, pid)
+}
+
+func runningPid(container string, pid int) (int, error) {
+	if pid <= 0 {
+		return 0, fmt.Errorf("container %q is not running", container)
+	}
+	return pid, nil
+}
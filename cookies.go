@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	cookies    []string
+	cookieFile string
+	cookieJar  = newCookieStore()
+)
+
+// cookieStore is the cookie jar shared by every request of a run, so a login
+// cookie is kept across redirects, retries and --then steps.  It also keeps
+// its own copy of each cookie, as cookiejar.Jar cannot list them, so they can
+// be saved to --cookie-jar.
+type cookieStore struct {
+	sync.Mutex
+	jar   *cookiejar.Jar
+	saved map[string]savedCookie
+	dirty bool
+}
+
+// savedCookie is one line of a Netscape (curl) cookie file
+type savedCookie struct {
+	Domain   string
+	Sub      bool
+	Path     string
+	Secure   bool
+	HTTPOnly bool
+	Expires  time.Time
+	Name     string
+	Value    string
+}
+
+func newCookieStore() *cookieStore {
+	jar, _ := cookiejar.New(nil)
+	return &cookieStore{jar: jar, saved: make(map[string]savedCookie)}
+}
+
+func (s *cookieStore) Cookies(u *url.URL) []*http.Cookie {
+	return s.jar.Cookies(u)
+}
+
+func (s *cookieStore) SetCookies(u *url.URL, cs []*http.Cookie) {
+	s.jar.SetCookies(u, cs)
+	s.Lock()
+	defer s.Unlock()
+	for _, c := range cs {
+		sc := savedCookie{
+			Domain:   strings.ToLower(strings.TrimPrefix(c.Domain, ".")),
+			Sub:      c.Domain != "",
+			Path:     c.Path,
+			Secure:   c.Secure,
+			HTTPOnly: c.HttpOnly,
+			Expires:  c.Expires,
+			Name:     c.Name,
+			Value:    c.Value,
+		}
+		if sc.Domain == "" {
+			sc.Domain = strings.ToLower(u.Hostname())
+		}
+		if !strings.HasPrefix(sc.Path, "/") {
+			sc.Path = cookiePath(u.Path)
+		}
+		if c.MaxAge > 0 {
+			sc.Expires = clock.Now().Add(time.Duration(c.MaxAge) * time.Second)
+		}
+		key := sc.Domain + ";" + sc.Path + ";" + sc.Name
+		if c.MaxAge < 0 || (!sc.Expires.IsZero() && sc.Expires.Before(clock.Now())) {
+			if domainMatch(u.Hostname(), sc.Domain) {
+				delete(s.saved, key)
+				s.dirty = true
+			}
+		} else if s.accepted(sc) {
+			s.saved[key] = sc
+			s.dirty = true
+		}
+	}
+}
+
+// accepted tells if the jar took a cookie, which it does not for one set
+// for a domain other than the host's own or a parent of it
+func (s *cookieStore) accepted(sc savedCookie) bool {
+	host := sc.Domain
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	for _, c := range s.jar.Cookies(&url.URL{Scheme: "https", Host: host, Path: sc.Path}) {
+		if c.Name == sc.Name && c.Value == sc.Value {
+			return true
+		}
+	}
+	return false
+}
+
+// domainMatch tells if a cookie domain is the host or, for a name, a parent
+// domain of it
+func domainMatch(host, domain string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == domain {
+		return true
+	}
+	return net.ParseIP(host) == nil && strings.HasSuffix(host, "."+domain)
+}
+
+// cookiePath is the default path of a cookie set without one, the directory
+// of the request path
+func cookiePath(p string) string {
+	if i := strings.LastIndex(p, "/"); i > 0 {
+		return p[:i]
+	}
+	return "/"
+}
+
+// loadCookies reads a Netscape format cookie file, as written by curl -c or
+// browser export tools, into the jar
+func loadCookies(file string) error {
+	if err := checkRead(file); err != nil {
+		return err
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		httpOnly := strings.HasPrefix(line, "#HttpOnly_")
+		line = strings.TrimPrefix(line, "#HttpOnly_")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) != 7 {
+			return fmt.Errorf("%s:%d: expected 7 tab separated fields", file, n)
+		}
+		expires, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s:%d: bad expiry %q", file, n, fields[4])
+		}
+		c := &http.Cookie{
+			Path:     fields[2],
+			Secure:   fields[3] == "TRUE",
+			HttpOnly: httpOnly,
+			Name:     fields[5],
+			Value:    fields[6],
+		}
+		if expires > 0 {
+			c.Expires = time.Unix(expires, 0)
+			if c.Expires.Before(clock.Now()) {
+				continue
+			}
+		}
+		host := strings.TrimPrefix(fields[0], ".")
+		if fields[1] == "TRUE" {
+			c.Domain = host
+		}
+		scheme := "http"
+		if c.Secure {
+			scheme = "https"
+		}
+		cookieJar.SetCookies(&url.URL{Scheme: scheme, Host: host, Path: c.Path}, []*http.Cookie{c})
+	}
+	cookieJar.dirty = false
+	return scanner.Err()
+}
+
+// saveCookies writes the jar back to --cookie-jar if any cookie changed
+func saveCookies() {
+	s := cookieJar
+	s.Lock()
+	defer s.Unlock()
+	if cookieFile == "" || !s.dirty {
+		return
+	}
+	var lines []string
+	for _, c := range s.saved {
+		domain, sub := c.Domain, "FALSE"
+		if c.Sub {
+			domain, sub = "."+domain, "TRUE"
+		}
+		if c.HTTPOnly {
+			domain = "#HttpOnly_" + domain
+		}
+		var expires int64
+		if !c.Expires.IsZero() {
+			expires = c.Expires.Unix()
+		}
+		secure := "FALSE"
+		if c.Secure {
+			secure = "TRUE"
+		}
+		lines = append(lines, strings.Join([]string{domain, sub, c.Path, secure,
+			strconv.FormatInt(expires, 10), c.Name, c.Value}, "\t"))
+	}
+	sort.Strings(lines)
+	out := "# Netscape HTTP Cookie File\n# Written by jqURL " + version + "\n\n" + strings.Join(lines, "\n") + "\n"
+
+	// cookies are as good as passwords, so the file is kept private
+	err := checkWrite(cookieFile)
+	var tmp *os.File
+	if err == nil {
+		tmp, err = ioutil.TempFile(filepath.Dir(cookieFile), ".jqurl_cookies")
+	}
+	if err == nil {
+		_, err = tmp.WriteString(out)
+		tmp.Close()
+		if err == nil {
+			err = os.Rename(tmp.Name(), cookieFile)
+		}
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}
+	if err != nil {
+		log.Fatalf("Error writing cookie jar %q: %s", cookieFile, err)
+	}
+	s.dirty = false
+}
+
+// loadCookieFlags reads the --cookie-jar file and any --cookie files, and
+// sends the --cookie NAME=VALUE pairs with every request
+func loadCookieFlags() {
+	if cookieFile != "" {
+		if err := loadCookies(cookieFile); err != nil && !os.IsNotExist(err) {
+			log.Fatalf("Error reading cookie jar: %s", err)
+		}
+	}
+	var pairs []string
+	for _, c := range cookies {
+		if !strings.Contains(c, "=") {
+			// like curl, a value without = is a cookie file to read
+			if err := loadCookies(c); err != nil {
+				log.Fatalf("Error reading cookie file: %s", err)
+			}
+			continue
+		}
+		pairs = append(pairs, strings.TrimSpace(c))
+	}
+	if len(pairs) > 0 {
+		if val, ok := Headers["cookie"]; ok {
+			pairs = append([]string{val}, pairs...)
+		}
+		Headers["cookie"] = strings.Join(pairs, "; ")
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	resolveRules   []string
+	connectToRules []string
+	dnsServers     string
+	dohURL         string
+
+	// resolved are the --resolve addresses by host:port
+	resolved map[string][]string
+
+	// connectTo are the --connect-to rules, in the order given
+	connectTo []connectRule
+
+	// dnsResolver looks up names for connections when --dns-server or
+	// --doh-url is given
+	dnsResolver *net.Resolver
+)
+
+// connectRule is one --connect-to HOST1:PORT1:HOST2:PORT2, an empty part
+// matching any host or port, or keeping it as it is
+type connectRule struct {
+	host, port     string
+	toHost, toPort string
+}
+
+// splitColons splits at the colons outside of [...], so IPv6 addresses can
+// be given in brackets
+func splitColons(s string) []string {
+	var parts []string
+	depth, start := 0, 0
+	for i, r := range s {
+		switch r {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case ':':
+			if depth == 0 {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// unbracket takes the brackets off an IPv6 address
+func unbracket(host string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+}
+
+// loadDNS reads the --resolve, --connect-to, --dns-server and --doh-url
+// settings
+func loadDNS() error {
+	for _, rule := range resolveRules {
+		parts := splitColons(rule)
+		if len(parts) < 3 || parts[0] == "" || parts[1] == "" {
+			return fmt.Errorf("bad --resolve %q, use HOST:PORT:ADDRESS[,ADDRESS]", rule)
+		}
+		// an IPv6 address given without brackets is split up too
+		addrs := strings.Join(parts[2:], ":")
+		if resolved == nil {
+			resolved = make(map[string][]string)
+		}
+		key := net.JoinHostPort(strings.ToLower(unbracket(parts[0])), parts[1])
+		for _, addr := range strings.Split(addrs, ",") {
+			addr = unbracket(strings.TrimSpace(addr))
+			if net.ParseIP(addr) == nil {
+				return fmt.Errorf("bad address %q in --resolve %q", addr, rule)
+			}
+			resolved[key] = append(resolved[key], addr)
+		}
+	}
+	for _, rule := range connectToRules {
+		parts := splitColons(rule)
+		if len(parts) != 4 {
+			return fmt.Errorf("bad --connect-to %q, use HOST1:PORT1:HOST2:PORT2, where any part may be empty", rule)
+		}
+		connectTo = append(connectTo, connectRule{
+			host: strings.ToLower(unbracket(parts[0])), port: parts[1],
+			toHost: unbracket(parts[2]), toPort: parts[3],
+		})
+	}
+	if dnsServers != "" && dohURL != "" {
+		return fmt.Errorf("use only one of --dns-server and --doh-url")
+	}
+	if (dnsServers != "" || dohURL != "") && (sshJump != "" || unixSocket != "" || useTor) {
+		return fmt.Errorf("--dns-server and --doh-url can't be used with --ssh-jump, --unix-socket or --tor, which look up names elsewhere")
+	}
+	if dnsServers != "" {
+		var servers []string
+		for _, s := range strings.Split(dnsServers, ",") {
+			s = strings.TrimSpace(s)
+			if _, _, err := net.SplitHostPort(s); err != nil {
+				s = net.JoinHostPort(unbracket(s), "53")
+			}
+			servers = append(servers, s)
+		}
+		dnsResolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				var err error
+				for _, s := range servers {
+					var conn net.Conn
+					if conn, err = d.DialContext(ctx, network, s); err == nil {
+						return conn, nil
+					}
+				}
+				return nil, err
+			},
+		}
+	}
+	return nil
+}
+
+// withDNS puts the --connect-to and --resolve overrides and the
+// --dns-server or --doh-url resolver in front of dialing, leaving the URL,
+// and so the Host header and TLS server name, as they were
+func withDNS(transport *http.Transport) {
+	if resolved == nil && connectTo == nil && dnsServers == "" && dohURL == "" {
+		return
+	}
+	if dohURL != "" {
+		// the DoH server itself is reached as set up so far
+		doh := &http.Client{Transport: transport.Clone(), Timeout: timeout}
+		dnsResolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return &dohConn{ctx: ctx, client: doh}, nil
+			},
+		}
+	}
+	dial := transport.DialContext
+	if dnsResolver != nil {
+		dial = (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Resolver: dnsResolver}).DialContext
+	}
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return dial(ctx, network, addr)
+		}
+		host = strings.ToLower(host)
+		for _, rule := range connectTo {
+			if (rule.host == "" || rule.host == host) && (rule.port == "" || rule.port == port) {
+				if rule.toHost != "" {
+					host = rule.toHost
+				}
+				if rule.toPort != "" {
+					port = rule.toPort
+				}
+				if debug {
+					log.Printf("Connecting to %s for %s", net.JoinHostPort(host, port), addr)
+				}
+				break
+			}
+		}
+		addrs, ok := resolved[net.JoinHostPort(host, port)]
+		if !ok {
+			return dial(ctx, network, net.JoinHostPort(host, port))
+		}
+		for _, ip := range addrs {
+			var conn net.Conn
+			if conn, err = dial(ctx, network, net.JoinHostPort(ip, port)); err == nil {
+				return conn, nil
+			}
+		}
+		return nil, err
+	}
+}
+
+// dohConn is the connection Go's resolver sends its DNS queries on, each
+// one POSTed to the --doh-url as an RFC 8484 application/dns-message.  Not
+// being a net.PacketConn, the resolver frames the messages as on TCP, with
+// a two byte length before each.
+type dohConn struct {
+	ctx    context.Context
+	client *http.Client
+
+	mu       sync.Mutex
+	query    bytes.Buffer
+	answer   bytes.Buffer
+	deadline time.Time
+}
+
+func (c *dohConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.query.Write(p)
+}
+
+func (c *dohConn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.answer.Len() == 0 {
+		msg := c.query.Bytes()
+		if len(msg) < 2 {
+			return 0, io.EOF
+		}
+		answer, err := c.exchange(msg[2:])
+		c.query.Reset()
+		if err != nil {
+			return 0, err
+		}
+		binary.Write(&c.answer, binary.BigEndian, uint16(len(answer)))
+		c.answer.Write(answer)
+	}
+	return c.answer.Read(p)
+}
+
+// exchange sends one query to the DoH server
+func (c *dohConn) exchange(msg []byte) ([]byte, error) {
+	ctx := c.ctx
+	if !c.deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, c.deadline)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", dohURL, bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH server %s answered %s", dohURL, resp.Status)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, 65535))
+}
+
+func (c *dohConn) Close() error                       { return nil }
+func (c *dohConn) LocalAddr() net.Addr                { return dohAddr{} }
+func (c *dohConn) RemoteAddr() net.Addr               { return dohAddr{} }
+func (c *dohConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *dohConn) SetWriteDeadline(t time.Time) error { return nil }
+func (c *dohConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+type dohAddr struct{}
+
+func (dohAddr) Network() string { return "doh" }
+func (dohAddr) String() string  { return dohURL }
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+)
+
+var (
+	maxFilesize      string
+	maxBodySize      int64
+	downloadProgress bool
+
+	// errBodyTooLarge is not worth retrying, the next reply will be as big
+	errBodyTooLarge = errors.New("response body is over --max-filesize")
+)
+
+// exitTooLarge is the exit code when a body is over --max-filesize, the
+// same as curl's
+const exitTooLarge = 63
+
+// loadMaxFilesize reads the --max-filesize limit
+func loadMaxFilesize() error {
+	if maxFilesize == "" {
+		return nil
+	}
+	n, err := parseSize(maxFilesize)
+	if err != nil || n <= 0 {
+		return fmt.Errorf("bad --max-filesize %q", maxFilesize)
+	}
+	maxBodySize = n
+	return nil
+}
+
+// downloadTransport bounds each response body to --max-filesize, refusing
+// one whose Content-Length is already over before reading any of it, and
+// shows the progress of reading it with --progress.  It sits above the
+// decoding, so the limit is on the body after decompression.
+type downloadTransport struct {
+	next http.RoundTripper
+}
+
+func withDownloadLimits(next http.RoundTripper) http.RoundTripper {
+	if maxBodySize == 0 && !downloadProgress {
+		return next
+	}
+	return downloadTransport{next: next}
+}
+
+func (t downloadTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	if maxBodySize > 0 {
+		if resp.ContentLength > maxBodySize {
+			resp.Body.Close()
+			return nil, fmt.Errorf("%w, %s is %s", errBodyTooLarge, req.URL, humanSize(resp.ContentLength))
+		}
+		resp.Body = &limitedBody{ReadCloser: resp.Body, left: maxBodySize}
+	}
+	if downloadProgress {
+		resp.Body = &progressReader{ReadCloser: resp.Body, size: resp.ContentLength, verb: "Downloaded"}
+	}
+	return resp, nil
+}
+
+// limitedBody fails the read which goes over the limit, rather than ending
+// the body early as io.LimitReader would
+type limitedBody struct {
+	io.ReadCloser
+	left int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if int64(len(p)) > b.left+1 {
+		p = p[:b.left+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) > b.left {
+		return int(b.left), fmt.Errorf("%w of %s", errBodyTooLarge, humanSize(maxBodySize))
+	}
+	b.left -= int64(n)
+	return n, err
+}
+
+// tooLargeExit ends the run when a fetch failed on a body over the limit
+func tooLargeExit(err error) {
+	if errors.Is(err, errBodyTooLarge) {
+		fmt.Fprintf(os.Stderr, "Error fetching: %s\n", err)
+		os.Exit(exitTooLarge)
+	}
+}
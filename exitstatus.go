@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/pschou/jqURL/pkg/jqurl"
+)
+
+var (
+	exitStatus   bool
+	failHTTP     bool
+	failWithBody bool
+
+	resultCount int
+	lastResult  interface{}
+)
+
+// exitHTTPError is the exit code for a 4xx or 5xx reply with --fail, the
+// same as curl's
+const exitHTTPError = 22
+
+// failExit ends the run when a fetch has failed and --fail is set, with
+// exitHTTPError for an error reply.  --fail-with-body first writes the body
+// of the reply to the output.
+func failExit(err error) {
+	if !failHTTP || err == nil {
+		return
+	}
+	var statusErr *jqurl.StatusError
+	if errors.As(err, &statusErr) {
+		if failWithBody {
+			dataOut.Write(statusErr.Body)
+		}
+		fmt.Fprintf(os.Stderr, "The requested URL returned error: %s\n", statusErr.Status)
+		os.Exit(exitHTTPError)
+	}
+	fmt.Fprintf(os.Stderr, "Error fetching: %s\n", err)
+	os.Exit(1)
+}
+
+// noteResult keeps track of the query results for --exit-status
+func noteResult(v interface{}) {
+	resultCount++
+	lastResult = v
+}
+
+// exitForResult sets the exit code from the last result as jq -e does: 1
+// when it was false or null, 4 when there were none
+func exitForResult() {
+	if !exitStatus {
+		return
+	}
+	if resultCount == 0 {
+		os.Exit(4)
+	}
+	if lastResult == nil || lastResult == false {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+)
+
+var (
+	fetchAllURLs bool
+	keyedByURL   bool
+	parallel     int
+)
+
+// fetchAll fetches every URL argument at once, at most --parallel at a time,
+// rather than treating them as alternatives.  The query gets an array of the
+// bodies in argument order, or an object keyed by URL with --keyed.  A URL
+// which fails gives null.
+func fetchAll(client *http.Client) interface{} {
+	results := make([]interface{}, len(Args))
+	if parallel < 1 {
+		parallel = 1
+	}
+	sem := make(chan struct{}, parallel)
+	if adaptive {
+		client = adaptiveClient(client, parallel)
+	}
+	var wg sync.WaitGroup
+	for i := range Args {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			results[i] = fetchOne(client, i)
+		}(i)
+	}
+	wg.Wait()
+
+	if !keyedByURL {
+		return results
+	}
+	keyed := make(map[string]interface{}, len(Args))
+	for i, Arg := range Args {
+		keyed[Arg] = results[i]
+	}
+	return keyed
+}
+
+// fetchOne gets a single URL argument for fetchAll, from the cache or lock
+// file when they have it
+func fetchOne(client *http.Client, i int) interface{} {
+	var v interface{}
+	if frozen {
+		byt, err := frozenBody(method, Args[i])
+		if err == nil {
+			err = unmarshalBody(byt, &v)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Frozen input missing: %s\n", err)
+			return nil
+		}
+		return frozenEnvelope(method, Args[i], v)
+	}
+	if stat, err := os.Stat(cacheFiles[i]); err == nil && useCache && !flush && since(stat.ModTime()) < maxAge {
+		if byt, err := ioutil.ReadFile(cacheFiles[i]); err == nil && unmarshalBody(byt, &v) == nil {
+			if debug {
+				log.Println("using cache", cacheFiles[i])
+			}
+			cacheHitMetrics(Args[i], cacheFiles[i])
+			saveResponseBody(nil, byt)
+			return cacheEnvelope(cacheFiles[i], Args[i], v)
+		}
+	}
+
+	opts := fetchOptions(client)
+	opts.URLs = Args[i : i+1]
+	verifyOptions(&opts)
+	conditionalFetch(&opts, cacheFiles[i])
+	res, err := fetchDo(opts)
+	failExit(err)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error fetching %s: %s\n", Args[i], err)
+		return nil
+	}
+	return keepResult(client, res, cacheFiles[i])
+}
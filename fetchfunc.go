@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pschou/jqURL/pkg/jqurl"
+)
+
+var (
+	scriptFile string
+	httpClient *http.Client
+)
+
+// funcFetch implements fetch(url) and fetch(url; {method, headers, body}),
+// letting a jq program issue its own requests.  The reply is parsed as JSON
+// when possible and returned as a string otherwise, an error status raises a
+// jq error which can be caught with try.
+func funcFetch(v interface{}, args []interface{}) interface{} {
+	if httpClient == nil && !frozen {
+		// --json-data and such are evaluated before there is a client
+		return fmt.Errorf("fetch: only available in the main query and --script")
+	}
+	target, ok := args[0].(string)
+	if !ok {
+		return fmt.Errorf("fetch: url must be a string, got %#v", args[0])
+	}
+	reqMethod := "GET"
+	reqHeaders := make(map[string]string)
+	for k, v := range Headers {
+		reqHeaders[k] = v
+	}
+	given := make(map[string]bool)
+	var body io.Reader
+	if len(args) > 1 && args[1] != nil {
+		opts, ok := args[1].(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("fetch: options must be an object, got %#v", args[1])
+		}
+		if m, ok := opts["method"].(string); ok {
+			reqMethod = strings.ToUpper(m)
+		}
+		if hs, ok := opts["headers"].(map[string]interface{}); ok {
+			for k, v := range hs {
+				reqHeaders[strings.ToLower(k)] = fmt.Sprint(v)
+				given[strings.ToLower(k)] = true
+			}
+		}
+		switch b := opts["body"].(type) {
+		case nil:
+		case string:
+			body = strings.NewReader(b)
+		default:
+			byt, err := json.Marshal(b)
+			if err != nil {
+				return fmt.Errorf("fetch: %s", err)
+			}
+			body = bytes.NewReader(byt)
+			if _, ok := reqHeaders["content-type"]; !ok {
+				reqHeaders["content-type"] = "application/json"
+			}
+		}
+	}
+	target = fixIPv6Zone(target)
+	u, err := url.Parse(target)
+	if err != nil {
+		return fmt.Errorf("fetch: %s", err)
+	}
+	if err = idnURL(u); err != nil {
+		return fmt.Errorf("fetch: %s", err)
+	}
+	target = u.String()
+	if !argOrigin(u) {
+		// the program picks the host, so the credentials given for the URL
+		// arguments stay with them unless passed to fetch explicitly
+		for _, h := range jqurl.CredentialHeaders {
+			if h = strings.ToLower(h); !given[h] {
+				delete(reqHeaders, h)
+			}
+		}
+	}
+	if err = validateRequest(reqMethod, reqHeaders, []string{target}); err != nil {
+		return fmt.Errorf("fetch: %s", err)
+	}
+
+	var byt []byte
+	if frozen {
+		if byt, err = frozenBody(reqMethod, target); err != nil {
+			return fmt.Errorf("fetch: %s", err)
+		}
+		return decodeFetched(byt)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, reqMethod, target, body)
+	if err != nil {
+		return fmt.Errorf("fetch: %s", err)
+	}
+	for k, v := range reqHeaders {
+		req.Header.Set(k, v)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("fetch: %s", err)
+	}
+	byt, err = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("fetch: %s", err)
+	}
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("fetch: %s returned %s", target, resp.Status)
+	}
+	recordFreeze(reqMethod, target, resp, byt)
+	recordCAS(reqMethod, target, resp, byt)
+	return decodeFetched(byt)
+}
+
+// argOrigin tells if a URL has the origin of one of the URL arguments
+func argOrigin(u *url.URL) bool {
+	for _, arg := range urls {
+		if arg != nil && jqurl.SameOrigin(arg, u) {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeFetched parses a reply as JSON, falling back to the raw text
+func decodeFetched(byt []byte) interface{} {
+	var out interface{}
+	if json.Unmarshal(byt, &out) != nil {
+		return string(byt)
+	}
+	return out
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	fixtureFile string
+
+	// errOffline is not worth retrying, no request leaves a --fixture run
+	errOffline = errors.New("not fetched, --fixture runs offline")
+)
+
+// fixtureTypes are the Content-Types of fixture files mime doesn't know on
+// every system
+var fixtureTypes = map[string]string{
+	".json":   "application/json",
+	".jsonl":  "application/x-ndjson",
+	".ndjson": "application/x-ndjson",
+	".yaml":   "application/yaml",
+	".yml":    "application/yaml",
+	".xml":    "application/xml",
+}
+
+// checkFixture makes sure the --fixture file can be read, and keeps the
+// cache out of the run so the fixture is what gets queried
+func checkFixture() {
+	if fixtureFile == "" {
+		return
+	}
+	err := checkRead(fixtureFile)
+	if err == nil {
+		_, err = os.Stat(fixtureFile)
+	}
+	if err != nil {
+		log.Fatalf("Error reading fixture: %s", err)
+	}
+	if frozen {
+		log.Fatal("--fixture can't be used with --frozen")
+	}
+	useCache = false
+}
+
+// fixtureTransport answers the requests for the first URL argument, or
+// with --script the first URL fetched, with the --fixture file and refuses
+// every other, writing each to stderr so the run shows what it would have
+// fetched
+type fixtureTransport struct {
+	mu     sync.Mutex
+	target string
+}
+
+func withFixture(next http.RoundTripper) http.RoundTripper {
+	if fixtureFile == "" {
+		return next
+	}
+	t := &fixtureTransport{}
+	if len(Args) > 0 {
+		if u, err := url.Parse(Args[0]); err == nil {
+			t.target = u.String()
+		}
+	}
+	return t
+}
+
+func (t *fixtureTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	target := req.URL.String()
+	t.mu.Lock()
+	if t.target == "" {
+		t.target = target
+	}
+	first := t.target == target
+	t.mu.Unlock()
+	if !first {
+		fmt.Fprintf(os.Stderr, "Fixture: %s %s not fetched\n", req.Method, target)
+		return nil, errOffline
+	}
+	fmt.Fprintf(os.Stderr, "Fixture: %s %s answered from %s\n", req.Method, target, fixtureFile)
+
+	f, err := os.Open(fixtureFile)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	header := http.Header{}
+	ext := strings.ToLower(filepath.Ext(fixtureFile))
+	if ct, ok := fixtureTypes[ext]; ok {
+		header.Set("Content-Type", ct)
+	} else if ct := mime.TypeByExtension(ext); ct != "" {
+		header.Set("Content-Type", ct)
+	}
+	header.Set("Content-Length", strconv.FormatInt(stat.Size(), 10))
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          f,
+		ContentLength: stat.Size(),
+		Request:       req,
+	}, nil
+}
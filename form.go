@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pschou/jqURL/pkg/jqurl"
+)
+
+var (
+	formFields    []string
+	dataURLEncode []string
+
+	// formBody and formType are the multipart body built from -F
+	formBody jqurl.Body
+	formType string
+)
+
+// applyForm builds the request body from -F and --data-urlencode, which like
+// curl switch a GET to a POST
+func applyForm() error {
+	if len(formFields) > 0 {
+		if postData != "" || len(dataURLEncode) > 0 || jsonData != "" || graphqlQuery != "" {
+			return fmt.Errorf("-F can't be used with --data, --data-urlencode, --json-data or --graphql")
+		}
+		body, ctype, err := multipartBody(formFields)
+		if err != nil {
+			return err
+		}
+		formBody, formType = body, ctype
+	} else if len(dataURLEncode) > 0 {
+		if strings.HasPrefix(postData, "@") || jsonData != "" || graphqlQuery != "" {
+			return fmt.Errorf("--data-urlencode can only be added to --data given inline")
+		}
+		pairs := []string{}
+		if postData != "" {
+			pairs = append(pairs, postData)
+		}
+		for _, arg := range dataURLEncode {
+			pair, err := urlEncodePair(arg)
+			if err != nil {
+				return err
+			}
+			pairs = append(pairs, pair)
+		}
+		postData = strings.Join(pairs, "&")
+	} else {
+		return nil
+	}
+	if method == "GET" || method == "HEAD" {
+		method = "POST"
+	}
+	return nil
+}
+
+// urlEncodePair encodes one --data-urlencode, as curl: "content", "=content",
+// "name=content", "@file" or "name@file", escaping only the content
+func urlEncodePair(arg string) (string, error) {
+	name, content := "", arg
+	if i := strings.IndexAny(arg, "=@"); i >= 0 {
+		name, content = arg[:i], arg[i+1:]
+		if arg[i] == '@' {
+			if err := checkRead(content); err != nil {
+				return "", err
+			}
+			var byt []byte
+			var err error
+			if content == "-" {
+				byt, err = ioutil.ReadAll(os.Stdin)
+			} else {
+				byt, err = ioutil.ReadFile(content)
+			}
+			if err != nil {
+				return "", fmt.Errorf("--data-urlencode: %s", err)
+			}
+			content = string(byt)
+		}
+	}
+	escaped := url.QueryEscape(content)
+	if name == "" {
+		return escaped, nil
+	}
+	return name + "=" + escaped, nil
+}
+
+// multipartBody lays out -F fields as multipart/form-data.  The part headers
+// are made up front and the files are streamed from disk on every attempt,
+// so the length is known and large uploads aren't held in memory.
+func multipartBody(fields []string) (jqurl.Body, string, error) {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	var segs []jqurl.Body
+	for _, field := range fields {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, "", fmt.Errorf("malformed -F %q, expected NAME=VALUE, NAME=@FILE or NAME=<FILE", field)
+		}
+		name, val := parts[0], parts[1]
+		h := make(textproto.MIMEHeader)
+		var content jqurl.Body
+		if strings.HasPrefix(val, "@") || strings.HasPrefix(val, "<") {
+			file, params := splitFormParams(val[1:])
+			if err := checkRead(file); err != nil {
+				return nil, "", err
+			}
+			var err error
+			if file == "-" {
+				content, err = jqurl.ReaderBody(os.Stdin)
+			} else {
+				content, err = jqurl.FileBody(file)
+			}
+			if err != nil {
+				return nil, "", fmt.Errorf("-F %s: %s", name, err)
+			}
+			if val[0] == '@' {
+				filename, ok := params["filename"]
+				if !ok && file != "-" {
+					filename = filepath.Base(file)
+				}
+				ctype, ok := params["type"]
+				if !ok {
+					if ctype = mime.TypeByExtension(filepath.Ext(filename)); ctype == "" {
+						ctype = "application/octet-stream"
+					}
+				}
+				h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`,
+					quoteEscaper.Replace(name), quoteEscaper.Replace(filename)))
+				h.Set("Content-Type", ctype)
+			} else {
+				h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"`, quoteEscaper.Replace(name)))
+				if ctype, ok := params["type"]; ok {
+					h.Set("Content-Type", ctype)
+				}
+			}
+		} else {
+			h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"`, quoteEscaper.Replace(name)))
+			content = jqurl.BytesBody([]byte(val))
+		}
+		if _, err := w.CreatePart(h); err != nil {
+			return nil, "", err
+		}
+		segs = append(segs, jqurl.BytesBody(append([]byte{}, buf.Bytes()...)), content)
+		buf.Reset()
+	}
+	if err := w.Close(); err != nil {
+		return nil, "", err
+	}
+	segs = append(segs, jqurl.BytesBody(append([]byte{}, buf.Bytes()...)))
+	return multiBody(segs), w.FormDataContentType(), nil
+}
+
+// quoteEscaper escapes a quoted Content-Disposition value, as mime/multipart
+var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
+
+// splitFormParams separates "file;type=text/csv;filename=a.csv"
+func splitFormParams(val string) (string, map[string]string) {
+	items := strings.Split(val, ";")
+	params := make(map[string]string)
+	for _, item := range items[1:] {
+		if kv := strings.SplitN(item, "=", 2); len(kv) == 2 {
+			params[strings.ToLower(strings.TrimSpace(kv[0]))] = strings.Trim(kv[1], `"`)
+		}
+	}
+	return items[0], params
+}
+
+// multiBody sends its bodies one after another, opening each in turn
+type multiBody []jqurl.Body
+
+func (m multiBody) Open() (io.ReadCloser, error) {
+	return &multiReader{segs: m}, nil
+}
+
+func (m multiBody) Len() int64 {
+	var n int64
+	for _, b := range m {
+		if b.Len() < 0 {
+			return -1
+		}
+		n += b.Len()
+	}
+	return n
+}
+
+func (m multiBody) Close() error {
+	for _, b := range m {
+		b.Close()
+	}
+	return nil
+}
+
+type multiReader struct {
+	segs []jqurl.Body
+	cur  io.ReadCloser
+}
+
+func (r *multiReader) Read(p []byte) (int, error) {
+	for {
+		if r.cur == nil {
+			if len(r.segs) == 0 {
+				return 0, io.EOF
+			}
+			var err error
+			if r.cur, err = r.segs[0].Open(); err != nil {
+				return 0, err
+			}
+			r.segs = r.segs[1:]
+		}
+		n, err := r.cur.Read(p)
+		if err == io.EOF {
+			r.cur.Close()
+			r.cur = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (r *multiReader) Close() error {
+	if r.cur != nil {
+		return r.cur.Close()
+	}
+	return nil
+}
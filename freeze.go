@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	freezeFile string
+	frozen     bool
+	lock       *lockFile
+	lockMu     sync.Mutex
+)
+
+// lockFile records every input a run used so a later --frozen run can replay
+// exactly the same bodies without touching the network
+type lockFile struct {
+	Version   string      `json:"jqurl_version"`
+	GoVersion string      `json:"go_version"`
+	Query     string      `json:"query"`
+	Created   time.Time   `json:"created"`
+	Requests  []lockEntry `json:"requests"`
+}
+
+type lockEntry struct {
+	Method       string          `json:"method"`
+	URL          string          `json:"url"`
+	Resolved     string          `json:"resolved,omitempty"`
+	Status       string          `json:"status,omitempty"`
+	ETag         string          `json:"etag,omitempty"`
+	LastModified string          `json:"last_modified,omitempty"`
+	SHA256       string          `json:"sha256"`
+	Body         json.RawMessage `json:"body,omitempty"`
+	Text         *string         `json:"text,omitempty"`
+}
+
+// lockHash hashes a body, JSON is compacted first so reformatting the lock
+// file does not change the hash
+func lockHash(byt []byte) string {
+	var buf bytes.Buffer
+	if json.Compact(&buf, byt) == nil {
+		byt = buf.Bytes()
+	}
+	sum := sha256.Sum256(byt)
+	return hex.EncodeToString(sum[:])
+}
+
+// recordFreeze adds a fetched body to the lock when --freeze is in use
+func recordFreeze(reqMethod, target string, resp *http.Response, byt []byte) {
+	if freezeFile == "" || frozen {
+		return
+	}
+	lockMu.Lock()
+	defer lockMu.Unlock()
+	if lock == nil {
+		lock = &lockFile{Version: version, GoVersion: runtime.Version(), Query: JQString, Created: clock.Now().UTC()}
+	}
+	e := lockEntry{Method: reqMethod, URL: target, SHA256: lockHash(byt)}
+	if resp != nil {
+		e.Status = resp.Status
+		e.ETag = resp.Header.Get("ETag")
+		e.LastModified = resp.Header.Get("Last-Modified")
+		if resp.Request != nil && resp.Request.URL.String() != target {
+			e.Resolved = resp.Request.URL.String()
+		}
+	}
+	if json.Valid(byt) {
+		e.Body = append(json.RawMessage(nil), byt...)
+	} else {
+		s := string(byt)
+		e.Text = &s
+	}
+	for i, old := range lock.Requests {
+		if old.Method == reqMethod && old.URL == target {
+			lock.Requests[i] = e
+			return
+		}
+	}
+	lock.Requests = append(lock.Requests, e)
+}
+
+// writeFreeze saves the lock file gathered during the run
+func writeFreeze() {
+	if freezeFile == "" || frozen || lock == nil {
+		return
+	}
+	byt, err := json.MarshalIndent(lock, "", "  ")
+	if err == nil {
+		err = checkWrite(freezeFile)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(freezeFile, append(byt, '\n'), 0644)
+	}
+	if err != nil {
+		log.Fatalf("Error writing lock file %q: %s", freezeFile, err)
+	}
+}
+
+// loadFreeze reads the lock file for a --frozen run
+func loadFreeze() {
+	err := checkRead(freezeFile)
+	var byt []byte
+	if err == nil {
+		byt, err = ioutil.ReadFile(freezeFile)
+	}
+	if err == nil {
+		lock = &lockFile{}
+		err = json.Unmarshal(byt, lock)
+	}
+	if err != nil {
+		log.Fatalf("Error reading lock file %q: %s", freezeFile, err)
+	}
+	if lock.Query != "" && lock.Query != JQString && debug {
+		log.Printf("jq query differs from the one recorded in %q", freezeFile)
+	}
+}
+
+// frozenBody returns the recorded body for a request, checking it still
+// matches its hash
+func frozenBody(reqMethod, target string) ([]byte, error) {
+	for _, e := range lock.Requests {
+		if e.Method != reqMethod || e.URL != target {
+			continue
+		}
+		byt := []byte(e.Body)
+		if e.Text != nil {
+			byt = []byte(*e.Text)
+		}
+		if lockHash(byt) != e.SHA256 {
+			return nil, fmt.Errorf("%s %s: body does not match recorded sha256", reqMethod, target)
+		}
+		return byt, nil
+	}
+	return nil, fmt.Errorf("%s %s is not recorded in %q", reqMethod, target, freezeFile)
+}
+
+// frozenEnvelope wraps a replayed body for --with-metadata with what the lock
+// file recorded of its response
+func frozenEnvelope(reqMethod, target string, v interface{}) interface{} {
+	if !withMetadata {
+		return v
+	}
+	status, header := http.StatusOK, map[string]string{}
+	for _, e := range lock.Requests {
+		if e.Method != reqMethod || e.URL != target {
+			continue
+		}
+		if code, err := strconv.Atoi(strings.SplitN(e.Status, " ", 2)[0]); err == nil {
+			status = code
+		}
+		if e.ETag != "" {
+			header["etag"] = e.ETag
+		}
+		if e.LastModified != "" {
+			header["last-modified"] = e.LastModified
+		}
+		if e.Resolved != "" {
+			target = e.Resolved
+		}
+	}
+	return envelope(target, status, header, v)
+}
+
+// frozenData loads the first URL argument found in the lock file
+func frozenData() interface{} {
+	var firstErr error
+	for _, Arg := range Args {
+		byt, err := frozenBody(method, Arg)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		var out interface{}
+		if err = unmarshalBody(byt, &out); err != nil {
+			log.Fatalf("Error parsing frozen body of %q: %s", Arg, err)
+		}
+		return frozenEnvelope(method, Arg, out)
+	}
+	fmt.Fprintf(os.Stderr, "Frozen input missing: %s\n", firstErr)
+	os.Exit(1)
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+)
+
+var (
+	graphqlQuery  string
+	graphqlVars   []string
+	graphqlFailed bool
+)
+
+// applyGraphQL wraps --graphql and its --graphql-var values into the
+// {"query","variables"} envelope and sends it as a JSON POST
+func applyGraphQL() {
+	if graphqlQuery == "" {
+		if len(graphqlVars) > 0 {
+			log.Fatal("--graphql-var needs --graphql")
+		}
+		return
+	}
+	if postData != "" {
+		log.Fatal("Use either --graphql or --data, not both")
+	}
+	query := graphqlQuery
+	if strings.HasPrefix(query, "@") {
+		err := checkRead(query[1:])
+		var byt []byte
+		if err == nil {
+			byt, err = ioutil.ReadFile(query[1:])
+		}
+		if err != nil {
+			log.Fatalf("Error reading GraphQL query %q: %s", query[1:], err)
+		}
+		query = string(byt)
+	}
+
+	vars := make(map[string]interface{})
+	for _, pair := range graphqlVars {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			log.Fatalf("Malformed --graphql-var %q, expected NAME=VALUE", pair)
+		}
+		// numbers, booleans, objects and such go in as JSON, anything else
+		// as a string
+		var v interface{}
+		if err := json.Unmarshal([]byte(parts[1]), &v); err != nil {
+			v = parts[1]
+		}
+		vars[parts[0]] = v
+	}
+	envelope := map[string]interface{}{"query": query}
+	if len(vars) > 0 {
+		envelope["variables"] = vars
+	}
+	byt, _ := json.Marshal(envelope)
+	postData = string(byt)
+	method = "POST"
+	Headers["content-type"] = "application/json"
+	if _, ok := Headers["accept"]; !ok {
+		Headers["accept"] = "application/graphql-response+json, application/json"
+	}
+}
+
+// graphqlData unwraps .data from a GraphQL reply, or from the body of a
+// --with-metadata envelope holding one
+func graphqlData(v interface{}) interface{} {
+	if graphqlQuery == "" {
+		return v
+	}
+	env, ok := v.(map[string]interface{})
+	if !ok || !withMetadata {
+		return graphqlUnwrap(v)
+	}
+	out := make(map[string]interface{}, len(env))
+	for key, val := range env {
+		out[key] = val
+	}
+	out["body"] = graphqlUnwrap(env["body"])
+	return out
+}
+
+// graphqlUnwrap returns .data, printing any .errors to stderr and marking the
+// run failed, as a reply may hold partial data and errors together
+func graphqlUnwrap(v interface{}) interface{} {
+	reply, ok := v.(map[string]interface{})
+	if !ok {
+		return v
+	}
+	if errs, ok := reply["errors"].([]interface{}); ok && len(errs) > 0 {
+		graphqlFailed = true
+		for _, e := range errs {
+			msg := fmt.Sprint(e)
+			if m, ok := e.(map[string]interface{}); ok {
+				if s, ok := m["message"].(string); ok {
+					msg = s
+				}
+				if path, ok := m["path"].([]interface{}); ok {
+					parts := make([]string, len(path))
+					for i, p := range path {
+						parts[i] = fmt.Sprint(p)
+					}
+					msg += " (at " + strings.Join(parts, ".") + ")"
+				}
+			}
+			fmt.Fprintf(os.Stderr, "GraphQL error: %s\n", msg)
+		}
+	}
+	return reply["data"]
+}
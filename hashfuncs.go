@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"math"
+	"strings"
+)
+
+// hashAlgs are the digests available to the hashing builtins
+var hashAlgs = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha384": sha512.New384,
+	"sha512": sha512.New,
+}
+
+func funcUUID(v interface{}, args []interface{}) interface{} {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return fmt.Errorf("uuid: %s", err)
+	}
+	b[6] = b[6]&0x0f | 0x40 // version 4
+	b[8] = b[8]&0x3f | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func funcRandBytes(v interface{}, args []interface{}) interface{} {
+	n, ok := toFloat(args[0])
+	if !ok || n < 0 || n > 1<<20 || n != math.Trunc(n) {
+		return fmt.Errorf("randbytes: expected a byte count, got %#v", args[0])
+	}
+	b := make([]byte, int(n))
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Errorf("randbytes: %s", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// hashFunc builds a builtin which returns the hex digest of the input string
+func hashFunc(name string) func(interface{}, []interface{}) interface{} {
+	return func(v interface{}, args []interface{}) interface{} {
+		s, ok := v.(string)
+		if !ok {
+			return fmt.Errorf("%s cannot be applied to: %#v", name, v)
+		}
+		h := hashAlgs[name]()
+		h.Write([]byte(s))
+		return hex.EncodeToString(h.Sum(nil))
+	}
+}
+
+func funcHMAC(v interface{}, args []interface{}) interface{} {
+	s, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("hmac cannot be applied to: %#v", v)
+	}
+	key, ok := args[0].(string)
+	if !ok {
+		return fmt.Errorf("hmac: key must be a string, got %#v", args[0])
+	}
+	alg, _ := args[1].(string)
+	newHash, ok := hashAlgs[strings.ToLower(alg)]
+	if !ok {
+		return fmt.Errorf("hmac: unknown algorithm %#v", args[1])
+	}
+	mac := hmac.New(newHash, []byte(key))
+	mac.Write([]byte(s))
+	return hex.EncodeToString(mac.Sum(nil))
+}
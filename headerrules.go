@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/pschou/jqURL/pkg/jqurl"
+)
+
+var (
+	headerIf        []string
+	headerRulesFile string
+	headerRules     []headerRule
+)
+
+// headerRule adds headers to the requests going to matching hosts
+type headerRule struct {
+	Host    string
+	Scheme  string
+	Headers map[string]string
+
+	// Origin, when set, limits the rule to this scheme, host and port
+	Origin *url.URL
+}
+
+// matches compares a request URL with the rule, the host is a glob such as
+// *.internal, or a CIDR range for IP addresses
+func (r headerRule) matches(req *http.Request) bool {
+	if r.Origin != nil {
+		return jqurl.SameOrigin(r.Origin, req.URL)
+	}
+	if r.Scheme != "" && !strings.EqualFold(r.Scheme, req.URL.Scheme) {
+		return false
+	}
+	host := strings.ToLower(strings.TrimSuffix(req.URL.Hostname(), "."))
+	if _, cidr, err := net.ParseCIDR(r.Host); err == nil {
+		ip := net.ParseIP(host)
+		return ip != nil && cidr.Contains(ip)
+	}
+	ok, _ := path.Match(strings.ToLower(r.Host), host)
+	return ok
+}
+
+// loadHeaderRules reads the --header-if flags and the --header-rules file,
+// a YAML (or JSON) list, or an object with a "rules" list, of entries with a
+// "host" glob, an optional "scheme" and the "headers" to add
+func loadHeaderRules() error {
+	for _, rule := range headerIf {
+		parts := strings.SplitN(strings.TrimSpace(rule), " ", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("malformed --header-if %q, use 'HOST HEADER: VALUE'", rule)
+		}
+		kv := strings.SplitN(parts[1], ":", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("malformed --header-if %q, use 'HOST HEADER: VALUE'", rule)
+		}
+		headerRules = append(headerRules, headerRule{Host: parts[0],
+			Headers: map[string]string{strings.TrimSpace(kv[0]): strings.TrimSpace(kv[1])}})
+	}
+	if headerRulesFile == "" {
+		return nil
+	}
+	if err := checkRead(headerRulesFile); err != nil {
+		return err
+	}
+	byt, err := ioutil.ReadFile(headerRulesFile)
+	if err != nil {
+		return err
+	}
+	var doc interface{}
+	if err = json.Unmarshal(byt, &doc); err != nil {
+		if doc, err = yamlUnmarshal(byt); err != nil {
+			return err
+		}
+	}
+	if obj, ok := doc.(map[string]interface{}); ok {
+		doc = obj["rules"]
+	}
+	list, ok := doc.([]interface{})
+	if !ok {
+		return fmt.Errorf("expected a list of rules")
+	}
+	for n, entry := range list {
+		e, _ := entry.(map[string]interface{})
+		host, _ := e["host"].(string)
+		hs, _ := e["headers"].(map[string]interface{})
+		if host == "" || len(hs) == 0 {
+			return fmt.Errorf("rule %d: needs a host and headers", n+1)
+		}
+		rule := headerRule{Host: host, Headers: map[string]string{}}
+		rule.Scheme, _ = e["scheme"].(string)
+		for k, v := range hs {
+			rule.Headers[k] = fmt.Sprint(v)
+		}
+		headerRules = append(headerRules, rule)
+	}
+	return nil
+}
+
+// ruleTransport applies the header rules to every request, redirects,
+// pages, token and chained requests included.  A header named in any rule is
+// only sent where a rule for it matches, so a redirect to another host does
+// not carry it along.
+type ruleTransport struct {
+	next http.RoundTripper
+}
+
+func withHeaderRules(next http.RoundTripper) http.RoundTripper {
+	if len(headerRules) == 0 {
+		return next
+	}
+	return ruleTransport{next: next}
+}
+
+func (t ruleTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	for _, rule := range headerRules {
+		for key := range rule.Headers {
+			req.Header.Del(key)
+		}
+	}
+	for _, rule := range headerRules {
+		if rule.matches(req) {
+			for key, val := range rule.Headers {
+				req.Header.Set(key, val)
+			}
+		}
+	}
+	return t.next.RoundTrip(req)
+}
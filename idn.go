@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// idnURL converts a Unicode host name to its punycode (IDNA) form so it can be
+// looked up and sent, warning when a label mixes scripts the way spoofed
+// look-alike names do
+func idnURL(u *url.URL) error {
+	host := u.Hostname()
+	ascii, err := idnToASCII(host)
+	if err != nil || ascii == host {
+		return err
+	}
+	for _, label := range strings.Split(host, ".") {
+		if scripts := labelScripts(label); mixedScripts(scripts) {
+			fmt.Fprintf(os.Stderr, "Warning: host %q mixes %s scripts in %q, it may be imitating another name\n",
+				host, strings.Join(scripts, " and "), label)
+		}
+	}
+	if debug {
+		log.Printf("IDN host %q is sent as %q", host, ascii)
+	}
+	if port := u.Port(); port != "" {
+		ascii += ":" + port
+	}
+	u.Host = ascii
+	return nil
+}
+
+// idnToASCII converts each non-ASCII label of a host name to "xn--" form.
+// Labels are lower cased, but no further Unicode normalization is done.
+func idnToASCII(host string) (string, error) {
+	host = strings.Map(func(r rune) rune {
+		switch r {
+		case '。', '．', '｡':
+			return '.'
+		}
+		return r
+	}, host)
+	labels := strings.Split(host, ".")
+	for i, label := range labels {
+		ascii := true
+		for _, r := range label {
+			if r >= 0x80 {
+				ascii = false
+				break
+			}
+		}
+		if ascii {
+			continue
+		}
+		enc, err := punycode(strings.ToLower(label))
+		if err != nil {
+			return "", fmt.Errorf("host %q: %s", host, err)
+		}
+		if labels[i] = "xn--" + enc; len(labels[i]) > 63 {
+			return "", fmt.Errorf("host %q: label %q is too long once encoded", host, label)
+		}
+	}
+	return strings.Join(labels, "."), nil
+}
+
+// punycode encodes a label as in RFC 3492
+func punycode(s string) (string, error) {
+	const (
+		base, tmin, tmax, skew, damp = 36, 1, 26, 38, 700
+	)
+	adapt := func(delta, points int, first bool) int {
+		if first {
+			delta /= damp
+		} else {
+			delta /= 2
+		}
+		delta += delta / points
+		k := 0
+		for delta > ((base-tmin)*tmax)/2 {
+			delta /= base - tmin
+			k += base
+		}
+		return k + (base-tmin+1)*delta/(delta+skew)
+	}
+	digit := func(d int) byte {
+		if d < 26 {
+			return byte('a' + d)
+		}
+		return byte('0' + d - 26)
+	}
+
+	runes := []rune(s)
+	var out []byte
+	for _, r := range runes {
+		if r < 0x80 {
+			out = append(out, byte(r))
+		}
+	}
+	b := len(out)
+	h := b
+	if b > 0 {
+		out = append(out, '-')
+	}
+	n, delta, bias := 128, 0, 72
+	for h < len(runes) {
+		m := int(unicode.MaxRune) + 1
+		for _, r := range runes {
+			if int(r) >= n && int(r) < m {
+				m = int(r)
+			}
+		}
+		if (m-n)*(h+1) < 0 || delta+(m-n)*(h+1) < 0 {
+			return "", errors.New("punycode overflow")
+		}
+		delta += (m - n) * (h + 1)
+		n = m
+		for _, r := range runes {
+			if int(r) < n {
+				delta++
+			}
+			if int(r) != n {
+				continue
+			}
+			q := delta
+			for k := base; ; k += base {
+				t := k - bias
+				if t < tmin {
+					t = tmin
+				} else if t > tmax {
+					t = tmax
+				}
+				if q < t {
+					break
+				}
+				out = append(out, digit(t+(q-t)%(base-t)))
+				q = (q - t) / (base - t)
+			}
+			out = append(out, digit(q))
+			bias = adapt(delta, h+1, h == b)
+			delta = 0
+			h++
+		}
+		delta++
+		n++
+	}
+	return string(out), nil
+}
+
+// labelScripts lists the scripts of the letters in a label
+func labelScripts(label string) []string {
+	seen := map[string]bool{}
+	for _, r := range label {
+		if r < 0x80 && !unicode.IsLetter(r) {
+			continue
+		}
+		for name, table := range unicode.Scripts {
+			if name != "Common" && name != "Inherited" && unicode.Is(table, r) {
+				seen[name] = true
+				break
+			}
+		}
+	}
+	var scripts []string
+	for name := range seen {
+		scripts = append(scripts, name)
+	}
+	sort.Strings(scripts)
+	return scripts
+}
+
+// mixedScripts reports if the scripts go beyond the combinations normally
+// used together, following the Unicode "highly restrictive" profile
+func mixedScripts(scripts []string) bool {
+	if len(scripts) < 2 {
+		return false
+	}
+	for _, allowed := range []string{"Han Hiragana Katakana Latin", "Bopomofo Han Latin", "Han Hangul Latin"} {
+		ok := true
+		for _, s := range scripts {
+			if !strings.Contains(" "+allowed+" ", " "+s+" ") {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return false
+		}
+	}
+	return true
+}
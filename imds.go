@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var imdsPreset bool
+
+const imdsBase = "http://169.254.169.254"
+
+// imdsURL adds the query parameters the GCP and Azure metadata services need
+// to answer in JSON
+func imdsURL(arg string) string {
+	u, err := url.Parse(arg)
+	if err != nil {
+		return arg
+	}
+	q := u.Query()
+	switch {
+	case strings.HasPrefix(u.Path, "/computeMetadata/"):
+		if q.Get("alt") == "" {
+			q.Set("alt", "json")
+		}
+	case strings.HasPrefix(u.Path, "/metadata/"):
+		if q.Get("api-version") == "" {
+			q.Set("api-version", "2021-02-01")
+		}
+		if q.Get("format") == "" {
+			q.Set("format", "json")
+		}
+	default:
+		return arg
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// imdsToken does the AWS IMDSv2 handshake, failure is expected when not on
+// AWS and is only logged
+func imdsToken(client *http.Client) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "PUT", imdsBase+"/latest/api/token", nil)
+	if err != nil {
+		return
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "300")
+	resp, err := client.Do(req)
+	if err != nil {
+		if debug {
+			log.Println("No IMDSv2 token:", err)
+		}
+		return
+	}
+	defer resp.Body.Close()
+	token, err := ioutil.ReadAll(resp.Body)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		if debug {
+			log.Println("No IMDSv2 token:", resp.Status)
+		}
+		return
+	}
+	Headers["x-aws-ec2-metadata-token"] = strings.TrimSpace(string(token))
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+var (
+	inputFormat  string
+	outputFormat string
+)
+
+// bodyFormat picks how to decode a response body, --input wins over the
+// Content-Type of the response
+func bodyFormat(resp *http.Response) string {
+	if inputFormat != "" {
+		return inputFormat
+	}
+	if resp == nil {
+		return "json"
+	}
+	mt, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	switch {
+	case mt == "application/yaml", mt == "application/x-yaml", mt == "text/yaml", mt == "text/x-yaml",
+		strings.HasSuffix(mt, "+yaml"):
+		return "yaml"
+	case mt == "application/xml", mt == "text/xml", strings.HasSuffix(mt, "+xml"):
+		return "xml"
+	}
+	return "json"
+}
+
+// decodeInput converts a response body in another format to JSON, so the
+// rest of the pipeline and the cache only ever see JSON
+func decodeInput(resp *http.Response, body []byte) ([]byte, error) {
+	if bodyFilter != "" {
+		var err error
+		if body, err = filterBody(body); err != nil {
+			return nil, err
+		}
+	}
+	switch format := bodyFormat(resp); format {
+	case "json":
+		return body, nil
+	case "yaml":
+		docs, err := yamlDocuments(body)
+		if err != nil {
+			return nil, err
+		}
+		if len(docs) < 2 {
+			var v interface{}
+			if len(docs) == 1 {
+				v = docs[0]
+			}
+			return json.Marshal(v)
+		}
+		// several documents are kept as a stream of JSON values, one a line
+		var out []byte
+		for _, doc := range docs {
+			byt, err := json.Marshal(doc)
+			if err != nil {
+				return nil, err
+			}
+			out = append(append(out, byt...), '\n')
+		}
+		return out, nil
+	case "xml":
+		v, err := xmlUnmarshal(body)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(v)
+	default:
+		return nil, fmt.Errorf("unknown input format %q", format)
+	}
+}
+
+// docStream is a body of several documents, such as a multi-document YAML
+// reply, each queried as an input of its own as jq does with a stream
+type docStream []interface{}
+
+// unmarshalBody parses a decoded body, a stream of several JSON values coming
+// back as a docStream
+func unmarshalBody(byt []byte, v *interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(byt))
+	var docs []interface{}
+	for {
+		var doc interface{}
+		if err := dec.Decode(&doc); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		docs = append(docs, doc)
+	}
+	switch len(docs) {
+	case 0:
+		// the error for an empty body
+		return json.Unmarshal(byt, v)
+	case 1:
+		*v = docs[0]
+	default:
+		*v = docStream(docs)
+	}
+	return nil
+}
+
+// inputDocs splits an input of several documents into one input each, with
+// the --with-metadata envelope around every one
+func inputDocs(input interface{}) []interface{} {
+	if docs, ok := input.(docStream); ok {
+		return docs
+	}
+	if env, ok := input.(map[string]interface{}); ok {
+		if docs, ok := env["body"].(docStream); ok {
+			out := make([]interface{}, len(docs))
+			for i, doc := range docs {
+				e := make(map[string]interface{}, len(env))
+				for k, v := range env {
+					e[k] = v
+				}
+				e["body"] = doc
+				out[i] = e
+			}
+			return out
+		}
+	}
+	return []interface{}{input}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+)
+
+// parsePrefix accepts either a CIDR or a bare address, treated as a single host
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		return p.Masked(), err
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// prefixContains reports if the outer network fully covers the inner one
+func prefixContains(outer, inner netip.Prefix) bool {
+	return outer.Bits() <= inner.Bits() && outer.Contains(inner.Addr().Unmap())
+}
+
+func funcIPInCIDR(v interface{}, args []interface{}) interface{} {
+	s, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("ip_in_cidr cannot be applied to: %#v", v)
+	}
+	ip, err := parsePrefix(s)
+	if err != nil {
+		return fmt.Errorf("ip_in_cidr: %s", err)
+	}
+	cidrs, ok := args[0].([]interface{})
+	if !ok {
+		cidrs = []interface{}{args[0]}
+	}
+	for _, c := range cidrs {
+		cs, ok := c.(string)
+		if !ok {
+			return fmt.Errorf("ip_in_cidr: expected a CIDR string, got %#v", c)
+		}
+		cidr, err := parsePrefix(cs)
+		if err != nil {
+			return fmt.Errorf("ip_in_cidr: %s", err)
+		}
+		if prefixContains(cidr, ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func funcCIDRContains(v interface{}, args []interface{}) interface{} {
+	s, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("cidr_contains cannot be applied to: %#v", v)
+	}
+	cidr, err := parsePrefix(s)
+	if err != nil {
+		return fmt.Errorf("cidr_contains: %s", err)
+	}
+	is, ok := args[0].(string)
+	if !ok {
+		return fmt.Errorf("cidr_contains: expected an address string, got %#v", args[0])
+	}
+	ip, err := parsePrefix(is)
+	if err != nil {
+		return fmt.Errorf("cidr_contains: %s", err)
+	}
+	return prefixContains(cidr, ip)
+}
+
+func funcIPSort(v interface{}, args []interface{}) interface{} {
+	a, ok := v.([]interface{})
+	if !ok {
+		return fmt.Errorf("ip_sort cannot be applied to: %#v", v)
+	}
+	prefixes := make([]netip.Prefix, len(a))
+	for i, e := range a {
+		s, ok := e.(string)
+		if !ok {
+			return fmt.Errorf("ip_sort: expected an address string, got %#v", e)
+		}
+		p, err := parsePrefix(s)
+		if err != nil {
+			return fmt.Errorf("ip_sort: %s", err)
+		}
+		prefixes[i] = p
+	}
+	out := make([]interface{}, len(a))
+	copy(out, a)
+	sort.Stable(ipSorter{out, prefixes})
+	return out
+}
+
+type ipSorter struct {
+	vals     []interface{}
+	prefixes []netip.Prefix
+}
+
+func (s ipSorter) Len() int { return len(s.vals) }
+func (s ipSorter) Less(i, j int) bool {
+	if c := s.prefixes[i].Addr().Compare(s.prefixes[j].Addr()); c != 0 {
+		return c < 0
+	}
+	return s.prefixes[i].Bits() < s.prefixes[j].Bits()
+}
+func (s ipSorter) Swap(i, j int) {
+	s.vals[i], s.vals[j] = s.vals[j], s.vals[i]
+	s.prefixes[i], s.prefixes[j] = s.prefixes[j], s.prefixes[i]
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/itchyny/gojq"
+	"github.com/pschou/jqURL/pkg/jqurl"
+)
+
+var (
+	queryTimeout time.Duration
+
+	jqVarNames  []string
+	jqVarValues []interface{}
+	jqNamed     = map[string]interface{}{}
+
+	// slurps are the NAME and FILE of each --slurpfile
+	slurps [][2]string
+
+	jqVarName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// pairFlags take a name and a value, like jq's
+var pairFlags = map[string]bool{"--arg": true, "--argjson": true, "--slurpfile": true}
+
+// joinPairFlags rewrites "--arg NAME VALUE" as "--arg NAME=VALUE" before the
+// flags are parsed, as the parser only takes one value per flag
+func joinPairFlags(args []string) []string {
+	out := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		if args[i] == "--" {
+			return append(out, args[i:]...)
+		}
+		if pairFlags[args[i]] && i+2 < len(args) && !strings.Contains(args[i+1], "=") {
+			out = append(out, args[i], args[i+1]+"="+args[i+2])
+			i += 2
+			continue
+		}
+		out = append(out, args[i])
+	}
+	return out
+}
+
+// splitPair separates NAME=VALUE
+func splitPair(flag string, arg []string) (string, string, error) {
+	parts := strings.SplitN(arg[0], "=", 2)
+	if len(parts) < 2 {
+		return "", "", fmt.Errorf("%s needs a name and a value", flag)
+	}
+	return parts[0], parts[1], nil
+}
+
+// setJQVar defines $name for the jq programs, like jq's --arg family
+func setJQVar(name string, v interface{}) error {
+	if !jqVarName.MatchString(name) {
+		return fmt.Errorf("invalid variable name %q", name)
+	}
+	jqNamed[name] = v
+	for i, n := range jqVarNames {
+		if n == "$"+name {
+			jqVarValues[i] = v
+			return nil
+		}
+	}
+	jqVarNames = append(jqVarNames, "$"+name)
+	jqVarValues = append(jqVarValues, v)
+	return nil
+}
+
+// argString handles --arg NAME VALUE
+func argString(args []string) error {
+	name, val, err := splitPair("--arg", args)
+	if err != nil {
+		return err
+	}
+	return setJQVar(name, val)
+}
+
+// argJSON handles --argjson NAME JSON
+func argJSON(args []string) error {
+	name, val, err := splitPair("--argjson", args)
+	if err != nil {
+		return err
+	}
+	var v interface{}
+	if err := json.Unmarshal([]byte(val), &v); err != nil {
+		return fmt.Errorf("--argjson %s: invalid JSON: %s", name, err)
+	}
+	return setJQVar(name, v)
+}
+
+// slurpFile handles --slurpfile NAME FILE, the file is read by
+// readSlurpFiles once all the flags, --read-allow among them, are in
+func slurpFile(args []string) error {
+	name, file, err := splitPair("--slurpfile", args)
+	if err != nil {
+		return err
+	}
+	slurps = append(slurps, [2]string{name, file})
+	return nil
+}
+
+// readSlurpFiles binds the JSON values in each --slurpfile as an array
+func readSlurpFiles() error {
+	for _, slurp := range slurps {
+		if err := readSlurpFile(slurp[0], slurp[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readSlurpFile(name, file string) error {
+	if err := checkRead(file); err != nil {
+		return fmt.Errorf("--slurpfile %s: %s", name, err)
+	}
+	byt, err := ioutil.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("--slurpfile %s: %s", name, err)
+	}
+	vals := []interface{}{}
+	dec := json.NewDecoder(bytes.NewReader(byt))
+	for {
+		var v interface{}
+		if err = dec.Decode(&v); err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("--slurpfile %s: invalid JSON in %q: %s", name, file, err)
+		}
+		vals = append(vals, v)
+	}
+	return setJQVar(name, vals)
+}
+
+// compileJQ compiles a jq program with the extra builtins and the variables
+// from --arg, --argjson and --slurpfile, plus $ARGS and any extra variables,
+// whose values are then passed to runJQ
+func compileJQ(expr string, extra ...string) (*gojq.Code, error) {
+	opts := append([]gojq.CompilerOption{}, jqFunctions...)
+	opts = append(opts, gojq.WithVariables(append(append(append([]string{}, jqVarNames...), "$ARGS"), extra...)))
+	if _, fake := clock.(*jqurl.FakeClock); fake {
+		return compileFakeNow(expr, opts)
+	}
+	return jqurl.Compile(expr, opts...)
+}
+
+// runJQ runs a program from compileJQ, stopping it once it has run for
+// --query-timeout on the input
+func runJQ(code *gojq.Code, input interface{}, extra ...interface{}) gojq.Iter {
+	args := map[string]interface{}{"positional": []interface{}{}, "named": jqNamed}
+	values := append(append(append([]interface{}{}, jqVarValues...), args), extra...)
+	if queryTimeout <= 0 {
+		return code.Run(input, values...)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	return &timedIter{iter: code.RunWithContext(ctx, input, values...), cancel: cancel}
+}
+
+// timedIter releases the timeout of a query once it is done, and explains
+// the error when it runs out
+type timedIter struct {
+	iter   gojq.Iter
+	cancel context.CancelFunc
+}
+
+func (t *timedIter) Next() (interface{}, bool) {
+	v, ok := t.iter.Next()
+	if !ok {
+		t.cancel()
+	} else if err, isErr := v.(error); isErr && errors.Is(err, context.DeadlineExceeded) {
+		t.cancel()
+		return fmt.Errorf("stopped after running for --query-timeout %s", queryTimeout), true
+	}
+	return v, ok
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io/ioutil"
+
+	"github.com/itchyny/gojq"
+)
+
+var (
+	fromFile     string
+	libraryPaths []string
+)
+
+// readFromFile reads the jq program of -f, leaving every argument a URL
+func readFromFile() (string, error) {
+	if err := checkRead(fromFile); err != nil {
+		return "", err
+	}
+	byt, err := ioutil.ReadFile(fromFile)
+	return string(byt), err
+}
+
+// moduleLoader lets a query import and include modules from the
+// --library-path directories, none being loaded without one
+func moduleLoader() (gojq.CompilerOption, error) {
+	if len(libraryPaths) == 0 {
+		return nil, nil
+	}
+	for _, dir := range libraryPaths {
+		if err := checkRead(dir); err != nil {
+			return nil, err
+		}
+	}
+	return gojq.WithModuleLoader(&sandboxLoader{gojq.NewModuleLoader(libraryPaths)}), nil
+}
+
+// sandboxLoader keeps the search path an import may give, as in
+// import "a" {search: "/dir"}, to --read-allow
+type sandboxLoader struct {
+	gojq.ModuleLoader
+}
+
+type metaModuleLoader interface {
+	LoadInitModules() ([]*gojq.Query, error)
+	LoadModuleWithMeta(string, map[string]interface{}) (*gojq.Query, error)
+	LoadJSONWithMeta(string, map[string]interface{}) (interface{}, error)
+}
+
+func (l *sandboxLoader) checkSearch(meta map[string]interface{}) error {
+	if dir, ok := meta["search"].(string); ok {
+		return checkRead(dir)
+	}
+	return nil
+}
+
+func (l *sandboxLoader) LoadInitModules() ([]*gojq.Query, error) {
+	return l.ModuleLoader.(metaModuleLoader).LoadInitModules()
+}
+
+func (l *sandboxLoader) LoadModuleWithMeta(name string, meta map[string]interface{}) (*gojq.Query, error) {
+	if err := l.checkSearch(meta); err != nil {
+		return nil, err
+	}
+	return l.ModuleLoader.(metaModuleLoader).LoadModuleWithMeta(name, meta)
+}
+
+func (l *sandboxLoader) LoadJSONWithMeta(name string, meta map[string]interface{}) (interface{}, error) {
+	if err := l.checkSearch(meta); err != nil {
+		return nil, err
+	}
+	return l.ModuleLoader.(metaModuleLoader).LoadJSONWithMeta(name, meta)
+}
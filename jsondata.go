@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+var jsonData string
+
+// applyJSONData evaluates --json-data against null, with the --arg family of
+// variables, and sends the one value it gives as the request body
+func applyJSONData() error {
+	if jsonData == "" {
+		return nil
+	}
+	if postData != "" || graphqlQuery != "" {
+		return fmt.Errorf("use only one of --json-data, --data and --graphql")
+	}
+	code, err := compileJQ(jsonData)
+	if err != nil {
+		return fmt.Errorf("--json-data: %s", err)
+	}
+	var body interface{}
+	n := 0
+	iter := runJQ(code, nil)
+	for {
+		v, ok := iter.Next()
+		if !ok {
+			break
+		}
+		if err, ok := v.(error); ok {
+			return fmt.Errorf("--json-data: %s", err)
+		}
+		body = v
+		n++
+	}
+	if n != 1 {
+		return fmt.Errorf("--json-data must give exactly one value, got %d", n)
+	}
+	byt, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("--json-data: %s", err)
+	}
+	postData = string(byt)
+	if method == "GET" || method == "HEAD" {
+		method = "POST"
+	}
+	return nil
+}
+
+// bodyContentType picks the Content-Type of a request body when no -H gave
+// one: JSON when it is, or is read from a file, else form data as with curl
+func bodyContentType() string {
+	if len(dataURLEncode) > 0 {
+		return "application/x-www-form-urlencoded"
+	}
+	if jsonData != "" || strings.HasPrefix(postData, "@") || json.Valid([]byte(postData)) {
+		return "application/json"
+	}
+	return "application/x-www-form-urlencoded"
+}
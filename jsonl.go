@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+)
+
+var jsonLines bool
+
+// streamJSONL runs the query on each line of a JSON Lines response as it
+// arrives, for endpoints such as event feeds and log tails which never end
+func streamJSONL(client *http.Client) {
+	opts := fetchOptions(client)
+	opts.Stream = true
+	res, err := fetchDo(opts)
+	if err != nil {
+		log.Fatalf("Error opening stream: %s", err)
+	}
+	defer res.Response.Body.Close()
+
+	rdr := bufio.NewReader(saveStream(res.Response.Body))
+	for {
+		line, err := rdr.ReadBytes('\n')
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			var v interface{}
+			if jerr := json.Unmarshal(line, &v); jerr != nil {
+				fmt.Fprintf(os.Stderr, "Skipping invalid JSON line: %s\n", jerr)
+			} else {
+				queryInput(respEnvelope(res.URL, res.Response, "", v))
+			}
+		}
+		if err == io.EOF {
+			// trailers only arrive after the last line
+			keepTrailers(res.Response)
+			break
+		}
+		if err != nil {
+			log.Fatalf("Error reading stream: %s", err)
+		}
+	}
+	finishQuery()
+}
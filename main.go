@@ -14,38 +14,45 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strings"
 	"time"
 
 	"github.com/itchyny/gojq"
 	"github.com/pschou/go-params"
-	"github.com/vishvananda/netns"
+	"github.com/pschou/jqURL/pkg/jqurl"
 )
 
 var (
 	version = "debug"
 	debug   = false
-	Headers = map[string]string{
-		"content-type": "application/json",
-	}
+	Headers = map[string]string{}
 
 	JQString string
 	keypair  tls.Certificate
 
 	raw, includeHeader, certIgnore, flush, useCache, followRedirects, pretty bool
+	locationTrusted                                                          bool
 	cert, key, ca, cacheDir, method, postData, outputFile                    string
 	maxTries                                                                 int
+	retryNonIdempotent                                                       bool
 	delay, maxAge, timeout                                                   time.Duration
 	headerVals                                                               *headerValue
 	caCertPool                                                               *x509.CertPool
 
-	dat        map[string]interface{}
-	Args       []string
-	urls       [](*url.URL)
-	cacheFiles []string
+	dat         interface{}
+	queryCode   *gojq.Code
+	yamlStarted = map[io.Writer]bool{}
+	output      io.Writer
+	Args        []string
+	urls        [](*url.URL)
+	cacheFiles  []string
 
-	docker string
+	docker           string
+	containerRuntime string
+	k8sPod           string
+	netnsName        string
 )
 
 type headerValue string
@@ -59,7 +66,7 @@ func (h *headerValue) Set(val []string) error {
 	return nil
 }
 func (h *headerValue) Get() interface{} { return "" }
-func (h *headerValue) String() string   { return "\"content-type: application/json\"" }
+func (h *headerValue) String() string   { return "\"\"" }
 
 func main() {
 	params.Default = "Default="
@@ -67,44 +74,290 @@ func main() {
 	params.PresVar(&flush, "flush", "Force redownload, when using cache")
 	params.PresVar(&useCache, "cache C", "Use local cache to speed up static queries")
 	params.PresVar(&debug, "debug", "Debug / verbose output")
+	params.PresVar(&versionJSON, "version-json", "Print the version, build and features of this binary as JSON and exit")
+	params.PresVar(&unsignedUpdate, "unsigned-update", "Let self-update install a release checked against its checksums only, in a build without an update key")
+	params.StringVar(&fakeTime, "fake-time", "", "Run with the clock stopped at this time, RFC 3339 or epoch seconds, and waits taking none, for tests", "TIME")
+	params.PresVar(&fetchAllURLs, "all", "Fetch every URL, in parallel, and query an array of all the bodies")
+	params.PresVar(&keyedByURL, "keyed", "With --all, query an object of the bodies keyed by URL")
+	params.IntVar(&parallel, "parallel", 8, "Number of URLs fetched at once with --all", "N")
+	params.PresVar(&adaptive, "adaptive", "With --all, start with one request at a time and adjust up to --parallel by the server's latency and 429/503 replies")
+	params.PresVar(&arrayStream, "array-stream", "Run the query on each element of a top-level JSON array as it is read, rather than on the whole body")
+	params.PresVar(&sseMode, "sse", "Subscribe to a Server-Sent Events stream, running the query on each event's data as it arrives")
+	params.PresVar(&jsonLines, "jsonl", "Read the response as JSON Lines, running the query on each line as it arrives")
+	params.StringVar(&inputFormat, "input", "", "Format of response bodies: json, yaml or xml, by default picked from the Content-Type", "FORMAT")
+	params.StringVar(&outputFormat, "output-format", "json", "Format of results: json or yaml", "FORMAT")
+	params.FlagFunc("arg", "Set $NAME to the string VALUE in the query", "NAME VALUE", 1, argString)
+	params.FlagFunc("argjson", "Set $NAME to the JSON value in the query", "NAME JSON", 1, argJSON)
+	params.FlagFunc("slurpfile", "Set $NAME to an array of the JSON values in FILE", "NAME FILE", 1, slurpFile)
 	params.PresVar(&raw, "raw-output r", "Raw output, no quotes for strings")
+	params.DurationVar(&queryTimeout, "query-timeout", 0, "Stop a jq query which runs longer than this on one input, 0 for no limit", "DURATION")
+	params.StringVar(&maxMemory, "max-memory", "", "Abort when the process uses more memory than this, ie: 512M", "SIZE")
+	params.PresVar(&exitStatus, "exit-status", "Exit 1 when the last result is false or null, 4 when there is none, as jq -e")
+	params.PresVar(&failHTTP, "fail", "Exit 22 on an HTTP 4xx/5xx reply, only retrying 5xx, 408 and 429")
+	params.PresVar(&failWithBody, "fail-with-body", "As --fail, writing the body of the error reply to stdout")
+	params.StringVar(&assertStatus, "assert-status", "", "Exit 5 unless the reply has one of these statuses, ie: 200,201 or 2xx", "LIST")
+	params.StringSliceVar(&assertHeaders, "assert-header", "Exit 6 unless the reply has this header with a value matching the regex, repeatable", "'NAME: REGEX'", 1)
+	params.DurationVar(&assertMaxTime, "assert-max-time", 0, "Exit 7 when a fetch succeeds but takes longer than this, retries included", "DURATION")
+	params.StringVar(&verifySHA256, "verify-sha256", "", "Exit 8 unless the response body has this SHA-256 hash, checked before it is parsed", "HEX")
+	params.StringVar(&verifyHeader, "verify-from-header", "", "Exit 8 unless the response body matches the digest in this header, ie: Digest or Content-Digest", "NAME")
 	params.PresVar(&includeHeader, "include i", "Include header in output")
-	temp := os.Getenv("TEMP")
-	if len(temp) > 4 && temp[1:2] == ":\\" {
-		// use windows temp directory name
-	} else {
-		temp = os.TempDir()
-	}
-	params.StringVar(&cacheDir, "cachedir", temp, "Path for cache", "DIR")
+	params.PresVar(&withMetadata, "with-metadata", "Query {\"status\",\"headers\",\"url\",\"body\"} instead of just the body")
+	params.StringVar(&profileName, "profile", "", "Use the flags of this profile in the config file, defaults to $JQURL_PROFILE or \"default\"", "NAME")
+	params.StringVar(&configFile, "config", "", "Config file with the profiles, defaults to config.yaml or config.toml in ~/.config/jqurl", "FILE")
+	params.StringVar(&cacheDir, "cachedir", defaultCacheDir(), "Path for cache", "DIR")
+	params.StringVar(&mapExec, "map-exec", "", "Run a command per result instead of printing it, {} in an argument is replaced by the value", "'CMD {}'")
+	params.PresVar(&mapExecShell, "map-exec-shell", "Run the --map-exec command with sh -c, the value is passed as $1")
+	params.StringVar(&urlNormalize, "url-normalize", urlNormalize, "Steps applied to URLs for cache keys: host, port, path, query, fragment, all or none", "LIST")
+	params.StringVar(&casDir, "cas-dir", "", "Keep every fetched body in this directory by its SHA-256, with an index of what each URL served, see: cas", "DIR")
+	params.StringVar(&freezeFile, "freeze", "", "Record the fetched bodies, hashes and ETags in a lock file", "FILE")
+	params.PresVar(&frozen, "frozen", "Replay the bodies recorded in the --freeze lock file instead of fetching")
+	params.StringVar(&fixtureFile, "fixture", "", "Answer the first URL with this file instead of fetching it, and fetch nothing else, for offline runs", "FILE")
+	params.StringVar(&reduceExpr, "reduce", "", "Fold the query results of every page or line together, EXPR runs on the total with $item", "EXPR")
+	params.StringVar(&splitBy, "split-by", "", "Write each result to a file in --split-dir named by this jq expression", "EXPR")
+	params.StringVar(&splitDir, "split-dir", ".", "Directory for --split-by files", "DIR")
 	params.StringVar(&outputFile, "output o", "", "Write output to <file> instead of stdout", "FILE")
+	params.StringVar(&saveBody, "save-body", "", "Also write the response body, as received, to this file", "FILE")
+	params.IntVar(&outputFD, "output-fd", 1, "Write the results to this open file descriptor, keeping stdout free", "N")
+	params.StringVar(&outputTemplate, "output-template", "", "Write output to a file named with strftime patterns, creating directories, ie: out/%Y/%m/%d/%H.json", "TEMPLATE")
 	params.DurationVar(&maxAge, "max-age", 4*time.Hour, "Max age for cache", "DURATION")
+	params.DurationVar(&refreshTimeout, "refresh-timeout", 0, "Serve an expired cache entry if refreshing takes longer, finishing the refresh in the background", "DURATION")
+	params.StringVar(&timeZone, "tz", "", "Time zone used by localtime/strflocaltime, ie: America/New_York", "ZONE")
+	params.StringVar(&cacheNamespace, "cache-namespace", "", "Keep cache entries apart from other jobs, defaults to the user id", "NAME")
+	params.PresVar(&rawBody, "raw-body", "Write the response body to the output as it is, without parsing it, the query must be .")
+	params.PresVar(&noJQ, "no-jq", "Take no query, every argument is a URL, and write the body as with --raw-body")
+	params.StringVar(&fromFile, "from-file f", "", "Read the jq query from a file, every argument is then a URL", "FILE")
+	params.StringSliceVar(&libraryPaths, "library-path", "Directory searched for modules the query imports or includes, repeatable, as jq -L", "DIR", 1)
+	params.StringVar(&scriptFile, "script", "", "Run a jq program from file which makes its own requests with fetch(url; opts)", "FILE")
+	params.DurationVar(&watchInterval, "watch", 0, "Fetch and run the query again at this interval until interrupted", "DURATION")
+	params.PresVar(&changesOnly, "changes-only", "With --watch, only write the results when they differ from the last round")
+	params.StringVar(&serveAddr, "serve", "", "Run as a server answering GET / with the query results, with /healthz, /readyz and /metrics", "ADDR")
+	params.StringVar(&purgeToken, "purge-token", "", "Enable POST /purge in --serve mode for requests with this bearer token, or @FILE, or $JQURL_PURGE_TOKEN", "TOKEN")
+	params.StringVar(&purgeOnSignal, "purge-on-signal", "", "Purge the cache and fetch again in --serve mode on this signal, ie: SIGHUP", "SIGNAL")
+	params.DurationVar(&shutdownTimeout, "shutdown-timeout", 30*time.Second, "How long --serve lets open requests finish after SIGTERM", "DURATION")
+	params.StringVar(&singleton, "singleton", "", "Only let one run of the job NAME go at a time, others skip it", "NAME")
+	params.DurationVar(&singletonWait, "singleton-wait", 0, "How long a --singleton run waits for the one going before skipping", "DURATION")
+	params.StringVar(&stateFile, "state", "", "File backing state_get/state_set, defaults to a file per namespace in cachedir", "FILE")
+	params.StringVar(&auditLog, "audit-log", "", "Append a JSON line for every request sent to this file, for egress accounting", "FILE")
+	params.StringVar(&metricsJSON, "metrics-json write-out", "", "Append a JSON line of DNS, connect, TLS, TTFB and total times, bytes, retries and cache use per URL to this file, - for stderr", "FILE")
+	params.PresVar(&auditChain, "audit-chain", "Chain the --audit-log entries by the SHA-256 of the line before, check with: audit verify FILE")
 	params.GroupingSet("Request")
-	params.StringVar(&postData, "data d", "", "Data to use in POST (use @filename to read from file)", "STRING")
-	params.Var(headerVals, "header H", "Custom header to pass to server\n", "'HEADER: VALUE'", 1)
+	params.StringVar(&baseURLFlag, "base-url", "", "Prefixed onto URL arguments given as a bare path, such as /v1/items", "URL")
+	params.StringVar(&postData, "data d", "", "Data to send, use @filename to read from a file or @- for stdin", "STRING")
+	params.StringSliceVar(&formFields, "form F", "Multipart form field, NAME=@FILE uploads a file and NAME=<FILE sends its text, ;type= sets the type", "NAME=VALUE", 1)
+	params.StringSliceVar(&dataURLEncode, "data-urlencode", "Form data to send URL-encoded, as NAME=VALUE, NAME@FILE or just VALUE", "DATA", 1)
+	params.StringVar(&jsonData, "json-data", "", "Send the JSON built by this jq expression, which may use --arg values, as a POST body", "EXPR")
+	params.StringVar(&graphqlQuery, "graphql", "", "POST a GraphQL query, or @filename, and query its .data, exiting 1 on .errors", "QUERY")
+	params.StringSliceVar(&graphqlVars, "graphql-var", "Variable for the --graphql query, the value is JSON or else a string", "NAME=VALUE", 1)
+	params.StringVar(&basicUser, "user u", "", "Basic auth credentials, for the password to stay out of shell history use --netrc", "USER:PASSWORD")
+	params.StringVar(&bearerToken, "bearer", "", "Send Authorization: Bearer TOKEN", "TOKEN")
+	params.StringVar(&tokenFile, "token-file", "", "Send Authorization: Bearer with the token read from this file", "FILE")
+	params.PresVar(&useNetrc, "netrc n", "Log in with the credentials for each host in ~/.netrc, or $NETRC")
+	params.StringVar(&netrcFile, "netrc-file", "", "As --netrc, reading this file", "FILE")
+	params.StringVar(&userAgent, "user-agent A", userAgent, "User-Agent header, {version}, {hostname}, {user}, {pid} and {job} are filled in", "AGENT")
+	params.StringSliceVar(&headerIf, "header-if", "Header only sent to hosts matching a glob or CIDR, ie: '*.internal X-Auth: abc'", "'HOST HEADER: VALUE'", 1)
+	params.StringVar(&headerRulesFile, "header-rules", "", "YAML file of host rules with the headers to send to them", "FILE")
+	params.StringSliceVar(&thenURLs, "then", "Fetch this URL for each query result, {{EXPR}} is filled in from the result, repeat for more steps", "'[METHOD] URL'", 1)
+	params.StringSliceVar(&thenHeaders, "then-header", "Header for the --then requests, may use {{EXPR}}", "'HEADER: VALUE'", 1)
+	params.StringVar(&thenData, "then-data", "", "Body for the --then requests, may use {{EXPR}}", "STRING")
+	params.StringVar(&thenQuery, "then-query", thenQuery, "jq query run on the bodies of the last --then step", "EXPR")
+	params.StringVar(&referer, "referer e", "", "Referer header, ending in ;auto also sets it to the previous URL on redirects", "URL")
+	params.StringVar(&origin, "origin", "", "Origin header, for CSRF protected endpoints", "SCHEME://HOST")
+	params.Var(headerVals, "header H", "Custom header to pass to server", "'HEADER: VALUE'", 1)
+	params.StringSliceVar(&cookies, "cookie b", "Cookie to send, or a Netscape format cookie file to read, repeatable", "'NAME=VALUE'", 1)
+	params.StringVar(&cookieFile, "cookie-jar c", "", "Read cookies from and save them back to this Netscape (curl) format file", "FILE")
 	params.PresVar(&followRedirects, "location L", "Follow redirects")
+	params.PresVar(&followPages, "paginate", "Follow Link: rel=\"next\" headers and continuation tokens, querying all pages merged")
+	params.PresVar(&pageStream, "paginate-stream", "Follow pages like --paginate, running the query on each page as it arrives")
+	params.StringVar(&nextJQ, "next-jq", "", "jq expression giving the next page URL from each page, null ends the paging", "EXPR")
+	params.StringVar(&cursorParam, "cursor-param", "", "Send the --next-jq value as this query parameter instead of as a URL", "NAME")
+	params.StringVar(&pageParam, "page-param", "", "Count up this page number query parameter until a page comes back empty", "NAME")
+	params.IntVar(&maxPages, "max-pages", 0, "Stop after this many pages, 0 for no limit", "N")
+	params.PresVar(&locationTrusted, "location-trusted", "Follow redirects and keep credentials when they go to another host")
 	params.DurationVar(&delay, "retry-delay", 7*time.Second, "Delay between retries", "DURATION")
 	params.DurationVar(&timeout, "max-time m", 15*time.Second, "Timeout per request", "DURATION")
 	params.IntVar(&maxTries, "max-tries", 30, "Maximum number of tries", "TRIES")
+	params.PresVar(&retryBackoff, "retry-backoff", "Double the retry delay after each round of tries, with random jitter")
+	params.DurationVar(&retryMaxDelay, "retry-max-delay", 5*time.Minute, "Longest wait between tries, also caps Retry-After", "DURATION")
+	params.StringVar(&retryOn, "retry-on", "", "Only retry these failures: status codes, 4xx, 5xx, conn, timeout or invalid, ie: 429,5xx,conn", "LIST")
+	params.StringVar(&retryPolicyScript, "retry-policy-script", "", "Run this after each failed try to decide on a retry and its delay, it gets the failure as JSON on stdin", "'CMD ARGS'")
+	params.PresVar(&retryNonIdempotent, "retry-non-idempotent", "Also retry methods such as POST, which may repeat what the request does")
+	params.DurationVar(&heartbeat, "heartbeat", 0, "Print a status line to stderr this often while retrying", "DURATION")
+	params.PresVar(&progressJSON, "progress-json", "Print a JSON status line to stderr for each failed try")
 	params.PresVar(&certIgnore, "insecure k", "Ignore certificate validation checks")
 	params.StringVar(&method, "request X", "GET", "Method to use for HTTP request (ie: POST/GET)", "METHOD")
-	params.StringVar(&docker, "docker", "", "Switch to the network of a container", "CONTAINER_ID")
+	params.PresVar(&ociMode, "oci", "Container registry mode, handles token auth, manifest types and tag paging")
+	params.PresVar(&githubPreset, "github", "GitHub API preset, relative URLs use api.github.com and $GITHUB_TOKEN")
+	params.PresVar(&gitlabPreset, "gitlab", "GitLab API preset, relative URLs use gitlab.com and $GITLAB_TOKEN")
+	params.PresVar(&aqlPreset, "aql", "Artifactory AQL preset, POSTs --data to api/search/aql under the URL")
+	params.PresVar(&nexusPreset, "nexus", "Nexus preset, follows continuationToken pages")
+	params.PresVar(&imdsPreset, "imds", "Cloud instance metadata preset (AWS IMDSv2, GCP, Azure), relative URLs use 169.254.169.254")
+	params.PresVar(&expect100, "expect100", "Send Expect: 100-continue with bodies over 1MB, so a server can refuse before the upload")
+	params.DurationVar(&expect100Timeout, "expect100-timeout", time.Second, "How long to wait for 100 Continue before sending the body anyway", "DURATION")
+	params.StringVar(&readBuffer, "read-buffer", "", "Size of the connection read buffer, ie: 64k", "SIZE")
+	params.StringVar(&writeBuffer, "write-buffer", "", "Size of the connection write buffer, ie: 256k", "SIZE")
+	params.PresVar(&prewarmConns, "prewarm-connections", "Resolve and connect to every URL's host in parallel, TLS included, before the first request")
+	params.PresVar(&uploadProgress, "upload-progress", "Show the progress of sending the request body on stderr")
+	params.PresVar(&downloadProgress, "progress", "Show the progress of reading each response body on stderr")
+	params.StringVar(&maxFilesize, "max-filesize", "", "Abort when a response body, once decompressed, is larger than this, ie: 100M", "SIZE")
+	params.StringSliceVar(&sharedRates, "shared-rate", "Limit requests to a host across all jqurl processes, ie: api.github.com=10/s", "HOST=COUNT/PERIOD", 1)
+	params.StringVar(&proxyURL, "proxy x", "", "Use this proxy, http://, https://, socks5:// or socks5h://, instead of HTTP(S)_PROXY", "URL")
+	params.StringVar(&noProxy, "noproxy", "", "Hosts, domains or CIDRs reached without the proxy, overrides NO_PROXY", "LIST")
+	params.StringSliceVar(&resolveRules, "resolve", "Connect to these addresses for HOST:PORT rather than looking it up, repeatable", "HOST:PORT:ADDR[,ADDR]", 1)
+	params.StringSliceVar(&connectToRules, "connect-to", "Connect to HOST2:PORT2 for requests to HOST1:PORT1, empty parts match any, repeatable", "HOST1:PORT1:HOST2:PORT2", 1)
+	params.StringVar(&dnsServers, "dns-server", "", "Look up host names with these DNS servers, comma separated, rather than the system's", "ADDR[:PORT]")
+	params.StringVar(&dohURL, "doh-url", "", "Look up host names with this DNS over HTTPS server, ie: https://1.1.1.1/dns-query", "URL")
+	params.StringVar(&unixSocket, "unix-socket", "", "Connect to this Unix socket, or Windows npipe:// pipe, instead of the URL's host", "PATH")
+	params.StringVar(&sshJump, "ssh-jump", "", "Connect through an SSH bastion host, using the ssh client and its keys/agent", "USER@HOST")
+	params.PresVar(&useTor, "tor", "Send requests through Tor, needed for .onion URLs")
+	params.StringVar(&torProxy, "tor-proxy", "127.0.0.1:9050", "Tor SOCKS address used with --tor", "HOST:PORT")
+	params.PresVar(&compressed, "compressed", "Ask for a compressed response, gzip, deflate, and br or zstd when their tools are installed")
+	params.PresVar(&http11, "http1.1", "Use HTTP/1.1 only")
+	params.PresVar(&http2, "http2", "Use HTTP/2 for https:// URLs, failing if the server doesn't offer it")
+	params.PresVar(&http2PriorKnowledge, "http2-prior-knowledge", "Use HTTP/2 only, unencrypted h2c for http:// URLs without an upgrade first")
+	params.StringVar(&bodyFilter, "body-filter", "", "Pipe each response body through a command before parsing it as JSON", "'CMD ARGS'")
+	params.StringVar(&docker, "docker", "", "Switch to the network of a container, by ID or name", "CONTAINER")
+	params.StringVar(&containerRuntime, "container-runtime", "", "Find the --docker container with docker, podman or nerdctl, rather than trying each", "NAME")
+	params.StringVar(&k8sPod, "k8s-pod", "", "Switch to the network of a Kubernetes pod on this node, found with crictl or from the kubelet", "NAMESPACE/POD")
+	params.StringVar(&netnsName, "netns", "", "Switch to a network namespace made with ip netns, or given by path", "NAME|/proc/PID/ns/net")
 
 	params.Usage = func() {
-		fmt.Println("jqURL - URL and JSON parser tool, Written by Paul Schou (github.com/pschou/jqURL), Version: " + version)
-		fmt.Printf("Usage:\n  %s [options] \"JSON Parser\" URLs\n\n", os.Args[0])
+		w := params.CommandLine.Output()
+		fmt.Fprintln(w, "jqURL - URL and JSON parser tool, Written by Paul Schou (github.com/pschou/jqURL), Version: "+version)
+		fmt.Fprintf(w, "Usage:\n  %s [options] \"JSON Parser\" URLs\n", os.Args[0])
+		fmt.Fprintf(w, "  %s [options] -f FILE URLs\n", os.Args[0])
+		fmt.Fprintf(w, "  %s [options] --script FILE\n", os.Args[0])
+		fmt.Fprintf(w, "  %s [options] prewarm JOBS_FILE\n", os.Args[0])
+		fmt.Fprintf(w, "  %s [options] cache namespaces|ls|stat URL|rm URL|prune [AGE]\n", os.Args[0])
+		fmt.Fprintf(w, "  %s audit verify FILE\n", os.Args[0])
+		fmt.Fprintf(w, "  %s [options] cas show HASH [QUERY]|log [URL]|ls\n", os.Args[0])
+		fmt.Fprintf(w, "  %s [options] self-update [TAG]\n\n", os.Args[0])
 		params.PrintDefaults()
 	}
 
 	params.GroupingSet("Certificate")
 	params.StringVar(&ca, "cacert", "", "Use certificate authorities, PEM encoded", "FILE")
-	params.StringVar(&cert, "cert E", "", "Use client cert in request, PEM encoded", "FILE")
+	params.StringVar(&cert, "cert E", "", "Use client cert in request, PEM encoded, a pkcs11: URI, or store:NAME from the Windows certificate store", "FILE")
 	params.StringVar(&key, "key", "", "Key file for client cert, PEM encoded", "FILE")
+	params.StringVar(&certType, "cert-type", "", "Type of the --cert file: PEM or P12, by default P12 for .p12 and .pfx files", "TYPE")
+	params.StringVar(&keyPass, "pass", "", "Passphrase of the key or PKCS#12 bundle, for it to stay out of shell history use --key-pass-env", "PASSWORD")
+	params.StringVar(&keyPassEnv, "key-pass-env", "", "Read the passphrase of the key or PKCS#12 bundle from this environment variable", "VAR")
+	params.PresVar(&useSpiffe, "spiffe", "Use the X.509 SVID from the SPIFFE Workload API at $SPIFFE_ENDPOINT_SOCKET as client cert, kept rotated")
+	params.StringVar(&spiffeServerID, "spiffe-id", "", "Require servers with an SVID to have this SPIFFE ID", "ID")
+	params.StringVar(&caBundleEmbedded, "ca-bundle-embedded", "", "Use a CA bundle built into the binary, \"list\" shows them", "NAME")
+	params.StringVar(&tlsPolicy, "tls-policy", "", "Restrict TLS versions and ciphers to a profile: fips, modern, intermediate or legacy", "POLICY")
+	params.StringVar(&tlsMin, "tls-min", "", "Lowest TLS version to use: 1.0, 1.1, 1.2 or 1.3", "VERSION")
+	params.StringVar(&tlsMax, "tls-max", "", "Highest TLS version to use: 1.0, 1.1, 1.2 or 1.3", "VERSION")
+	params.StringVar(&tlsCiphers, "ciphers", "", "TLS 1.2 and older cipher suites to offer, by IANA name, comma separated", "LIST")
+	params.StringVar(&tlsServer, "servername", "", "Send this name with SNI and check the certificate against it, instead of the URL's host", "NAME")
+	params.StringVar(&pinnedPubkey, "pinnedpubkey", "", "Only talk to servers with this public key, sha256//BASE64 hashes separated by ; or a PEM/DER key file", "HASHES")
+	params.StringVar(&tlsKeyLog, "tls-keylog", "", "Append TLS session keys to file for debugging, like SSLKEYLOGFILE", "FILE")
+
+	params.GroupingSet("Sandbox")
+	params.StringSliceVar(&readAllow, "read-allow", "Only read files under these paths, for @file bodies, --slurpfile, the cache and such, repeatable", "PATH", 1)
+	params.StringSliceVar(&writeAllow, "write-allow", "Only write files under these paths, for output, split, cache, cookie and state files, repeatable", "PATH", 1)
 
 	params.CommandLine.Indent = 2
+	if args, err := withProfile(os.Args); err != nil {
+		log.Fatal(err)
+	} else {
+		os.Args = args
+	}
+	os.Args = joinPairFlags(os.Args)
 	params.Parse()
 	Args = params.Args()
+	if configLoaded != "" {
+		if err := checkRead(configLoaded); err != nil {
+			log.Fatal(err)
+		}
+	}
+	openDataOut()
+	if versionJSON {
+		writeVersionJSON()
+		return
+	}
+
+	if os.Getenv(refreshEnv) != "" {
+		refreshChild, flush, refreshTimeout = true, true, 0
+		// the run which handed off the refresh has written these already,
+		// this one only rewrites the cache entry
+		saveBody, casDir, freezeFile, auditLog, metricsJSON = "", "", "", "", ""
+	}
+
+	if timeZone != "" {
+		loc, err := loadZone(timeZone)
+		if err != nil {
+			log.Fatalf("Error loading time zone %q: %s", timeZone, err)
+		}
+		time.Local = loc
+	}
+
+	watchMemory()
+
+	if cacheNamespace == "" {
+		cacheNamespace = fmt.Sprintf("%d", os.Getuid())
+	} else if !validNamespace(cacheNamespace) {
+		log.Fatalf("Invalid cache namespace %q, use letters, digits, '.', '-' and '_'", cacheNamespace)
+	}
+
+	if stateFile == "" {
+		stateFile = filepath.Join(cacheDir, "jqurl_state_"+cacheNamespace)
+	}
+
+	switch inputFormat {
+	case "", "json", "yaml", "xml":
+	default:
+		log.Fatalf("Unknown --input format %q", inputFormat)
+	}
+	if outputFile != "" && outputTemplate != "" {
+		log.Fatal("Use only one of -o and --output-template")
+	}
+	if docker != "" && k8sPod != "" || docker != "" && netnsName != "" || k8sPod != "" && netnsName != "" {
+		log.Fatal("Use only one of --docker, --k8s-pod and --netns")
+	}
+	switch outputFormat {
+	case "json", "yaml":
+	default:
+		log.Fatalf("Unknown --output-format %q", outputFormat)
+	}
+
+	if err := parseURLNormalize(); err != nil {
+		log.Fatal(err)
+	}
+	if err := readSlurpFiles(); err != nil {
+		log.Fatal(err)
+	}
+	if opt, err := moduleLoader(); err != nil {
+		log.Fatalf("--library-path: %s", err)
+	} else if opt != nil {
+		jqFunctions = append(jqFunctions, opt)
+	}
+	if useCache {
+		if err := checkWrite(cacheDir); err != nil {
+			log.Fatalf("Cache: %s", err)
+		}
+	}
+	if saveBody != "" {
+		if serveAddr != "" || watchInterval > 0 {
+			log.Fatal("--save-body can't be used with --serve or --watch")
+		}
+		if err := checkWrite(saveBody); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if casDir != "" && (len(Args) == 0 || Args[0] != "cas") {
+		if err := checkWrite(casDir); err != nil {
+			log.Fatalf("Content store: %s", err)
+		}
+	}
+	loadCookieFlags()
+	if err := parseSharedRates(); err != nil {
+		log.Fatal(err)
+	}
 
 	if ca != "" {
+		if err := checkRead(ca); err != nil {
+			log.Fatal(err)
+		}
 		caCert, err := ioutil.ReadFile(ca)
 		if err != nil {
 			log.Fatalf("Error reading CA cert file %q: %s", ca, err)
@@ -113,49 +366,215 @@ func main() {
 		caCertPool.AppendCertsFromPEM(caCert)
 	}
 
-	if cert != "" && key == "" {
-		// Just in case the cert and key are in the same file
-		key = cert
+	if caBundleEmbedded != "" {
+		if err := loadEmbeddedCABundle(caBundleEmbedded); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := openAuditLog(); err != nil {
+		log.Fatalf("Error opening audit log %q: %s", auditLog, err)
+	}
+	if err := openMetrics(); err != nil {
+		log.Fatalf("Error opening metrics file %q: %s", metricsJSON, err)
 	}
-	if cert != "" && key != "" {
+	if err := openKeyLog(); err != nil {
+		log.Fatalf("Error opening TLS key log %q: %s", tlsKeyLog, err)
+	}
+
+	if useSpiffe {
+		if cert != "" {
+			log.Fatal("Use either --cert or --spiffe, not both")
+		}
+		startSpiffe()
+	} else if strings.HasPrefix(cert, certStorePrefix) {
 		var err error
-		keypair, err = tls.LoadX509KeyPair(cert, key)
+		keypair, err = storeCert(strings.TrimPrefix(cert, certStorePrefix))
+		if err != nil {
+			log.Fatalf("Error loading client cert %q: %s", cert, err)
+		}
+	} else if strings.HasPrefix(cert, pkcs11Prefix) {
+		var err error
+		keypair, err = pkcs11Cert(cert)
+		if err != nil {
+			log.Fatalf("Error loading client cert from token: %s", err)
+		}
+	} else if cert != "" {
+		var err error
+		keypair, err = loadCertFile(cert, key)
 		if err != nil {
 			log.Fatalf("Error reading client cert keypair cert=%q key=%q: %s", cert, key, err)
 		}
 	}
 
-	if len(Args) < 2 {
+	if ociMode {
+		if _, ok := Headers["accept"]; !ok {
+			Headers["accept"] = ociAccept
+		}
+		followPages = true
+	}
+	applyPresets()
+	applyReferer()
+	if err := applyAuth(); err != nil {
+		log.Fatalf("Error setting up authentication: %s", err)
+	}
+	applyGraphQL()
+	if err := applyJSONData(); err != nil {
+		log.Fatal(err)
+	}
+	if err := applyForm(); err != nil {
+		log.Fatal(err)
+	}
+	if failWithBody {
+		failHTTP = true
+	}
+	var err error
+	if retryCheck, err = retryOnFunc(); err != nil {
+		log.Fatal(err)
+	}
+	retryPolicy = scriptRetryPolicy()
+	if err := loadClock(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadMaxFilesize(); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkTor(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadDNS(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadAssertions(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadHeaderRules(); err != nil {
+		log.Fatalf("Error loading header rules: %s", err)
+	}
+	if pageStream || nextJQ != "" || cursorParam != "" || pageParam != "" {
+		followPages = true
+	}
+	if reduceExpr != "" && followPages {
+		// fold each page in as it comes rather than merging them first
+		pageStream = true
+	}
+	if cursorParam != "" && nextJQ == "" {
+		log.Fatalf("--cursor-param needs --next-jq to find the cursor")
+	}
+
+	if len(Args) == 0 || Args[0] != "cache" && Args[0] != "audit" && Args[0] != "cas" {
+		defer holdSingleton()()
+	}
+	if len(Args) == 2 && Args[0] == "prewarm" {
+		prewarm(Args[1])
+		return
+	}
+	if len(Args) > 0 && Args[0] == "cache" {
+		cacheCommand(Args[1:])
+		return
+	}
+	if len(Args) > 0 && Args[0] == "audit" {
+		auditCommand(Args[1:])
+		return
+	}
+	if len(Args) > 0 && Args[0] == "cas" {
+		casCommand(Args[1:])
+		return
+	}
+	if len(Args) > 0 && Args[0] == "self-update" {
+		selfUpdate(Args[1:])
+		return
+	}
+
+	if noJQ {
+		rawBody = true
+	}
+	if len(Args) < 2 && scriptFile == "" && ((fromFile == "" && !noJQ) || len(Args) < 1) {
 		params.Usage()
 		os.Exit(1)
 		return
 	}
 
-	JQString = Args[0]
-	Args = Args[1:]
+	if scriptFile != "" {
+		err := checkRead(scriptFile)
+		var byt []byte
+		if err == nil {
+			byt, err = ioutil.ReadFile(scriptFile)
+		}
+		if err != nil {
+			log.Fatalf("Error reading script %q: %s", scriptFile, err)
+		}
+		JQString = string(byt)
+	} else if fromFile != "" {
+		var err error
+		if JQString, err = readFromFile(); err != nil {
+			log.Fatalf("Error reading jq program %q: %s", fromFile, err)
+		}
+	} else if noJQ {
+		JQString = "."
+	} else {
+		JQString = Args[0]
+		Args = Args[1:]
+	}
 	cacheFiles = make([]string, len(Args))
 	urls = make([](*url.URL), len(Args))
 
 	for i, Arg := range Args {
-		u, err := url.Parse(Arg)
+		Args[i] = presetURL(fixIPv6Zone(Arg))
+		if err := validateRequest(method, Headers, Args[i:i+1]); err != nil {
+			log.Fatalf("Refusing request: %s", err)
+		}
+		u, err := url.Parse(Args[i])
 		if err != nil {
-			fmt.Println("Malformed URL:", err)
+			fmt.Fprintln(os.Stderr, "Malformed URL:", err)
 			os.Exit(1)
 		}
+		if err = idnURL(u); err != nil {
+			log.Fatalf("Bad host name: %s", err)
+		}
+		Args[i] = u.String()
+		if isOnion(u) && !useTor {
+			log.Fatalf("Onion URL %q needs --tor", Args[i])
+		}
 		urls[i] = u
 	}
+	scopePresetTokens(urls)
 
-	for i, Arg := range Args {
-		h := sha1.New()
-		h.Write([]byte(Arg))
-		h.Write([]byte(fmt.Sprintf("%d", os.Getuid())))
-		bs := h.Sum(nil)
+	if jsonLines || pageStream || arrayStream || sseMode {
+		// a stream is queried as it arrives, so never cached
+		useCache = false
+	}
+	checkRawBody()
+	checkMapExec()
+	checkVerify()
+	checkFixture()
+
+	if frozen {
+		if freezeFile == "" {
+			log.Fatalf("--frozen needs the lock file given with --freeze")
+		}
+		// replay only what was recorded, never the cache or the network
+		useCache = false
+		loadFreeze()
+		if scriptFile == "" && !fetchAllURLs {
+			dat = frozenData()
+		}
+	}
 
-		cacheFile := fmt.Sprintf("%s/jqurl_%x", cacheDir, bs)
+	for i, Arg := range Args {
+		cacheFile := cacheFileName(Arg)
 		cacheFiles[i] = cacheFile
 
 		stat, err := os.Stat(cacheFile)
-		if err == nil && !flush && useCache && time.Now().Add(maxAge).After(stat.ModTime()) {
+		if err == nil && !flush && useCache && refreshTimeout > 0 && staleDat == nil &&
+			since(stat.ModTime()) >= maxAge {
+			if debug {
+				log.Println("found stale cache", cacheFile)
+			}
+			if byt, err := ioutil.ReadFile(cacheFile); err == nil && unmarshalBody(byt, &staleDat) == nil {
+				staleDat = cacheEnvelope(cacheFile, Arg, staleDat)
+			}
+		}
+		if err == nil && !flush && useCache && since(stat.ModTime()) < maxAge {
 			if debug {
 				log.Println("found cache", cacheFile)
 			}
@@ -167,140 +586,392 @@ func main() {
 				if includeHeader {
 					fmt.Fprintf(os.Stderr, "Header skipped as cache used\nURL: %s\nFile: %s\n", urls[i], cacheFile)
 				}
-				json.Unmarshal(byt, &dat)
+				unmarshalBody(byt, &dat)
+				dat = cacheEnvelope(cacheFile, Arg, dat)
+				cacheHitMetrics(Arg, cacheFile)
+				saveResponseBody(nil, byt)
 				break
 			}
 		}
 	}
 
 	if docker != "" {
-		// Lock the OS Thread so we don't accidentally switch namespaces
-		runtime.LockOSThread()
-		defer runtime.UnlockOSThread()
-
-		// Save the current network namespace
-		origns, _ := netns.Get()
-		defer origns.Close()
-
-		nsh, err := netns.GetFromDocker(docker)
+		restore, err := enterDockerNetns(docker)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error switching to container network space %q, err: %s", docker, err)
+			fmt.Fprintf(os.Stderr, "Error switching to container network space %q, err: %s\n", docker, err)
 			os.Exit(1)
 		}
-		defer nsh.Close()
-		netns.Set(nsh)
+		defer restore()
+	} else if k8sPod != "" {
+		restore, err := enterPodNetns(k8sPod)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error switching to pod network space %q, err: %s\n", k8sPod, err)
+			os.Exit(1)
+		}
+		defer restore()
+	} else if netnsName != "" {
+		restore, err := enterNamedNetns(netnsName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error switching to network namespace %q, err: %s\n", netnsName, err)
+			os.Exit(1)
+		}
+		defer restore()
 	}
 
 	doCurl()
 }
 
-func doCurl() {
-	http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{
+// defaultCacheDir picks the per user local app data folder on Windows and
+// the temp directory elsewhere
+func defaultCacheDir() string {
+	if dir := os.Getenv("LOCALAPPDATA"); runtime.GOOS == "windows" && dir != "" {
+		return filepath.Join(dir, "jqurl")
+	}
+	return os.TempDir()
+}
+
+// cacheFileName returns the cache file used for a URL
+func cacheFileName(arg string) string {
+	h := sha1.New()
+	h.Write([]byte(normalizeURL(arg)))
+	h.Write([]byte(cacheNamespace))
+	if unixSocket != "" {
+		// the same URL on another socket is another resource
+		h.Write([]byte(unixSocket))
+	}
+	bs := h.Sum(nil)
+	return filepath.Join(cacheDir, fmt.Sprintf("jqurl_%s_%x", cacheNamespace, bs))
+}
+
+func newClient() *http.Client {
+	tlsConfig := &tls.Config{
 		InsecureSkipVerify: certIgnore,
 		RootCAs:            caCertPool,
 		Certificates:       []tls.Certificate{keypair},
 		Renegotiation:      tls.RenegotiateOnceAsClient,
+		KeyLogWriter:       keyLogWriter,
+	}
+	if err := applyTLSPolicy(tlsConfig); err != nil {
+		log.Fatal(err)
 	}
-	//http.DefaultTransport.IdleConnTimeout = 10 * time.Second
-	client := &http.Client{
-		Transport: http.DefaultTransport,
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			if followRedirects == false {
-				return http.ErrUseLastResponse
+	if useSpiffe {
+		spiffeTLS(tlsConfig)
+	}
+	if err := applyTLSOptions(tlsConfig); err != nil {
+		log.Fatal(err)
+	}
+	// a copy, so the settings stay with this client rather than every user of
+	// http.DefaultTransport
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	transport.ExpectContinueTimeout = expect100Timeout
+	for _, b := range []struct {
+		size string
+		set  *int
+	}{
+		{readBuffer, &transport.ReadBufferSize},
+		{writeBuffer, &transport.WriteBufferSize},
+	} {
+		if b.size != "" {
+			n, err := parseSize(b.size)
+			if err != nil {
+				log.Fatalf("Bad buffer size: %s", err)
 			}
-			return nil
-		},
+			*b.set = int(n)
+		}
+	}
+	proxy, err := proxyFunc()
+	if err != nil {
+		log.Fatal(err)
+	}
+	transport.Proxy = proxy
+	if useTor {
+		torTransport(transport)
+	}
+	if sshJump != "" {
+		transport.DialContext = sshDial
+		transport.Proxy = nil
+	}
+	if unixSocket != "" {
+		transport.DialContext = socketDial
+		transport.Proxy = nil
+	}
+	withDNS(transport)
+	if err := applyProtocols(transport); err != nil {
+		log.Fatal(err)
+	}
+	if prewarmConns && fixtureFile == "" {
+		warmConnections(transport, Args)
+	}
+	//transport.IdleConnTimeout = 10 * time.Second
+	return &http.Client{
+		Transport:     withDownloadLimits(withDecoding(withUserAgent(withHeaderRules(withNetrc(rateLimited(withAudit(withFixture(transport)))))))),
+		Jar:           cookieJar,
+		CheckRedirect: jqurl.RedirectPolicy{Follow: followRedirects || locationTrusted, Trusted: locationTrusted, AutoReferer: autoReferer, Jar: cookieJar}.CheckRedirect,
+	}
+}
+
+func doCurl() {
+	client := newClient()
+	httpClient = client
+	defer closeBodies()
+
+	if scriptFile != "" {
+		// the script makes its own requests with fetch
+		runQuery(nil)
+		return
+	}
+
+	if imdsPreset {
+		imdsToken(client)
+	}
+
+	if serveAddr != "" {
+		serveQuery(client)
+		return
+	}
+	if watchInterval > 0 {
+		watchQuery(client)
+		return
+	}
+	if rawBody {
+		writeRawBody(client)
+		return
+	}
+	if jsonLines {
+		streamJSONL(client)
+		return
 	}
+	if sseMode {
+		streamSSE(client)
+		return
+	}
+	if arrayStream {
+		streamArray(client)
+		return
+	}
+	if pageStream {
+		streamPages(client)
+		return
+	}
+	if fetchAllURLs {
+		runQuery(fetchAll(client))
+		return
+	}
+
+	if staleDat != nil && dat == nil {
+		dat = refreshOrStale(client)
+	} else {
+		fetchURLs(client)
+	}
+	if refreshChild {
+		return
+	}
+	if len(thenURLs) > 0 {
+		runChain(client, dat)
+		return
+	}
+	runQuery(dat)
+}
+
+// fetchURLs tries the URLs in turn until one returns JSON, filling in dat
+func fetchURLs(client *http.Client) {
+	fetchURLsContext(context.Background(), client)
+}
 
-	for j := 0; j < maxTries && len(dat) == 0; j++ {
-		i := j % len(Args)
+// fetchURLsContext is fetchURLs, giving up quietly once ctx is done
+func fetchURLsContext(ctx context.Context, client *http.Client) {
+	if dat != nil {
+		return
+	}
+	opts := fetchOptions(client)
+	opts.Context = ctx
+	verifyOptions(&opts)
+	if len(cacheFiles) == 1 {
+		conditionalFetch(&opts, cacheFiles[0])
+	}
+	res, err := fetchDo(opts)
+	if ctx.Err() != nil {
+		return
+	}
+	failExit(err)
+	if errors.Is(err, jqurl.ErrNotIdempotent) {
+		fmt.Fprintf(os.Stderr, "Error fetching: %s\nAdd --retry-non-idempotent or an Idempotency-Key header to retry %s requests\n", err, method)
+	}
+	if err != nil {
 		if debug {
-			log.Println("HTTP", method, urls[i])
+			log.Printf("Giving up after %d tries: %s", maxTries, err)
 		}
-		var err error
-		var resp *http.Response
-		var req *http.Request
-
-		var rdr io.Reader
-		if method == "POST" {
-			if len(postData) > 0 && postData[0] == '@' {
-				f, err := os.Open(postData[1:])
-				if err != nil {
-					log.Fatalf("Unable to open %q, err: %s", postData[1:], err)
-				}
-				defer f.Close()
-				rdr = f
-			} else {
-				rdr = strings.NewReader(postData)
-			}
+		return
+	}
+	dat = keepResult(client, res, cacheFiles[res.Index])
+}
+
+// keepResult parses a fetched body and follows any further pages, recording
+// the outcome in the lock file and cache
+func keepResult(client *http.Client, res *jqurl.Result, cacheFile string) interface{} {
+	var v interface{}
+	byt := res.Body
+	keepTrailers(res.Response)
+	saveResponseBody(res.Response, byt)
+	err := unmarshalBody(byt, &v)
+	if err != nil {
+		log.Fatalf("Cannot unmarshall url %q err: %s", res.URL, err)
+	}
+	if followPages {
+		if v, err = getPages(client, res.Response, v); err != nil {
+			log.Fatalf("Error following pages: %s", err)
 		}
+		byt, _ = json.Marshal(v)
+	}
+	recordFreeze(method, res.URL, res.Response, byt)
+	recordCAS(method, res.URL, res.Response, byt)
+	if !useCache {
+		return respEnvelope(res.URL, res.Response, "", v)
+	}
+	if debug {
+		log.Println("writing out file")
+	}
+	os.MkdirAll(filepath.Dir(cacheFile), 0755)
+	err = writeAtomic(cacheFile, byt, 0644)
+	if err != nil && debug {
+		log.Fatalf("Error writing file: %s", err)
+	}
+	v = respEnvelope(res.URL, res.Response, cacheFile, v)
+	writeCacheMeta(cacheFile, res.URL, res.Response)
+	return v
+}
+
+// fetchOptions sets up a fetch of the URL arguments from the flags
+func fetchOptions(client *http.Client) jqurl.Options {
+	opts := jqurl.Options{
+		URLs:     Args,
+		Method:   method,
+		Headers:  make(map[string]string),
+		Client:   client,
+		Timeout:  timeout,
+		MaxTries: maxTries,
+		Delay:    delay,
 
-		ctx, cancel := context.WithTimeout(context.Background(), timeout)
-		defer cancel()
+		Backoff:  retryBackoff,
+		MaxDelay: retryMaxDelay,
+		RetryOn: func(resp *http.Response, err error) bool {
+			if errors.Is(err, errEncoding) || errors.Is(err, errBodyTooLarge) || errors.Is(err, errVerify) ||
+				errors.Is(err, errOffline) {
+				return false
+			}
+			return retryCheck == nil || retryCheck(resp, err)
+		},
 
-		req, err = http.NewRequestWithContext(ctx, method, urls[i].String(), rdr)
+		RetryPolicy:        retryPolicy,
+		RetryNonIdempotent: retryNonIdempotent,
+		Fail:               failHTTP,
+		OnRetry: func(try int, target string, err error, wait time.Duration) {
+			retryWait(try, target, err, wait)
+		},
+		Clock: clock,
+	}
+	if formBody != nil {
+		opts.Body = formBody
+		opts.Headers["content-type"] = formType
+		uploadOptions(&opts)
+	} else if method == "POST" || postData != "" {
+		body, err := postBody(postData)
 		if err != nil {
-			log.Fatalf("New request error: %s", err)
+			log.Fatalf("Unable to read request body %q, err: %s", postData, err)
 		}
-		if method == "POST" {
-			req.Header.Set("Content-Type", "x-www-form-urlencoded")
+		opts.Body = body
+		opts.Headers["content-type"] = bodyContentType()
+		uploadOptions(&opts)
+	}
+	headersMu.Lock()
+	for key, val := range Headers {
+		if debug {
+			log.Printf("Request Header: %s: %s\n", key, redactHeader(key, val))
 		}
-		for key, val := range Headers {
-			if debug {
-				fmt.Printf("Request Header: %s: %s\n", key, val)
-			}
-			req.Header.Set(key, val)
+		opts.Headers[key] = val
+	}
+	headersMu.Unlock()
+	opts.Filter = decodeInput
+	if saveBody != "" {
+		opts.Filter = rawBodyFilter(decodeInput)
+	}
+	opts.OnInformational = informational
+	if debug {
+		opts.Logf = log.Printf
+	}
+	opts.OnResponse = func(resp *http.Response) bool {
+		if debug {
+			log.Printf("Response: %s %s", resp.Proto, resp.Status)
 		}
-		resp, err = client.Do(req)
-		if debug && err != nil {
-			fmt.Printf("Error doing http request: %s\n", err)
+		if includeHeader {
+			printHeaders(resp.Proto+" "+resp.Status, resp.Header)
 		}
-
-		if err == nil {
-			if includeHeader {
-				fmt.Fprintf(os.Stderr, "%s %s\n", resp.Proto, resp.Status)
-				for key, vals := range resp.Header {
-					for _, val := range vals {
-						fmt.Fprintf(os.Stderr, "%s: %s\n", key, val)
-					}
-				}
-				fmt.Fprintf(os.Stderr, "\n")
+		if ociMode && resp.StatusCode == http.StatusUnauthorized {
+			headersMu.Lock()
+			defer headersMu.Unlock()
+			if val, ok := Headers["authorization"]; ok && opts.Headers["authorization"] != val {
+				// another fetch has got a token meanwhile
+				opts.Headers["authorization"] = val
+				return true
 			}
-
-			byt, err := ioutil.ReadAll(resp.Body)
-			resp.Body.Close()
-
-			if err == nil {
-				err = json.Unmarshal(byt, &dat)
-				if err != nil && debug {
-					log.Fatalf("Cannot unmarshall url %q err: %s", urls[i], err)
-				}
-				if err == nil {
-					if !useCache {
-						break
-					}
-					if debug {
-						log.Println("writing out file")
-					}
-					err = ioutil.WriteFile(cacheFiles[i], byt, 0666)
-					if err != nil && debug {
-						log.Fatalf("Error writing file: %s", err)
-					}
-					break
-				}
+			if ociAuthed {
+				return false
 			}
+			if err := ociAuthorize(client, resp); err != nil {
+				fmt.Fprintf(os.Stderr, "Error getting registry token: %s\n", err)
+				return false
+			}
+			// retry right away with the new token
+			opts.Headers["authorization"] = Headers["authorization"]
+			return true
 		}
+		return false
+	}
+	return opts
+}
 
-		if i%len(Args) == len(Args)-1 {
-			time.Sleep(delay)
+// writeResult prints one query result, as JSON unless raw output is wanted
+func writeResult(output io.Writer, v interface{}) {
+	if s, ok := v.(string); ok && raw && outputFormat == "yaml" {
+		fmt.Fprintf(output, "%s\n", s)
+	} else if outputFormat == "yaml" {
+		if yamlStarted[output] {
+			fmt.Fprintf(output, "---\n")
+		}
+		yamlStarted[output] = true
+		output.Write(yamlMarshal(v))
+	} else if raw {
+		fmt.Fprintf(output, "%v\n", v)
+	} else {
+		var jsonOutput []byte
+		if pretty {
+			jsonOutput, _ = json.MarshalIndent(v, "", "  ")
+		} else {
+			jsonOutput, _ = json.Marshal(v)
 		}
+		fmt.Fprintf(output, "%s\n", string(jsonOutput))
 	}
+}
 
-	query, err := gojq.Parse(JQString)
-	if err != nil {
-		log.Fatalf("Error compiling jq query %q: %s", JQString, err)
+// runQuery runs the jq query over the input and writes out the results
+func runQuery(input interface{}) {
+	for _, in := range inputDocs(input) {
+		queryInput(graphqlData(in))
 	}
-	iter := query.Run(dat) // or query.RunWithContext
+	finishQuery()
+}
+
+// queryInput runs the jq query over one input, the query is compiled on
+// first use
+func queryInput(input interface{}) {
+	if queryCode == nil {
+		var err error
+		if queryCode, err = compileJQ(JQString); err != nil {
+			log.Fatalf("Error %s", err)
+		}
+	}
+	iter := runJQ(queryCode, input)
 	for {
 		v, ok := iter.Next()
 		if !ok {
@@ -310,29 +981,59 @@ func doCurl() {
 			log.Fatalf("Error running jq query %q: %s", JQString, err)
 		}
 		if debug {
-			fmt.Printf("%#v\n", v)
+			log.Printf("Result: %#v", v)
+		}
+		if reduceExpr != "" {
+			reduceResult(v)
+			continue
 		}
+		emitResult(v)
+	}
+}
 
-		output := os.Stdout
-		if outputFile != "" {
-			f, err := os.Create(outputFile)
+// emitResult hands a result to --map-exec or --split-by, or writes it out
+func emitResult(v interface{}) {
+	noteResult(v)
+	if mapExec != "" {
+		runMapExec(v)
+		return
+	}
+	if splitBy != "" {
+		writeSplit(v)
+		return
+	}
+
+	if output == nil {
+		output = dataOut
+		if name := outputPath(); name != "" {
+			f, err := createOutput(name)
 			if err != nil {
 				log.Fatalf("Error creating output file: %s", err)
 			}
-			defer f.Close()
 			output = f
 		}
+	}
+	writeResult(output, v)
+}
 
-		if raw {
-			fmt.Fprintf(output, "%v\n", v)
-		} else {
-			var jsonOutput []byte
-			if pretty {
-				jsonOutput, _ = json.MarshalIndent(v, "", "  ")
-			} else {
-				jsonOutput, _ = json.Marshal(v)
-			}
-			fmt.Fprintf(output, "%s\n", string(jsonOutput))
+// finishQuery closes the outputs once every input has been queried
+func finishQuery() {
+	flushReduce()
+	if f, ok := output.(*os.File); ok && f != dataOut {
+		if err := f.Close(); err != nil {
+			log.Fatalf("Error writing output file: %s", err)
 		}
 	}
+	closeSplits()
+	closeSaveBody()
+	writeFreeze()
+	saveCookies()
+
+	if err := saveState(); err != nil {
+		log.Fatalf("Error writing state file %q: %s", stateFile, err)
+	}
+	if mapExecFails > 0 || graphqlFailed {
+		os.Exit(1)
+	}
+	exitForResult()
 }
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+var (
+	mapExec      string
+	mapExecShell bool
+	mapExecFails int
+
+	// mapExecArgs is the --map-exec command split into its arguments
+	mapExecArgs []string
+)
+
+// checkMapExec splits up the --map-exec command, refusing a blank one
+func checkMapExec() {
+	if mapExec == "" {
+		return
+	}
+	if strings.TrimSpace(mapExec) == "" {
+		log.Fatal("--map-exec needs a command")
+	}
+	if mapExecShell {
+		return
+	}
+	var err error
+	if mapExecArgs, err = splitCommand(mapExec); err != nil {
+		log.Fatalf("Bad --map-exec command: %s", err)
+	}
+}
+
+// splitCommand splits a command line into arguments at spaces, keeping
+// those in '...' or "..." quotes or after a backslash.  Nothing else of the
+// shell, variables and globs included, is taken from it.
+func splitCommand(s string) ([]string, error) {
+	var args []string
+	var arg strings.Builder
+	inArg := false
+	var quote rune
+	escaped := false
+	for _, r := range s {
+		switch {
+		case escaped:
+			arg.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped, inArg = true, true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				arg.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote, inArg = r, true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, fmt.Errorf("unterminated quote or escape in %q", s)
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("no command in %q", s)
+	}
+	return args, nil
+}
+
+// resultString renders a jq result for a command, strings are passed as is
+// and anything else as compact JSON
+func resultString(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	byt, _ := json.Marshal(v)
+	return string(byt)
+}
+
+// runMapExec runs the --map-exec command for one result.  By default the
+// command is split on spaces, quotes keeping an argument together, and every
+// "{}" in an argument is replaced by the value, so no shell ever parses it.  With --map-exec-shell the command runs
+// under "sh -c" with the value in $1 and $JQURL_VALUE, never spliced into
+// the script text.
+func runMapExec(v interface{}) {
+	val := resultString(v)
+	var cmd *exec.Cmd
+	if mapExecShell {
+		cmd = exec.Command("sh", "-c", mapExec, "jqurl", val)
+	} else {
+		args := make([]string, len(mapExecArgs))
+		for i, arg := range mapExecArgs {
+			args[i] = strings.ReplaceAll(arg, "{}", val)
+		}
+		cmd = exec.Command(args[0], args[1:]...)
+	}
+	cmd.Env = append(os.Environ(), "JQURL_VALUE="+val)
+	cmd.Stdout, cmd.Stderr = dataOut, os.Stderr
+	if err := cmd.Run(); err != nil {
+		fmt.Fprintf(os.Stderr, "Command for %s failed: %s\n", val, err)
+		mapExecFails++
+	}
+}
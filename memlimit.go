@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	rtdebug "runtime/debug"
+	"runtime/metrics"
+	"time"
+)
+
+var maxMemory string
+
+// watchMemory aborts the run once the Go runtime holds more than
+// --max-memory, so a query over an unexpectedly huge response cannot take a
+// shared host down with it.  The garbage collector is also told of the
+// limit, so it works harder before the limit is reached.
+func watchMemory() {
+	if maxMemory == "" {
+		return
+	}
+	limit, err := parseSize(maxMemory)
+	if err != nil || limit <= 0 {
+		log.Fatalf("Bad --max-memory %q", maxMemory)
+	}
+	rtdebug.SetMemoryLimit(limit)
+	samples := []metrics.Sample{
+		{Name: "/memory/classes/total:bytes"},
+		{Name: "/memory/classes/heap/released:bytes"},
+	}
+	go func() {
+		for range time.Tick(50 * time.Millisecond) {
+			metrics.Read(samples)
+			used := int64(samples[0].Value.Uint64() - samples[1].Value.Uint64())
+			if used > limit {
+				fmt.Fprintf(os.Stderr, "Aborting, memory use of %s is over --max-memory %s\n", humanSize(used), humanSize(limit))
+				os.Exit(3)
+			}
+		}
+	}()
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+var withMetadata bool
+
+// headerObject flattens a header into an object with lower case keys,
+// repeated headers joined by commas
+func headerObject(h http.Header) map[string]string {
+	out := make(map[string]string, len(h))
+	for key, vals := range h {
+		out[strings.ToLower(key)] = strings.Join(vals, ", ")
+	}
+	return out
+}
+
+// envelope wraps a body for --with-metadata, so the query can look at the
+// status and headers it came with as .status, .headers, .url and .body
+func envelope(target string, status int, header map[string]string, body interface{}) interface{} {
+	headers := make(map[string]interface{}, len(header))
+	for key, val := range header {
+		headers[key] = val
+	}
+	return map[string]interface{}{
+		"url":     target,
+		"status":  status,
+		"headers": headers,
+		"body":    body,
+	}
+}
+
+// respEnvelope wraps a fetched body with its response.  A 304 which reused
+// the cache reports the response the cache entry was filled from.
+func respEnvelope(target string, resp *http.Response, cacheFile string, body interface{}) interface{} {
+	if !withMetadata {
+		return body
+	}
+	if resp == nil {
+		return envelope(target, http.StatusOK, nil, body)
+	}
+	if resp.StatusCode == http.StatusNotModified && cacheFile != "" {
+		if meta, err := readCacheMeta(cacheFile); err == nil && meta.Status != 0 {
+			return envelope(target, meta.Status, meta.Header, body)
+		}
+	}
+	if resp.Request != nil {
+		// where the redirects ended up
+		target = resp.Request.URL.String()
+	}
+	return envelope(target, resp.StatusCode, headerObject(resp.Header), body)
+}
+
+// cacheEnvelope wraps a body read from the cache with the response recorded
+// in its metadata
+func cacheEnvelope(cacheFile, target string, body interface{}) interface{} {
+	if !withMetadata {
+		return body
+	}
+	meta, err := readCacheMeta(cacheFile)
+	if err != nil || meta.Status == 0 {
+		return envelope(target, http.StatusOK, nil, body)
+	}
+	return envelope(meta.Final, meta.Status, meta.Header, body)
+}
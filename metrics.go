@@ -0,0 +1,282 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pschou/jqURL/pkg/jqurl"
+)
+
+var (
+	metricsJSON string
+
+	metricsMu  sync.Mutex
+	metricsOut io.Writer
+)
+
+// fetchMetrics is the line written to --metrics-json for each URL fetched or
+// taken from the cache.  The timings, in milliseconds, are of the last try;
+// DNS, connect and TLS are left out when it reused a connection.
+type fetchMetrics struct {
+	URL      string   `json:"url"`
+	Method   string   `json:"method,omitempty"`
+	Status   int      `json:"status,omitempty"`
+	Protocol string   `json:"protocol,omitempty"`
+	Error    string   `json:"error,omitempty"`
+	Cache    string   `json:"cache,omitempty"`
+	Tries    int      `json:"tries"`
+	Retries  int      `json:"retries"`
+	Reused   bool     `json:"reused_connection,omitempty"`
+	DNS      *float64 `json:"dns_ms,omitempty"`
+	Connect  *float64 `json:"connect_ms,omitempty"`
+	TLS      *float64 `json:"tls_ms,omitempty"`
+	TTFB     *float64 `json:"ttfb_ms,omitempty"`
+	Total    float64  `json:"total_ms"`
+	Sent     int64    `json:"bytes_sent"`
+	Received int64    `json:"bytes_received"`
+}
+
+// openMetrics opens the --metrics-json file for appending, "-" is stderr as
+// stdout has the query results
+func openMetrics() error {
+	switch metricsJSON {
+	case "":
+		return nil
+	case "-":
+		metricsOut = os.Stderr
+		return nil
+	}
+	if err := checkWrite(metricsJSON); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(metricsJSON, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	metricsOut = f
+	return nil
+}
+
+// writeMetrics writes one line of metrics
+func writeMetrics(m fetchMetrics) {
+	if metricsOut == nil {
+		return
+	}
+	byt, err := json.Marshal(m)
+	if err != nil {
+		return
+	}
+	metricsMu.Lock()
+	metricsOut.Write(append(byt, '\n'))
+	metricsMu.Unlock()
+}
+
+// cacheHitMetrics records a URL answered from the cache without a request
+func cacheHitMetrics(target, cacheFile string) {
+	if metricsOut == nil {
+		return
+	}
+	m := fetchMetrics{URL: target, Cache: "hit"}
+	if stat, err := os.Stat(cacheFile); err == nil {
+		m.Received = stat.Size()
+	}
+	writeMetrics(m)
+}
+
+// fetchDo is jqurl.Do, checking the reply against the assertions and
+// writing the metrics of the fetch when asked to
+func fetchDo(opts jqurl.Options) (*jqurl.Result, error) {
+	last := withAssertions(&opts)
+	start := time.Now()
+	if metricsOut == nil {
+		res, err := jqurl.Do(opts)
+		tooLargeExit(err)
+		verifyExit(err)
+		checkAssertions(last)
+		checkMaxTime(res, time.Since(start))
+		return res, err
+	}
+	rec := &tryTimes{}
+	client := *opts.Client
+	client.Transport = metricsTransport{next: opts.Client.Transport, rec: rec}
+	opts.Client = &client
+	retries := 0
+	onRetry := opts.OnRetry
+	opts.OnRetry = func(try int, target string, err error, wait time.Duration) {
+		retries++
+		if onRetry != nil {
+			onRetry(try, target, err, wait)
+		} else {
+			clock.Sleep(wait)
+		}
+	}
+
+	res, err := jqurl.Do(opts)
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	m := fetchMetrics{
+		URL:      opts.URLs[0],
+		Method:   opts.Method,
+		Tries:    rec.tries,
+		Retries:  retries,
+		Reused:   rec.reused,
+		Sent:     rec.sent,
+		Received: rec.received,
+	}
+	if !rec.start.IsZero() {
+		end := rec.end
+		if end.IsZero() {
+			end = time.Now()
+		}
+		m.Total = msSince(rec.start, end)
+	}
+	if !rec.reused {
+		m.DNS = msBetween(rec.dnsStart, rec.dnsDone)
+		m.Connect = msBetween(rec.connStart, rec.connDone)
+		m.TLS = msBetween(rec.tlsStart, rec.tlsDone)
+	}
+	m.TTFB = msBetween(rec.start, rec.firstByte)
+	if err != nil {
+		m.Error = err.Error()
+	} else {
+		m.URL = res.URL
+		m.Status = res.Response.StatusCode
+		m.Protocol = rec.proto
+	}
+	if useCache {
+		m.Cache = "miss"
+		if err == nil && m.Status == http.StatusNotModified {
+			m.Cache = "revalidated"
+		}
+	}
+	writeMetrics(m)
+	tooLargeExit(err)
+	verifyExit(err)
+	checkAssertions(last)
+	checkMaxTime(res, time.Since(start))
+	return res, err
+}
+
+// tryTimes are the httptrace times of the latest try of a fetch, redirects
+// being counted as part of it
+type tryTimes struct {
+	mu    sync.Mutex
+	tries int
+	tryAttempt
+}
+
+type tryAttempt struct {
+	start, end          time.Time
+	dnsStart, dnsDone   time.Time
+	connStart, connDone time.Time
+	tlsStart, tlsDone   time.Time
+	firstByte           time.Time
+	reused              bool
+	proto               string
+	sent, received      int64
+}
+
+// metricsTransport traces each request of a fetch into its tryTimes
+type metricsTransport struct {
+	next http.RoundTripper
+	rec  *tryTimes
+}
+
+func (t metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rec := t.rec
+	now := time.Now()
+	rec.mu.Lock()
+	if req.Response == nil {
+		// a new try rather than a redirect within one
+		rec.tries++
+		rec.tryAttempt = tryAttempt{start: now}
+	} else {
+		rec.firstByte, rec.end = time.Time{}, time.Time{}
+	}
+	if req.ContentLength > 0 {
+		rec.sent += req.ContentLength
+	}
+	rec.mu.Unlock()
+
+	set := func(at *time.Time) {
+		rec.mu.Lock()
+		if at.IsZero() {
+			*at = time.Now()
+		}
+		rec.mu.Unlock()
+	}
+	trace := &httptrace.ClientTrace{
+		DNSStart:             func(httptrace.DNSStartInfo) { set(&rec.dnsStart) },
+		DNSDone:              func(httptrace.DNSDoneInfo) { set(&rec.dnsDone) },
+		ConnectStart:         func(string, string) { set(&rec.connStart) },
+		ConnectDone:          func(string, string, error) { set(&rec.connDone) },
+		TLSHandshakeStart:    func() { set(&rec.tlsStart) },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { set(&rec.tlsDone) },
+		GotFirstResponseByte: func() { set(&rec.firstByte) },
+		GotConn: func(info httptrace.GotConnInfo) {
+			rec.mu.Lock()
+			rec.reused = info.Reused
+			rec.mu.Unlock()
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		rec.mu.Lock()
+		rec.end = time.Now()
+		rec.mu.Unlock()
+		return resp, err
+	}
+	rec.mu.Lock()
+	rec.proto = resp.Proto
+	rec.mu.Unlock()
+	resp.Body = &countingBody{ReadCloser: resp.Body, rec: rec}
+	return resp, nil
+}
+
+// countingBody adds up the body bytes read and notes when the body ends
+type countingBody struct {
+	io.ReadCloser
+	rec *tryTimes
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.rec.mu.Lock()
+	b.rec.received += int64(n)
+	if err != nil {
+		b.rec.end = time.Now()
+	}
+	b.rec.mu.Unlock()
+	return n, err
+}
+
+func (b *countingBody) Close() error {
+	b.rec.mu.Lock()
+	if b.rec.end.IsZero() {
+		b.rec.end = time.Now()
+	}
+	b.rec.mu.Unlock()
+	return b.ReadCloser.Close()
+}
+
+// msBetween is the time from a to b in milliseconds, nil when either is
+// missing
+func msBetween(a, b time.Time) *float64 {
+	if a.IsZero() || b.IsZero() {
+		return nil
+	}
+	ms := msSince(a, b)
+	return &ms
+}
+
+func msSince(a, b time.Time) float64 {
+	return float64(b.Sub(a).Microseconds()) / 1000
+}
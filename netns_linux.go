@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/vishvananda/netns"
+)
+
+// enterDockerNetns switches the calling thread into the network namespace of
+// a container, the returned function switches back.  A container ID no
+// runtime knows of is looked for in the Docker cgroups.
+func enterDockerNetns(container string) (func(), error) {
+	return enterNetns(func() (netns.NsHandle, error) {
+		pid, err := containerPid(container)
+		if err != nil {
+			if nsh, idErr := netns.GetFromDocker(container); idErr == nil {
+				return nsh, nil
+			}
+			return netns.None(), err
+		}
+		return netns.GetFromPid(pid)
+	})
+}
+
+// enterNamedNetns switches into a namespace made by `ip netns add`, or one
+// given by its path such as /proc/PID/ns/net
+func enterNamedNetns(name string) (func(), error) {
+	return enterNetns(func() (netns.NsHandle, error) {
+		if strings.ContainsRune(name, '/') {
+			return netns.GetFromPath(name)
+		}
+		return netns.GetFromName(name)
+	})
+}
+
+// enterPodNetns switches into the network namespace of a Kubernetes pod
+// running on this node, given as NAMESPACE/POD
+func enterPodNetns(pod string) (func(), error) {
+	path, err := podNetnsPath(pod)
+	if err != nil {
+		return nil, err
+	}
+	return enterNetns(func() (netns.NsHandle, error) {
+		return netns.GetFromPath(path)
+	})
+}
+
+func enterNetns(get func() (netns.NsHandle, error)) (func(), error) {
+	// Lock the OS Thread so we don't accidentally switch namespaces
+	runtime.LockOSThread()
+
+	// Save the current network namespace
+	origns, err := netns.Get()
+	if err != nil {
+		runtime.UnlockOSThread()
+		return nil, err
+	}
+
+	nsh, err := get()
+	if err == nil {
+		err = netns.Set(nsh)
+		nsh.Close()
+	}
+	if err != nil {
+		origns.Close()
+		runtime.UnlockOSThread()
+		return nil, err
+	}
+	return func() {
+		netns.Set(origns)
+		origns.Close()
+		runtime.UnlockOSThread()
+	}, nil
+}
+
+// podNetnsPath finds the network namespace of a pod, asking the container
+// runtime over CRI with crictl when it is installed, and otherwise from the
+// pod log directories the kubelet keeps and the cgroups of the processes
+// running in the pod
+func podNetnsPath(pod string) (string, error) {
+	parts := strings.SplitN(pod, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", fmt.Errorf("give the pod as NAMESPACE/POD")
+	}
+	if _, err := exec.LookPath("crictl"); err == nil {
+		return crictlNetns(parts[0], parts[1])
+	}
+	return kubeletNetns(parts[0], parts[1])
+}
+
+// crictlNetns looks up a ready pod sandbox and the namespace it runs in
+func crictlNetns(namespace, name string) (string, error) {
+	out, err := crictl("pods", "--namespace", namespace, "--name", "^"+name+"$", "--state", "ready", "-q")
+	if err != nil {
+		return "", err
+	}
+	ids := strings.Fields(string(out))
+	if len(ids) == 0 {
+		return "", fmt.Errorf("no ready pod %s/%s on this node", namespace, name)
+	}
+	if out, err = crictl("inspectp", ids[0]); err != nil {
+		return "", err
+	}
+	var sandbox struct {
+		Info struct {
+			Pid         int `json:"pid"`
+			RuntimeSpec struct {
+				Linux struct {
+					Namespaces []struct {
+						Type string `json:"type"`
+						Path string `json:"path"`
+					} `json:"namespaces"`
+				} `json:"linux"`
+			} `json:"runtimeSpec"`
+		} `json:"info"`
+	}
+	if err = json.Unmarshal(out, &sandbox); err != nil {
+		return "", fmt.Errorf("crictl inspectp: %s", err)
+	}
+	for _, ns := range sandbox.Info.RuntimeSpec.Linux.Namespaces {
+		if ns.Type == "network" && ns.Path != "" {
+			return ns.Path, nil
+		}
+	}
+	if sandbox.Info.Pid > 0 {
+		return fmt.Sprintf("/proc/%d/ns/net", sandbox.Info.Pid), nil
+	}
+	return "", fmt.Errorf("pod %s/%s has no network namespace, is it on the host network?", namespace, name)
+}
+
+func crictl(args ...string) ([]byte, error) {
+	cmd := exec.Command("crictl", args...)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("crictl %s: %s", args[0], err)
+	}
+	return out, nil
+}
+
+// kubeletNetns finds the UID of a pod from /var/log/pods/NAMESPACE_POD_UID,
+// then a process whose cgroup carries that UID
+func kubeletNetns(namespace, name string) (string, error) {
+	dirs, _ := filepath.Glob(filepath.Join("/var/log/pods", namespace+"_"+name+"_*"))
+	if len(dirs) == 0 {
+		return "", fmt.Errorf("no pod %s/%s on this node, and crictl is not installed", namespace, name)
+	}
+	procs, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return "", err
+	}
+	for _, dir := range dirs {
+		uid := strings.TrimPrefix(filepath.Base(dir), namespace+"_"+name+"_")
+		// the systemd cgroup driver writes the UID with underscores
+		alt := strings.Replace(uid, "-", "_", -1)
+		for _, p := range procs {
+			pid, err := strconv.Atoi(p.Name())
+			if err != nil {
+				continue
+			}
+			if procInCgroup(pid, uid, alt) {
+				return fmt.Sprintf("/proc/%d/ns/net", pid), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no running process found for pod %s/%s", namespace, name)
+}
+
+// procInCgroup reports if a process is in a cgroup named with either form
+// of a pod UID
+func procInCgroup(pid int, uid, alt string) bool {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := scanner.Text(); strings.Contains(line, uid) || strings.Contains(line, alt) {
+			return true
+		}
+	}
+	return false
+}
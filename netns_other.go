@@ -0,0 +1,22 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// enterDockerNetns is only possible on Linux, which has network namespaces
+func enterDockerNetns(container string) (func(), error) {
+	return nil, fmt.Errorf("network namespaces are not supported on %s", runtime.GOOS)
+}
+
+func enterNamedNetns(name string) (func(), error) {
+	return enterDockerNetns(name)
+}
+
+func enterPodNetns(pod string) (func(), error) {
+	return enterDockerNetns(pod)
+}
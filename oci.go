@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+var (
+	ociMode   bool
+	ociAuthed bool
+
+	// headersMu guards Headers, which the token exchange updates while
+	// --all fetches are running
+	headersMu sync.Mutex
+)
+
+// ociAccept lists the manifest media types a registry may answer with
+var ociAccept = strings.Join([]string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/json",
+}, ", ")
+
+// parseAuthParams splits a challenge like `Bearer realm="x",scope="a,b"` into
+// the scheme and its parameters
+func parseAuthParams(challenge string) (scheme string, params map[string]string) {
+	params = make(map[string]string)
+	parts := strings.SplitN(strings.TrimSpace(challenge), " ", 2)
+	scheme = strings.ToLower(parts[0])
+	if len(parts) < 2 {
+		return
+	}
+	rest := parts[1]
+	for rest != "" {
+		eq := strings.IndexByte(rest, '=')
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = strings.TrimLeft(rest[eq+1:], " ")
+		var val string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				end = len(rest) - 1
+			}
+			val, rest = rest[1:end+1], rest[end+1:]
+			if len(rest) > 0 {
+				rest = rest[1:]
+			}
+		} else if comma := strings.IndexByte(rest, ','); comma >= 0 {
+			val, rest = rest[:comma], rest[comma:]
+		} else {
+			val, rest = rest, ""
+		}
+		params[key] = val
+		rest = strings.TrimLeft(rest, ", ")
+	}
+	return
+}
+
+// ociAuthorize performs the registry token handshake described by the
+// WWW-Authenticate header of a 401 reply and stores the bearer token
+func ociAuthorize(client *http.Client, resp *http.Response) error {
+	scheme, params := parseAuthParams(resp.Header.Get("WWW-Authenticate"))
+	if scheme != "bearer" || params["realm"] == "" {
+		return fmt.Errorf("unsupported registry challenge %q", resp.Header.Get("WWW-Authenticate"))
+	}
+	u, err := url.Parse(params["realm"])
+	if err != nil {
+		return err
+	}
+	q := u.Query()
+	for _, key := range []string{"service", "scope"} {
+		if params[key] != "" {
+			q.Set(key, params[key])
+		}
+	}
+	u.RawQuery = q.Encode()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	// Registry credentials given as a basic auth header are exchanged for a token
+	if auth := Headers["authorization"]; strings.HasPrefix(strings.ToLower(auth), "basic ") {
+		req.Header.Set("Authorization", auth)
+	}
+	if debug {
+		log.Println("OCI token request", u)
+	}
+	tokResp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer tokResp.Body.Close()
+	if tokResp.StatusCode != http.StatusOK {
+		return fmt.Errorf("token request to %q returned %s", u.Host, tokResp.Status)
+	}
+	var tok struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	byt, err := ioutil.ReadAll(tokResp.Body)
+	if err == nil {
+		err = json.Unmarshal(byt, &tok)
+	}
+	if err != nil {
+		return err
+	}
+	if tok.Token == "" {
+		tok.Token = tok.AccessToken
+	}
+	if tok.Token == "" {
+		return errors.New("no token in registry auth reply")
+	}
+	Headers["authorization"] = "Bearer " + tok.Token
+	ociAuthed = true
+	return nil
+}
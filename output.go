@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/itchyny/timefmt-go"
+)
+
+var (
+	outputTemplate string
+	outputFD       int
+
+	// dataOut is where results go, diagnostics always go to stderr
+	dataOut = os.Stdout
+)
+
+// openDataOut points the results at --output-fd, for supervisors which keep
+// data and logs on channels of their own
+func openDataOut() {
+	if outputFD == 1 {
+		return
+	}
+	if outputFD < 1 || outputFD == 2 {
+		log.Fatalf("Invalid --output-fd %d, stderr is kept for diagnostics", outputFD)
+	}
+	dataOut = os.NewFile(uintptr(outputFD), fmt.Sprintf("fd %d", outputFD))
+	if _, err := dataOut.Stat(); err != nil {
+		log.Fatalf("File descriptor %d given by --output-fd is not open", outputFD)
+	}
+}
+
+// outputPath is the -o file, or the --output-template filled in with the
+// current time, such as out/%Y/%m/%d/%H.json for hourly archives
+func outputPath() string {
+	if outputTemplate != "" {
+		return timefmt.Format(clock.Now(), outputTemplate)
+	}
+	return outputFile
+}
+
+// createOutput creates the output file along with any missing directories
+func createOutput(name string) (*os.File, error) {
+	if err := checkWrite(name); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return nil, err
+	}
+	return os.Create(name)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/itchyny/gojq"
+	"github.com/pschou/jqURL/pkg/jqurl"
+)
+
+var (
+	followPages bool
+	pageStream  bool
+	nextJQ      string
+	cursorParam string
+	pageParam   string
+	maxPages    int
+
+	nextCode *gojq.Code
+)
+
+// nextLink returns the rel="next" target of a RFC 5988 Link header, resolved
+// against the request URL
+func nextLink(resp *http.Response) *url.URL {
+	u, _ := jqurl.NextLink(resp, nil)
+	return u
+}
+
+// nextPage finds the URL of the page after resp.  By default that comes from
+// a Link header or the continuationToken field used by Nexus, --next-jq takes
+// it from the page, as a URL or with --cursor-param a cursor, and
+// --page-param counts up a page number.
+func nextPage(resp *http.Response, page interface{}) (*url.URL, error) {
+	switch {
+	case nextJQ != "":
+		return nextFromJQ(resp, page)
+	case pageParam != "":
+		if emptyPage(page) {
+			return nil, nil
+		}
+		u := *resp.Request.URL
+		q := u.Query()
+		n := 1
+		if cur := q.Get(pageParam); cur != "" {
+			var err error
+			if n, err = strconv.Atoi(cur); err != nil {
+				return nil, fmt.Errorf("page parameter %s=%q is not a number", pageParam, cur)
+			}
+		}
+		q.Set(pageParam, strconv.Itoa(n+1))
+		u.RawQuery = q.Encode()
+		return &u, nil
+	}
+	if u := nextLink(resp); u != nil {
+		return u, nil
+	}
+	if obj, ok := page.(map[string]interface{}); ok {
+		if token, ok := obj["continuationToken"].(string); ok && token != "" {
+			u := *resp.Request.URL
+			q := u.Query()
+			q.Set("continuationToken", token)
+			u.RawQuery = q.Encode()
+			return &u, nil
+		}
+	}
+	return nil, nil
+}
+
+// nextFromJQ runs --next-jq on a page, null, false or "" end the paging
+func nextFromJQ(resp *http.Response, page interface{}) (*url.URL, error) {
+	if nextCode == nil {
+		var err error
+		if nextCode, err = jqurl.Compile(nextJQ, jqFunctions...); err != nil {
+			return nil, err
+		}
+	}
+	v, ok := nextCode.Run(page).Next()
+	if !ok || v == nil || v == false || v == "" {
+		return nil, nil
+	}
+	if err, ok := v.(error); ok {
+		return nil, fmt.Errorf("--next-jq %q: %s", nextJQ, err)
+	}
+	next := fmt.Sprint(v)
+	if cursorParam != "" {
+		u := *resp.Request.URL
+		q := u.Query()
+		q.Set(cursorParam, next)
+		u.RawQuery = q.Encode()
+		return &u, nil
+	}
+	return resp.Request.URL.Parse(next)
+}
+
+// emptyPage reports if a page has no entries, which ends page numbering
+func emptyPage(page interface{}) bool {
+	switch p := page.(type) {
+	case []interface{}:
+		return len(p) == 0
+	case map[string]interface{}:
+		for _, v := range p {
+			if arr, ok := v.([]interface{}); ok && len(arr) > 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return page == nil
+}
+
+// mergePage appends the entries of a following page onto the first one.
+// Top level arrays are concatenated, as are the array fields of object
+// replies, such as "items" (GitHub search, Nexus) and "tags" (OCI tag list),
+// while other fields take the value of the latest page.
+func mergePage(first, page interface{}) interface{} {
+	switch f := first.(type) {
+	case []interface{}:
+		if p, ok := page.([]interface{}); ok {
+			return append(f, p...)
+		}
+	case map[string]interface{}:
+		p, ok := page.(map[string]interface{})
+		if !ok {
+			break
+		}
+		for key, val := range p {
+			more, isArr := val.([]interface{})
+			have, hadArr := f[key].([]interface{})
+			if isArr && (hadArr || f[key] == nil) {
+				f[key] = append(have, more...)
+			} else {
+				f[key] = val
+			}
+		}
+	}
+	return first
+}
+
+// getPages follows the pages after the first reply, returning them merged
+// into the first
+func getPages(client *http.Client, resp *http.Response, first interface{}) (interface{}, error) {
+	err := eachPage(client, resp, first, func(_ *http.Response, page interface{}) {
+		first = mergePage(first, page)
+	})
+	return first, err
+}
+
+// eachPage fetches the pages after the first reply in turn, handing each to
+// fn.  It stops at --max-pages, counting the first, or when a next page URL
+// comes round again.
+func eachPage(client *http.Client, resp *http.Response, page interface{}, fn func(resp *http.Response, page interface{})) error {
+	seen := map[string]bool{resp.Request.URL.String(): true}
+	for n := 1; maxPages == 0 || n < maxPages; n++ {
+		next, err := nextPage(resp, page)
+		if err != nil || next == nil {
+			return err
+		}
+		if seen[next.String()] {
+			if debug {
+				log.Println("next page already fetched, stopping", next)
+			}
+			return nil
+		}
+		seen[next.String()] = true
+		if debug {
+			log.Println("HTTP next page", next)
+		}
+		// each page is fetched as the first was, with its retries, --fail,
+		// --input decoding and assertions
+		opts := fetchOptions(client)
+		opts.URLs, opts.Method, opts.Body = []string{next.String()}, "GET", nil
+		delete(opts.Headers, "content-type")
+		res, err := fetchDo(opts)
+		if err != nil {
+			return fmt.Errorf("page %q: %s", next, err)
+		}
+		resp = res.Response
+		saveResponseBody(resp, res.Body)
+		page = nil
+		if err = unmarshalBody(res.Body, &page); err != nil {
+			return err
+		}
+		if pageParam != "" && emptyPage(page) {
+			return nil
+		}
+		fn(resp, page)
+	}
+	return nil
+}
+
+// streamPages runs the query on each page as it is fetched rather than on
+// all of them merged, for listings too large to hold at once
+func streamPages(client *http.Client) {
+	res, err := fetchDo(fetchOptions(client))
+	if err != nil {
+		log.Fatalf("Error fetching first page: %s", err)
+	}
+	keepTrailers(res.Response)
+	saveResponseBody(res.Response, res.Body)
+	var first interface{}
+	if err = unmarshalBody(res.Body, &first); err != nil {
+		log.Fatalf("Cannot unmarshall url %q err: %s", res.URL, err)
+	}
+	queryInput(respEnvelope(res.URL, res.Response, "", first))
+	err = eachPage(client, res.Response, first, func(resp *http.Response, page interface{}) {
+		queryInput(respEnvelope(resp.Request.URL.String(), resp, "", page))
+	})
+	if err != nil {
+		log.Fatalf("Error following pages: %s", err)
+	}
+	finishQuery()
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// pkcs11Prefix picks a client certificate and key on a smartcard or HSM in
+// --cert, by an RFC 7512 URI such as pkcs11:token=PIV;object=Auth
+const pkcs11Prefix = "pkcs11:"
+
+// pkcs11Tool is OpenSC's command line tool, which loads the PKCS#11 module.
+// Loading it in process would need cgo, which the static build leaves out.
+var pkcs11Tool = "pkcs11-tool"
+
+// pkcs11Token holds what a pkcs11: URI picks out
+type pkcs11Token struct {
+	module, slot, token string
+	object, id          string
+	pin                 string
+}
+
+// parsePKCS11URI reads the token, object, id and slot-id path attributes and
+// the module-path, pin-value and pin-source query attributes of a URI.  The
+// PIN may also come from $PKCS11_PIN and the module from $PKCS11_MODULE.
+func parsePKCS11URI(uri string) (*pkcs11Token, error) {
+	t := &pkcs11Token{module: os.Getenv("PKCS11_MODULE"), pin: os.Getenv("PKCS11_PIN")}
+	path, query := strings.TrimPrefix(uri, pkcs11Prefix), ""
+	if i := strings.Index(path, "?"); i >= 0 {
+		path, query = path[:i], path[i+1:]
+	}
+	attrs := strings.FieldsFunc(path, func(r rune) bool { return r == ';' })
+	attrs = append(attrs, strings.FieldsFunc(query, func(r rune) bool { return r == '&' })...)
+	for _, attr := range attrs {
+		parts := strings.SplitN(attr, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("malformed attribute %q in %q", attr, uri)
+		}
+		val, err := url.PathUnescape(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("malformed attribute %q in %q", attr, uri)
+		}
+		switch parts[0] {
+		case "module-path":
+			t.module = val
+		case "slot-id":
+			t.slot = val
+		case "token":
+			t.token = val
+		case "object":
+			t.object = val
+		case "id":
+			t.id = hex.EncodeToString([]byte(val))
+		case "pin-value":
+			t.pin = val
+		case "pin-source":
+			file := strings.TrimPrefix(val, "file:")
+			if err := checkRead(file); err != nil {
+				return nil, err
+			}
+			byt, err := ioutil.ReadFile(file)
+			if err != nil {
+				return nil, fmt.Errorf("reading pin-source: %s", err)
+			}
+			t.pin = strings.TrimSpace(string(byt))
+		case "type", "manufacturer", "model", "serial", "library-description", "library-manufacturer", "library-version", "slot-description", "slot-manufacturer":
+			// not needed to find the object
+		default:
+			return nil, fmt.Errorf("unknown attribute %q in %q", parts[0], uri)
+		}
+	}
+	if t.object == "" && t.id == "" {
+		return nil, fmt.Errorf("%q names no object or id", uri)
+	}
+	return t, nil
+}
+
+// run calls pkcs11-tool on the token and object with more arguments, the
+// data going in and out through temporary files
+func (t *pkcs11Token) run(in []byte, args ...string) ([]byte, error) {
+	dir, err := ioutil.TempDir("", "jqurl_pkcs11")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	var base []string
+	if t.module != "" {
+		base = append(base, "--module", t.module)
+	}
+	if t.slot != "" {
+		base = append(base, "--slot", t.slot)
+	}
+	if t.token != "" {
+		base = append(base, "--token-label", t.token)
+	}
+	if t.object != "" {
+		base = append(base, "--label", t.object)
+	}
+	if t.id != "" {
+		base = append(base, "--id", t.id)
+	}
+	if in != nil {
+		if err = ioutil.WriteFile(dir+"/in", in, 0600); err != nil {
+			return nil, err
+		}
+		base = append(base, "--input-file", dir+"/in")
+	}
+	cmd := exec.Command(pkcs11Tool, append(append(base, args...), "--output-file", dir+"/out")...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("%s: %s: %s", pkcs11Tool, err, strings.TrimSpace(string(out)))
+	}
+	return ioutil.ReadFile(dir + "/out")
+}
+
+// pkcs11Cert reads the certificate of a pkcs11: URI and signs with the key
+// beside it, which never leaves the token
+func pkcs11Cert(uri string) (tls.Certificate, error) {
+	t, err := parsePKCS11URI(uri)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if _, err = exec.LookPath(pkcs11Tool); err != nil {
+		return tls.Certificate{}, fmt.Errorf("PKCS#11 needs %s, from OpenSC, which was not found", pkcs11Tool)
+	}
+	der, err := t.run(nil, "--read-object", "--type", "cert")
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("certificate on token: %s", err)
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  &pkcs11Signer{token: t, pub: leaf.PublicKey},
+		Leaf:        leaf,
+	}, nil
+}
+
+// digestInfo prefixes a hash for RSA PKCS #1 v1.5 signing, which the token
+// does not do itself with the plain RSA-PKCS mechanism
+var digestInfo = map[crypto.Hash][]byte{
+	crypto.SHA1:   {0x30, 0x21, 0x30, 0x09, 0x06, 0x05, 0x2b, 0x0e, 0x03, 0x02, 0x1a, 0x05, 0x00, 0x04, 0x14},
+	crypto.SHA256: {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	crypto.SHA384: {0x30, 0x41, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x02, 0x05, 0x00, 0x04, 0x30},
+	crypto.SHA512: {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+}
+
+// pkcs11Signer signs TLS handshakes on the token
+type pkcs11Signer struct {
+	token *pkcs11Token
+	pub   crypto.PublicKey
+}
+
+func (s *pkcs11Signer) Public() crypto.PublicKey { return s.pub }
+
+func (s *pkcs11Signer) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	args := []string{"--sign"}
+	if s.token.pin != "" {
+		args = append(args, "--login", "--pin", s.token.pin)
+	}
+	switch s.pub.(type) {
+	case *rsa.PublicKey:
+		hash := strings.ReplaceAll(opts.HashFunc().String(), "-", "")
+		if _, ok := opts.(*rsa.PSSOptions); ok {
+			// the salt defaults to the hash length, as TLS wants
+			args = append(args, "--mechanism", "RSA-PKCS-PSS", "--hash-algorithm", hash, "--mgf", "MGF1-"+hash)
+			break
+		}
+		args = append(args, "--mechanism", "RSA-PKCS")
+		if opts.HashFunc() != crypto.MD5SHA1 {
+			prefix, ok := digestInfo[opts.HashFunc()]
+			if !ok {
+				return nil, fmt.Errorf("unsupported hash %s", opts.HashFunc())
+			}
+			digest = append(append([]byte{}, prefix...), digest...)
+		}
+	case *ecdsa.PublicKey:
+		args = append(args, "--mechanism", "ECDSA")
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", s.pub)
+	}
+	sig, err := s.token.run(digest, args...)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := s.pub.(*ecdsa.PublicKey); ok {
+		return derECDSASig(sig)
+	}
+	return sig, nil
+}
@@ -0,0 +1,105 @@
+package jqurl
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"runtime"
+)
+
+// Body is a request body which can be sent again, on a retry or after a
+// redirect, rather than being used up by the first attempt
+type Body interface {
+	// Open returns a reader from the start of the body
+	Open() (io.ReadCloser, error)
+
+	// Len is the size in bytes, -1 when unknown
+	Len() int64
+
+	// Close releases anything held, such as a spool file
+	Close() error
+}
+
+// spoolMemory is how much of a streamed body is kept in memory before the
+// rest goes to a temporary file
+const spoolMemory = 1 << 20
+
+// BytesBody sends a byte slice
+func BytesBody(b []byte) Body {
+	return bytesBody(b)
+}
+
+type bytesBody []byte
+
+func (b bytesBody) Open() (io.ReadCloser, error) { return ioutil.NopCloser(bytes.NewReader(b)), nil }
+func (b bytesBody) Len() int64                   { return int64(len(b)) }
+func (b bytesBody) Close() error                 { return nil }
+
+// FileBody sends a file.  A regular file is opened again for every attempt,
+// anything else, such as a pipe, can only be read once so it is spooled.
+func FileBody(name string) (Body, error) {
+	stat, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if stat.Mode().IsRegular() {
+		return fileBody{name: name, size: stat.Size()}, nil
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReaderBody(f)
+}
+
+type fileBody struct {
+	name string
+	size int64
+}
+
+func (b fileBody) Open() (io.ReadCloser, error) { return os.Open(b.name) }
+func (b fileBody) Len() int64                   { return b.size }
+func (b fileBody) Close() error                 { return nil }
+
+// ReaderBody reads r to the end, such as standard input, keeping the first
+// megabyte in memory and spooling the rest to a temporary file
+func ReaderBody(r io.Reader) (Body, error) {
+	head, err := ioutil.ReadAll(io.LimitReader(r, spoolMemory))
+	if err != nil || len(head) < spoolMemory {
+		return bytesBody(head), err
+	}
+	f, err := ioutil.TempFile("", "jqurl_body")
+	if err != nil {
+		return nil, err
+	}
+	if runtime.GOOS != "windows" {
+		// the open file stays readable, and nothing is left behind on a crash
+		os.Remove(f.Name())
+	}
+	size, err := io.Copy(f, io.MultiReader(bytes.NewReader(head), r))
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return &spoolBody{f: f, size: size}, nil
+}
+
+type spoolBody struct {
+	f    *os.File
+	size int64
+}
+
+func (b *spoolBody) Open() (io.ReadCloser, error) {
+	return ioutil.NopCloser(io.NewSectionReader(b.f, 0, b.size)), nil
+}
+func (b *spoolBody) Len() int64 { return b.size }
+func (b *spoolBody) Close() error {
+	err := b.f.Close()
+	if runtime.GOOS == "windows" {
+		os.Remove(b.f.Name())
+	}
+	return err
+}
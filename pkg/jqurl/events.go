@@ -0,0 +1,83 @@
+package jqurl
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Event is one event of a text/event-stream
+type Event struct {
+	// Event is the type of the event, "message" when the server gave none
+	Event string
+	ID    string
+	Data  string
+}
+
+// EventReader parses a Server-Sent Events stream
+type EventReader struct {
+	rdr *bufio.Reader
+
+	// LastID is the ID of the latest event, which events without one
+	// carry on, to be sent as Last-Event-ID when reconnecting.  Set it
+	// before reading to carry on from an earlier connection.
+	LastID string
+
+	// Retry is the reconnection time the server last asked for, and is left
+	// as it was set until the server asks for one
+	Retry time.Duration
+}
+
+// NewEventReader reads events from a text/event-stream body
+func NewEventReader(r io.Reader) *EventReader {
+	return &EventReader{rdr: bufio.NewReader(r)}
+}
+
+// Next returns the next event, or io.EOF at the end of the stream.  An
+// event cut off by the end of the stream is dropped.
+func (r *EventReader) Next() (Event, error) {
+	var data strings.Builder
+	event := ""
+	for {
+		line, err := r.rdr.ReadString('\n')
+		if err != nil {
+			return Event{}, err
+		}
+		line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+		if line == "" {
+			if data.Len() > 0 {
+				if event == "" {
+					event = "message"
+				}
+				return Event{Event: event, ID: r.LastID, Data: strings.TrimSuffix(data.String(), "\n")}, nil
+			}
+			event = ""
+			continue
+		}
+		if strings.HasPrefix(line, ":") {
+			// a comment, often sent to keep the connection open
+			continue
+		}
+		field, value := line, ""
+		if i := strings.IndexByte(line, ':'); i >= 0 {
+			field, value = line[:i], strings.TrimPrefix(line[i+1:], " ")
+		}
+		switch field {
+		case "data":
+			data.WriteString(value)
+			data.WriteByte('\n')
+		case "event":
+			event = value
+		case "id":
+			if !strings.ContainsRune(value, 0) {
+				r.LastID = value
+			}
+		case "retry":
+			if ms, err := strconv.Atoi(value); err == nil && ms >= 0 {
+				r.Retry = time.Duration(ms) * time.Millisecond
+			}
+		}
+	}
+}
@@ -0,0 +1,559 @@
+// Package jqurl fetches JSON documents over HTTP and runs jq queries on them,
+// the same fetch-then-query workflow as the jqurl command, for Go programs
+// which would rather not shell out to the binary.
+//
+//	body, err := jqurl.Fetch(jqurl.Options{URLs: []string{"https://api.example.com/items"}})
+//	...
+//	var data interface{}
+//	json.Unmarshal(body, &data)
+//	iter, err := jqurl.Query(data, ".items[].id")
+package jqurl
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/itchyny/gojq"
+)
+
+// Options describe a fetch.  Only URLs is required.
+type Options struct {
+	// URLs are alternatives, tried in turn until one returns a JSON body
+	URLs []string
+
+	// Method defaults to GET
+	Method  string
+	Headers map[string]string
+
+	// Body is sent with every attempt, nil sends none
+	Body Body
+
+	// Client defaults to one following redirects with RedirectPolicy
+	Client *http.Client
+
+	// Transport, when set, sends the requests in place of the Client's own,
+	// for an embedder's proxying, fault injection or recording
+	Transport http.RoundTripper
+
+	// Resolver, when set, looks up the host names the transport dials, such
+	// as from service discovery.  The transport must be an *http.Transport,
+	// the default one included, and fetches with the same Resolver share a
+	// copy of it dialing with the Resolver, through its own DialContext if
+	// it has one.
+	Resolver *net.Resolver
+
+	// Timeout bounds each attempt, zero for no limit
+	Timeout time.Duration
+
+	// MaxTries is the number of attempts over all URLs, at least one is made
+	MaxTries int
+
+	// Delay is the wait after every failed round through the URLs
+	Delay time.Duration
+
+	// Backoff doubles the Delay after each round, with random jitter so
+	// many clients do not retry in step
+	Backoff bool
+
+	// MaxDelay caps the wait between rounds, including one asked for by a
+	// Retry-After header, zero for no cap
+	MaxDelay time.Duration
+
+	// RetryOn decides if a failed try is worth another, from the response
+	// when there was one.  Nil retries every failure.
+	RetryOn func(resp *http.Response, err error) bool
+
+	// RetryPolicy, when set, decides instead of RetryOn, Delay, Backoff and
+	// Retry-After whether a failed try is made again and how long to wait
+	// first.  MaxTries still bounds the tries, and requests which are not
+	// idempotent are still only retried as RetryNonIdempotent allows.
+	RetryPolicy RetryPolicy
+
+	// Fail makes a 4xx or 5xx response an error, a *StatusError, rather than
+	// taking its body when it is JSON.  Client errors other than 408 and 429
+	// are not retried.
+	Fail bool
+
+	// RetryNonIdempotent retries methods such as POST and PATCH, which are
+	// otherwise only retried when they carry an Idempotency-Key header or
+	// the connection failed before the request was sent
+	RetryNonIdempotent bool
+
+	// Stream ends the fetch at the first 2xx response without reading its
+	// body, for endpoints which never finish.  Result.Body is nil and the
+	// caller must close Response.Body.
+	Stream bool
+
+	// Filter converts a body before it is checked for JSON, such as from
+	// another format named by the response Content-Type
+	Filter func(resp *http.Response, body []byte) ([]byte, error)
+
+	// OnResponse sees each response before its body is read.  Returning true
+	// discards it and resends the request at once without counting a try,
+	// such as after fetching a token.
+	OnResponse func(resp *http.Response) (resend bool)
+
+	// OnInformational sees each 1xx response, such as 103 Early Hints, which
+	// comes ahead of the final one
+	OnInformational func(code int, header http.Header)
+
+	// OnRetry is called after a failed try in place of sleeping for wait
+	OnRetry func(try int, target string, err error, wait time.Duration)
+
+	// Clock sleeps between tries and dates Retry-After, nil is SystemClock
+	Clock Clock
+
+	// Context, when set, cancels the fetch, and with Stream the reading of
+	// the body, once it is done
+	Context context.Context
+
+	// Logf receives debug messages when set
+	Logf func(format string, v ...interface{})
+}
+
+// Result is the reply which ended a fetch
+type Result struct {
+	// Index of the URL which answered
+	Index int
+	URL   string
+
+	// Response has its body already read and closed, unless streaming, so
+	// Response.Trailer holds any trailers sent after the body
+	Response *http.Response
+	// Body is a JSON document, or several one after the other when a
+	// Filter turns a multi-document reply into a stream of JSON values
+	Body []byte
+}
+
+// RetryPolicy decides what follows a failed try, for APIs whose rate limits
+// and error replies the built in retries don't fit
+type RetryPolicy interface {
+	// Retry is given the number of tries made so far, from one, the
+	// response of the failed try when there was one, with its body closed,
+	// and the error it failed with
+	Retry(tries int, resp *http.Response, err error) (retry bool, wait time.Duration)
+}
+
+// RetryPolicyFunc lets a function be used as a RetryPolicy
+type RetryPolicyFunc func(tries int, resp *http.Response, err error) (bool, time.Duration)
+
+// Retry calls f(tries, resp, err)
+func (f RetryPolicyFunc) Retry(tries int, resp *http.Response, err error) (bool, time.Duration) {
+	return f(tries, resp, err)
+}
+
+// ErrNotIdempotent is wrapped by the error of a failed fetch which was not
+// retried because its method is not idempotent
+var ErrNotIdempotent = errors.New("not retried as the request is not idempotent")
+
+// StatusError is the error of a fetch ended by a 4xx or 5xx response when
+// Options.Fail is set
+type StatusError struct {
+	URL        string
+	StatusCode int
+	Status     string
+	Body       []byte
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s returned %s", e.URL, e.Status)
+}
+
+// retryable reports if a status is worth trying again: server errors,
+// timeouts and rate limits
+func (e *StatusError) retryable() bool {
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusRequestTimeout || e.StatusCode == http.StatusTooManyRequests
+}
+
+// Fetch tries the URLs in turn until one returns JSON, and returns the body
+func Fetch(opts Options) ([]byte, error) {
+	res, err := Do(opts)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// Do is Fetch which also returns the response which answered
+func Do(opts Options) (*Result, error) {
+	if len(opts.URLs) == 0 {
+		return nil, fmt.Errorf("jqurl: no URLs to fetch")
+	}
+	method := opts.Method
+	if method == "" {
+		method = "GET"
+	}
+	client, err := fetchClient(opts)
+	if err != nil {
+		return nil, err
+	}
+	logf := opts.Logf
+	if logf == nil {
+		logf = func(string, ...interface{}) {}
+	}
+	clock := opts.Clock
+	if clock == nil {
+		clock = SystemClock
+	}
+
+	var lastErr error
+	for j := 0; j == 0 || j < opts.MaxTries; j++ {
+		i := j % len(opts.URLs)
+		target := opts.URLs[i]
+		logf("HTTP %s %s", method, target)
+
+		res, resp, resend, err := try(client, method, target, opts)
+		if resend {
+			j--
+			continue
+		}
+		if err == nil {
+			res.Index = i
+			return res, nil
+		}
+		logf("Error fetching %s: %s", target, err)
+		lastErr = err
+		if opts.Context != nil && opts.Context.Err() != nil {
+			return nil, err
+		}
+		var statusErr *StatusError
+		if opts.RetryPolicy == nil && errors.As(err, &statusErr) && !statusErr.retryable() {
+			return nil, err
+		}
+		if j+1 < opts.MaxTries && !opts.RetryNonIdempotent && !Idempotent(method, opts.Headers) && !notSent(err) {
+			return nil, fmt.Errorf("%w: %s", ErrNotIdempotent, err)
+		}
+		if opts.RetryPolicy != nil {
+			if j+1 >= opts.MaxTries {
+				break
+			}
+			retry, wait := opts.RetryPolicy.Retry(j+1, resp, err)
+			if !retry {
+				return nil, err
+			}
+			if opts.OnRetry != nil {
+				opts.OnRetry(j+1, target, lastErr, wait)
+			} else {
+				clock.Sleep(wait)
+			}
+			continue
+		}
+		if opts.RetryOn != nil && !opts.RetryOn(resp, err) {
+			return nil, err
+		}
+
+		if j+1 < opts.MaxTries {
+			var wait time.Duration
+			if i == len(opts.URLs)-1 {
+				wait = roundDelay(opts, j/len(opts.URLs))
+			}
+			if after := retryAfter(resp, clock); after > wait {
+				wait = after
+				if opts.MaxDelay > 0 && wait > opts.MaxDelay {
+					wait = opts.MaxDelay
+				}
+			}
+			if opts.OnRetry != nil {
+				opts.OnRetry(j+1, target, lastErr, wait)
+			} else {
+				clock.Sleep(wait)
+			}
+		}
+	}
+	return nil, lastErr
+}
+
+// roundDelay is the wait after a failed round, counted from zero
+func roundDelay(opts Options, round int) time.Duration {
+	wait := opts.Delay
+	if !opts.Backoff || wait <= 0 {
+		return wait
+	}
+	for ; round > 0 && (opts.MaxDelay <= 0 || wait < opts.MaxDelay) && wait < time.Hour; round-- {
+		wait *= 2
+	}
+	if opts.MaxDelay > 0 && wait > opts.MaxDelay {
+		wait = opts.MaxDelay
+	}
+	// anywhere from half to the full wait
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+// retryAfter reads the Retry-After header of a response, in seconds or as a
+// date
+func retryAfter(resp *http.Response, clock Clock) time.Duration {
+	if resp == nil {
+		return 0
+	}
+	val := strings.TrimSpace(resp.Header.Get("Retry-After"))
+	if val == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(val); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if when, err := http.ParseTime(val); err == nil {
+		return when.Sub(clock.Now())
+	}
+	return 0
+}
+
+// Idempotent reports if a request can be sent twice without doing the work
+// twice, by its method (RFC 9110) or an Idempotency-Key header
+func Idempotent(method string, headers map[string]string) bool {
+	switch strings.ToUpper(method) {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	for key := range headers {
+		if strings.EqualFold(key, "Idempotency-Key") || strings.EqualFold(key, "X-Idempotency-Key") {
+			return true
+		}
+	}
+	return false
+}
+
+// notSent reports if an attempt failed while connecting, so the server never
+// saw the request and it is safe to send again whatever the method
+func notSent(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// try makes a single attempt at one URL, returning the response it got
+// even when the attempt failed
+func try(client *http.Client, method, target string, opts Options) (*Result, *http.Response, bool, error) {
+	parent := opts.Context
+	if parent == nil {
+		parent = context.Background()
+	}
+	ctx, cancel := context.WithCancel(parent)
+	streaming := false
+	defer func() {
+		if !streaming {
+			cancel()
+		}
+	}()
+	if opts.OnInformational != nil {
+		ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+			Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+				opts.OnInformational(code, http.Header(header))
+				return nil
+			},
+		})
+	}
+	var timer *time.Timer
+	if opts.Timeout > 0 {
+		timer = time.AfterFunc(opts.Timeout, cancel)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, nil)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if opts.Body != nil && opts.Body.Len() != 0 {
+		if req.Body, err = opts.Body.Open(); err != nil {
+			return nil, nil, false, err
+		}
+		req.ContentLength = opts.Body.Len()
+		req.GetBody = opts.Body.Open
+	}
+	for key, val := range opts.Headers {
+		req.Header.Set(key, val)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if opts.OnResponse != nil && opts.OnResponse(resp) {
+		resp.Body.Close()
+		return nil, resp, true, nil
+	}
+	if opts.Fail && resp.StatusCode >= 400 {
+		byt, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, resp, false, &StatusError{URL: target, StatusCode: resp.StatusCode, Status: resp.Status, Body: byt}
+	}
+	if opts.Stream {
+		if resp.StatusCode/100 != 2 {
+			resp.Body.Close()
+			return nil, resp, false, fmt.Errorf("%s %s", resp.Proto, resp.Status)
+		}
+		// the timeout covers getting the response, the body takes as long
+		// as it takes
+		if timer != nil {
+			timer.Stop()
+		}
+		streaming = true
+		resp.Body = cancelBody{ReadCloser: resp.Body, cancel: cancel}
+		return &Result{URL: target, Response: resp}, resp, false, nil
+	}
+
+	byt, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err == nil && opts.Filter != nil {
+		byt, err = opts.Filter(resp, byt)
+	}
+	if err != nil {
+		return nil, resp, false, err
+	}
+	if err = validStream(byt); err != nil {
+		return nil, resp, false, fmt.Errorf("%s, invalid JSON: %s", resp.Status, err)
+	}
+	return &Result{URL: target, Response: resp, Body: byt}, resp, false, nil
+}
+
+// validStream checks a body holds one JSON value or more
+func validStream(byt []byte) error {
+	if json.Valid(byt) {
+		return nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(byt))
+	n := 0
+	for {
+		var v json.RawMessage
+		if err := dec.Decode(&v); err == io.EOF && n > 0 {
+			return nil
+		} else if err == io.EOF {
+			return json.Unmarshal(byt, &v)
+		} else if err != nil {
+			return err
+		}
+		n++
+	}
+}
+
+// cancelBody releases the request context when a streamed body is closed
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// Query compiles a jq program and runs it on data, which should be made of
+// the types encoding/json decodes into.  Extra compiler options, such as
+// gojq.WithFunction, are passed on to gojq.Compile.
+func Query(data interface{}, jq string, options ...gojq.CompilerOption) (gojq.Iter, error) {
+	code, err := Compile(jq, options...)
+	if err != nil {
+		return nil, err
+	}
+	return code.Run(data), nil
+}
+
+// Compile parses and compiles a jq program once, for running it over many
+// inputs such as the lines of a stream
+func Compile(jq string, options ...gojq.CompilerOption) (*gojq.Code, error) {
+	query, err := gojq.Parse(jq)
+	if err != nil {
+		return nil, fmt.Errorf("parsing jq query %q: %s", jq, err)
+	}
+	code, err := gojq.Compile(query, options...)
+	if err != nil {
+		return nil, fmt.Errorf("compiling jq query %q: %s", jq, err)
+	}
+	return code, nil
+}
+
+// CredentialHeaders are removed from a redirected request which leaves the
+// origin of the first one, unless the redirect policy trusts it
+var CredentialHeaders = []string{"Authorization", "Cookie", "Private-Token", "Job-Token", "X-JFrog-Art-Api"}
+
+// RedirectPolicy decides which redirects a client follows, use its
+// CheckRedirect method as the http.Client's
+type RedirectPolicy struct {
+	// Follow redirects at all, otherwise the redirect response is returned
+	Follow bool
+
+	// Trusted keeps credential headers on redirects to other origins, like
+	// curl's --location-trusted
+	Trusted bool
+
+	// Max is the number of redirects followed, 10 when zero
+	Max int
+
+	// AutoReferer sets the Referer of each redirected request to the URL it
+	// was redirected from, like curl's --referer ";auto", rather than
+	// keeping a Referer given on the first request
+	AutoReferer bool
+
+	// Jar is the client's cookie jar, if it has one.  The jar then keeps
+	// the Cookie header of each redirect, which the first request no longer
+	// shows as the caller set it once the jar's cookies were added to it.
+	Jar http.CookieJar
+}
+
+// CheckRedirect implements the policy for http.Client.  A redirect to a
+// different scheme, host or port drops the credential headers, where Go on
+// its own keeps them for subdomains and for https to http downgrades.
+func (p RedirectPolicy) CheckRedirect(req *http.Request, via []*http.Request) error {
+	if !p.Follow {
+		return http.ErrUseLastResponse
+	}
+	max := p.Max
+	if max == 0 {
+		max = 10
+	}
+	if len(via) >= max {
+		return fmt.Errorf("stopped after %d redirects", max)
+	}
+	first := via[0]
+	if p.AutoReferer {
+		last := via[len(via)-1].URL
+		if strings.EqualFold(last.Scheme, "https") && strings.EqualFold(req.URL.Scheme, "http") {
+			req.Header.Del("Referer")
+		} else {
+			ref := *last
+			ref.User, ref.Fragment = nil, ""
+			req.Header.Set("Referer", ref.String())
+		}
+	}
+	if SameOrigin(first.URL, req.URL) || p.Trusted {
+		// put back anything Go itself dropped
+		for _, h := range CredentialHeaders {
+			if h == "Cookie" && p.Jar != nil {
+				continue
+			}
+			if vals, ok := first.Header[h]; ok {
+				req.Header[h] = vals
+			}
+		}
+		return nil
+	}
+	for _, h := range CredentialHeaders {
+		req.Header.Del(h)
+	}
+	return nil
+}
+
+// SameOrigin compares the scheme, host and port of two URLs
+func SameOrigin(a, b *url.URL) bool {
+	port := func(u *url.URL) string {
+		if p := u.Port(); p != "" {
+			return p
+		}
+		if strings.EqualFold(u.Scheme, "https") {
+			return "443"
+		}
+		return "80"
+	}
+	return strings.EqualFold(a.Scheme, b.Scheme) && strings.EqualFold(a.Hostname(), b.Hostname()) && port(a) == port(b)
+}
@@ -0,0 +1,82 @@
+package jqurl
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// A redirect which updates a cookie must be followed with the jar's new value
+// alone, not the old one copied over from the first request as well
+func TestRedirectJarCookie(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/set", func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "s", Value: "old", Path: "/"})
+	})
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "s", Value: "new", Path: "/"})
+		http.Redirect(w, r, "/echo", http.StatusFound)
+	})
+	mux.HandleFunc("/echo", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Join(r.Header["Cookie"], "|")))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Jar: jar, CheckRedirect: RedirectPolicy{Follow: true, Jar: jar}.CheckRedirect}
+	for _, path := range []string{"/set", "/login"} {
+		resp, err := client.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if path == "/login" && string(body) != "s=new" {
+			t.Errorf("redirect sent Cookie %q, want %q", body, "s=new")
+		}
+	}
+}
+
+// A Resolver must feed the addresses it finds to a dialer the transport
+// already had, such as one through a tunnel, rather than replace it
+func TestResolverKeepsDialer(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ok":true}`))
+	}))
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+
+	var dialed []string
+	base := http.DefaultTransport.(*http.Transport).Clone()
+	base.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		return (&net.Dialer{}).DialContext(ctx, network, srv.Listener.Addr().String())
+	}
+	body, err := Fetch(Options{
+		URLs:      []string{"http://localhost:" + port + "/"},
+		Transport: base,
+		Resolver:  &net.Resolver{PreferGo: true},
+		MaxTries:  1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != `{"ok":true}` {
+		t.Errorf("body %q", body)
+	}
+	if len(dialed) == 0 {
+		t.Fatal("base dialer not used")
+	}
+	if host, _, _ := net.SplitHostPort(dialed[0]); net.ParseIP(host) == nil {
+		t.Errorf("base dialer given %q, want a looked up address", dialed[0])
+	}
+}
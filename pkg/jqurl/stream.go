@@ -0,0 +1,367 @@
+package jqurl
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/itchyny/gojq"
+)
+
+// Format says how a Stream splits a body into the values it queries
+type Format int
+
+const (
+	// FormatJSON queries the whole body as one value
+	FormatJSON Format = iota
+
+	// FormatJSONLines queries each line of a JSON Lines body
+	FormatJSONLines
+
+	// FormatArray queries each element of a top-level array as it is
+	// decoded, and a body which isn't an array whole
+	FormatArray
+
+	// FormatEvents queries the data of each event of a text/event-stream,
+	// as JSON or else as a string
+	FormatEvents
+)
+
+// StreamOptions describe the source of a Stream
+type StreamOptions struct {
+	Options
+
+	Format Format
+
+	// Query is run on each value, nil yields the values themselves
+	Query *gojq.Code
+
+	// NextPage gives the URL of the page after the one fetched with resp,
+	// nil after the last page.  The page is the body with FormatJSON and
+	// nil otherwise.  NextLink follows Link headers, and a nil NextPage
+	// fetches one page.
+	NextPage func(resp *http.Response, page interface{}) (*url.URL, error)
+
+	// Reconnect, with FormatEvents, connects again when the stream ends,
+	// after the retry time the server gave or else Delay, sending
+	// Last-Event-ID, until the server answers 204 No Content
+	Reconnect bool
+}
+
+// Stream yields the results of a query over a source as the body is read,
+// page after page, so a caller takes them at its own pace and can stop
+// mid-stream.  It is not safe for use by several goroutines at once.
+type Stream struct {
+	opts   StreamOptions
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	target string // URL to fetch next, "" for the first of URLs
+	resp   *http.Response
+	next   func() (interface{}, error)
+	page   interface{}
+	lastID string
+	retry  time.Duration
+	iter   gojq.Iter
+	err    error
+}
+
+// NewStream sets up a stream, nothing is fetched until the first Next
+func NewStream(opts StreamOptions) *Stream {
+	if len(opts.URLs) == 0 {
+		return &Stream{err: fmt.Errorf("jqurl: no URLs to fetch")}
+	}
+	parent := opts.Context
+	if parent == nil {
+		parent = context.Background()
+	}
+	if opts.Clock == nil {
+		opts.Clock = SystemClock
+	}
+	s := &Stream{opts: opts, retry: opts.Delay}
+	s.ctx, s.cancel = context.WithCancel(parent)
+	return s
+}
+
+// Next returns the next result, or io.EOF once the source is done.  The
+// body is read no further than the results asked for.  Cancelling ctx
+// while Next waits ends the stream, and its error is returned from then
+// on.  A query error is returned as it is, and the results after it follow
+// on the next call.
+func (s *Stream) Next(ctx context.Context) (interface{}, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	if ctx.Done() != nil {
+		if err := ctx.Err(); err != nil {
+			return nil, s.fail(err)
+		}
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-ctx.Done():
+				// abort the fetch or read Next is blocked in
+				s.cancel()
+			case <-done:
+			}
+		}()
+	}
+	for {
+		if s.iter != nil {
+			if v, ok := s.iter.Next(); ok {
+				if err, ok := v.(error); ok {
+					return nil, err
+				}
+				return v, nil
+			}
+			s.iter = nil
+		}
+		v, err := s.value()
+		if ctx.Err() != nil {
+			return nil, s.fail(ctx.Err())
+		}
+		if err != nil {
+			return nil, s.fail(err)
+		}
+		if s.opts.Query == nil {
+			return v, nil
+		}
+		s.iter = s.opts.Query.Run(v)
+	}
+}
+
+// Close ends the stream, closing any body being read
+func (s *Stream) Close() error {
+	if s.err == nil {
+		s.fail(errors.New("jqurl: stream closed"))
+	}
+	return nil
+}
+
+// fail ends the stream with err
+func (s *Stream) fail(err error) error {
+	s.err = err
+	if s.resp != nil {
+		s.resp.Body.Close()
+		s.resp = nil
+	}
+	if s.cancel != nil {
+		s.cancel()
+	}
+	return err
+}
+
+// value reads the next value from the body, fetching the first page, the
+// pages after it and reconnecting as needed
+func (s *Stream) value() (interface{}, error) {
+	for {
+		if s.next == nil {
+			if err := s.open(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		v, err := s.next()
+		if err == nil {
+			return v, nil
+		}
+		if err != io.EOF && !(s.opts.Format == FormatEvents && s.opts.Reconnect && s.ctx.Err() == nil) {
+			return nil, err
+		}
+
+		// this body is done
+		resp := s.resp
+		resp.Body.Close()
+		s.resp, s.next = nil, nil
+		if s.opts.Format == FormatEvents && s.opts.Reconnect {
+			s.opts.Clock.Sleep(s.retry)
+			continue
+		}
+		if s.opts.NextPage == nil {
+			return nil, io.EOF
+		}
+		u, err := s.opts.NextPage(resp, s.page)
+		if err != nil {
+			return nil, err
+		}
+		if u == nil {
+			return nil, io.EOF
+		}
+		s.target = u.String()
+	}
+}
+
+// open fetches the next page, or reconnects to an event stream
+func (s *Stream) open() error {
+	opts := s.opts.Options
+	opts.Context = s.ctx
+	opts.Stream = s.opts.Format != FormatJSON
+	if s.target != "" {
+		opts.URLs = []string{s.target}
+	}
+	if s.opts.Format == FormatEvents {
+		opts.Headers = make(map[string]string, len(s.opts.Headers)+3)
+		for key, val := range s.opts.Headers {
+			opts.Headers[key] = val
+		}
+		opts.Headers["accept"] = "text/event-stream"
+		opts.Headers["cache-control"] = "no-cache"
+		if s.lastID != "" {
+			opts.Headers["last-event-id"] = s.lastID
+		}
+	}
+	res, err := Do(opts)
+	if err != nil {
+		return err
+	}
+	s.resp, s.page = res.Response, nil
+	s.target = res.URL
+
+	switch s.opts.Format {
+	case FormatJSON:
+		var v interface{}
+		if err := json.Unmarshal(res.Body, &v); err != nil {
+			return err
+		}
+		s.page = v
+		sent := false
+		s.next = func() (interface{}, error) {
+			if sent {
+				return nil, io.EOF
+			}
+			sent = true
+			return v, nil
+		}
+	case FormatJSONLines:
+		rdr := bufio.NewReader(res.Response.Body)
+		s.next = func() (interface{}, error) {
+			for {
+				line, err := rdr.ReadBytes('\n')
+				if len(strings.TrimSpace(string(line))) > 0 {
+					var v interface{}
+					if jerr := json.Unmarshal(line, &v); jerr != nil {
+						return nil, jerr
+					}
+					return v, nil
+				}
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+	case FormatArray:
+		s.next = arrayValues(res.Response.Body)
+	case FormatEvents:
+		if res.Response.StatusCode == http.StatusNoContent {
+			// the server asks not to reconnect
+			s.opts.Reconnect = false
+			s.next = func() (interface{}, error) { return nil, io.EOF }
+			return nil
+		}
+		if ct := res.Response.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/event-stream") {
+			return fmt.Errorf("%s answered with %q rather than text/event-stream", res.URL, ct)
+		}
+		events := NewEventReader(res.Response.Body)
+		events.LastID, events.Retry = s.lastID, s.retry
+		s.next = func() (interface{}, error) {
+			ev, err := events.Next()
+			s.lastID, s.retry = events.LastID, events.Retry
+			if err != nil {
+				return nil, err
+			}
+			var v interface{}
+			if json.Unmarshal([]byte(ev.Data), &v) != nil {
+				v = ev.Data
+			}
+			return v, nil
+		}
+	default:
+		return fmt.Errorf("jqurl: unknown stream format %d", s.opts.Format)
+	}
+	return nil
+}
+
+// arrayValues decodes the elements of a top-level array one at a time
+func arrayValues(body io.Reader) func() (interface{}, error) {
+	rdr := bufio.NewReader(body)
+	dec := json.NewDecoder(rdr)
+	started, whole := false, false
+	return func() (interface{}, error) {
+		if !started {
+			started = true
+			first, err := firstByte(rdr)
+			if err != nil {
+				return nil, err
+			}
+			if first != '[' {
+				whole = true
+				var v interface{}
+				if err := dec.Decode(&v); err != nil {
+					return nil, err
+				}
+				return v, nil
+			}
+			if _, err := dec.Token(); err != nil {
+				return nil, err
+			}
+		}
+		if whole {
+			return nil, io.EOF
+		}
+		if !dec.More() {
+			if _, err := dec.Token(); err != nil {
+				return nil, err
+			}
+			return nil, io.EOF
+		}
+		var v interface{}
+		if err := dec.Decode(&v); err != nil {
+			return nil, err
+		}
+		return v, nil
+	}
+}
+
+// firstByte peeks past any white space at the first byte of a body
+func firstByte(rdr *bufio.Reader) (byte, error) {
+	for {
+		b, err := rdr.Peek(1)
+		if err != nil {
+			return 0, err
+		}
+		switch b[0] {
+		case ' ', '\t', '\r', '\n':
+			rdr.ReadByte()
+		default:
+			return b[0], nil
+		}
+	}
+}
+
+// NextLink is a StreamOptions.NextPage following the rel="next" target of a
+// RFC 5988 Link header, resolved against the request URL
+func NextLink(resp *http.Response, page interface{}) (*url.URL, error) {
+	for _, link := range resp.Header.Values("Link") {
+		for _, entry := range strings.Split(link, ",") {
+			parts := strings.Split(entry, ";")
+			target := strings.Trim(strings.TrimSpace(parts[0]), "<>")
+			for _, p := range parts[1:] {
+				p = strings.TrimSpace(p)
+				if p == `rel="next"` || p == "rel=next" {
+					if u, err := resp.Request.URL.Parse(target); err == nil {
+						return u, nil
+					}
+				}
+			}
+		}
+	}
+	return nil, nil
+}
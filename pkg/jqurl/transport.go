@@ -0,0 +1,112 @@
+package jqurl
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// resolverTransports keeps the transport made for each resolver, so fetches
+// with the same one share its pool of connections.  It holds the latest
+// maxResolverTransports, one made per fetch would otherwise never be freed.
+var (
+	resolverMu         sync.Mutex
+	resolverTransports = map[resolverKey]*http.Transport{}
+	resolverOrder      []resolverKey
+)
+
+const maxResolverTransports = 16
+
+type resolverKey struct {
+	base     *http.Transport
+	resolver *net.Resolver
+}
+
+// NewTransport is http.DefaultTransport looking up host names with resolver,
+// such as one asking a service discovery agent rather than the system
+func NewTransport(resolver *net.Resolver) *http.Transport {
+	return withResolver(http.DefaultTransport.(*http.Transport), resolver)
+}
+
+// withResolver is a copy of base dialing with resolver.  A DialContext of
+// base's own, such as one through a tunnel or a unix socket, is kept and
+// given the addresses the resolver finds in place of the host name.
+func withResolver(base *http.Transport, resolver *net.Resolver) *http.Transport {
+	t := base.Clone()
+	dial := base.DialContext
+	if dial == nil {
+		t.DialContext = (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Resolver: resolver}).DialContext
+		return t
+	}
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || net.ParseIP(host) != nil {
+			return dial(ctx, network, addr)
+		}
+		addrs, err := resolver.LookupHost(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range addrs {
+			var conn net.Conn
+			if conn, err = dial(ctx, network, net.JoinHostPort(ip, port)); err == nil {
+				return conn, nil
+			}
+		}
+		return nil, err
+	}
+	return t
+}
+
+// resolverTransport is the shared copy of base dialing with resolver, the
+// oldest kept is dropped, with its idle connections, to make room
+func resolverTransport(base *http.Transport, resolver *net.Resolver) *http.Transport {
+	key := resolverKey{base: base, resolver: resolver}
+	resolverMu.Lock()
+	defer resolverMu.Unlock()
+	if t, ok := resolverTransports[key]; ok {
+		return t
+	}
+	if len(resolverOrder) >= maxResolverTransports {
+		old := resolverOrder[0]
+		resolverTransports[old].CloseIdleConnections()
+		delete(resolverTransports, old)
+		resolverOrder = resolverOrder[1:]
+	}
+	t := withResolver(base, resolver)
+	resolverTransports[key] = t
+	resolverOrder = append(resolverOrder, key)
+	return t
+}
+
+// fetchClient is the client a fetch uses, with the Options.Transport and
+// Options.Resolver put in place of those of the client
+func fetchClient(opts Options) (*http.Client, error) {
+	client := opts.Client
+	if client == nil {
+		client = &http.Client{CheckRedirect: RedirectPolicy{Follow: true}.CheckRedirect}
+	}
+	if opts.Transport == nil && opts.Resolver == nil {
+		return client, nil
+	}
+	rt := opts.Transport
+	if rt == nil {
+		rt = client.Transport
+	}
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	if opts.Resolver != nil {
+		base, ok := rt.(*http.Transport)
+		if !ok {
+			return nil, fmt.Errorf("jqurl: Resolver needs an *http.Transport, not a %T", rt)
+		}
+		rt = resolverTransport(base, opts.Resolver)
+	}
+	c := *client
+	c.Transport = rt
+	return &c, nil
+}
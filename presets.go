@@ -0,0 +1,147 @@
+package main
+
+import (
+	"net/url"
+	"os"
+	"strings"
+)
+
+var (
+	githubPreset, gitlabPreset, aqlPreset, nexusPreset bool
+
+	// baseURL is prefixed onto URL arguments given as a bare path
+	baseURL     string
+	baseURLFlag string
+
+	// presetTokens are the credentials a preset found in the environment,
+	// kept out of Headers so they only go to the API's host
+	presetTokens map[string]string
+)
+
+// firstEnv returns the first non-empty environment variable of the list
+func firstEnv(names ...string) string {
+	for _, name := range names {
+		if val := os.Getenv(name); val != "" {
+			return val
+		}
+	}
+	return ""
+}
+
+// applyPresets sets the base URL, auth and paging for the API presets, any
+// header given on the command line takes precedence
+func applyPresets() {
+	setDefault := func(key, val string) {
+		if _, ok := Headers[key]; !ok && val != "" {
+			Headers[key] = val
+		}
+	}
+	setToken := func(key, val string) {
+		if _, ok := Headers[key]; !ok && val != "" {
+			presetTokens = map[string]string{key: val}
+		}
+	}
+	switch {
+	case githubPreset:
+		baseURL = firstEnv("GITHUB_API_URL")
+		if baseURL == "" {
+			baseURL = "https://api.github.com"
+		}
+		setDefault("accept", "application/vnd.github+json")
+		setDefault("x-github-api-version", "2022-11-28")
+		if token := firstEnv("GITHUB_TOKEN", "GH_TOKEN"); token != "" {
+			setToken("authorization", "Bearer "+token)
+		}
+		followPages = true
+	case gitlabPreset:
+		baseURL = firstEnv("CI_API_V4_URL")
+		if baseURL == "" {
+			baseURL = "https://gitlab.com/api/v4"
+		}
+		if token := firstEnv("GITLAB_TOKEN", "GL_TOKEN"); token != "" {
+			setToken("private-token", token)
+		} else if token := os.Getenv("CI_JOB_TOKEN"); token != "" {
+			setToken("job-token", token)
+		}
+		followPages = true
+	case aqlPreset:
+		baseURL = os.Getenv("ARTIFACTORY_URL")
+		// an AQL search only reads, so the POST is safe to repeat
+		retryNonIdempotent = true
+		if token := os.Getenv("ARTIFACTORY_TOKEN"); token != "" {
+			setToken("authorization", "Bearer "+token)
+		} else if key := os.Getenv("ARTIFACTORY_API_KEY"); key != "" {
+			setToken("x-jfrog-art-api", key)
+		}
+		// AQL is posted as plain text, unless a content type was asked for
+		if _, ok := Headers["content-type"]; !ok {
+			Headers["content-type"] = "text/plain"
+		}
+		method = "POST"
+	case nexusPreset:
+		baseURL = os.Getenv("NEXUS_URL")
+		followPages = true
+	case imdsPreset:
+		// headers for every cloud are sent, so paths for several providers
+		// can be listed as alternatives
+		baseURL = imdsBase
+		Headers["metadata-flavor"] = "Google"
+		Headers["metadata"] = "true"
+	}
+	if baseURLFlag != "" {
+		baseURL = baseURLFlag
+	}
+	baseURL = strings.TrimSuffix(baseURL, "/")
+}
+
+// scopePresetTokens adds a header rule sending the preset's token to the
+// origin of the base URL, or when there is none to those of the URLs given,
+// so redirects, pages and --then requests elsewhere don't carry it.  A header
+// set with -H, --user and such since the preset was applied wins.
+func scopePresetTokens(urls []*url.URL) {
+	for key := range presetTokens {
+		if _, ok := Headers[key]; ok {
+			delete(presetTokens, key)
+		}
+	}
+	if len(presetTokens) == 0 {
+		return
+	}
+	if baseURL != "" {
+		if u, err := url.Parse(baseURL); err == nil {
+			urls = []*url.URL{u}
+		}
+	}
+	for _, u := range urls {
+		if u != nil && u.Hostname() != "" {
+			headerRules = append(headerRules, headerRule{Origin: u, Headers: presetTokens})
+		}
+	}
+	presetTokens = nil
+}
+
+// presetURL expands a bare path into a full URL and asks for the largest
+// page size the presets allow
+func presetURL(arg string) string {
+	if aqlPreset {
+		if u, err := url.Parse(arg); err == nil && !strings.HasSuffix(u.Path, "/api/search/aql") {
+			u.Path = strings.TrimSuffix(u.Path, "/") + "/api/search/aql"
+			arg = u.String()
+		}
+	}
+	if baseURL == "" || !strings.HasPrefix(arg, "/") {
+		return arg
+	}
+	arg = baseURL + arg
+	if imdsPreset {
+		return imdsURL(arg)
+	}
+	if (githubPreset || gitlabPreset) && !strings.Contains(arg, "per_page=") {
+		if strings.Contains(arg, "?") {
+			arg += "&per_page=100"
+		} else {
+			arg += "?per_page=100"
+		}
+	}
+	return arg
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/xhit/go-str2duration"
+)
+
+// prewarmJob is one entry of a prewarm jobs file
+type prewarmJob struct {
+	URLs    []string
+	MaxAge  time.Duration
+	Method  string
+	Data    string
+	Headers map[string]string
+}
+
+// loadJobs reads a YAML (or JSON) jobs file, either a list of jobs or an
+// object with a "jobs" list.  Each job has a "url" or "urls" list and may set
+// "max-age", "method", "data" and "headers".
+func loadJobs(file string) ([]prewarmJob, error) {
+	if err := checkRead(file); err != nil {
+		return nil, err
+	}
+	byt, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var doc interface{}
+	if err = json.Unmarshal(byt, &doc); err != nil {
+		if doc, err = yamlUnmarshal(byt); err != nil {
+			return nil, err
+		}
+	}
+	if obj, ok := doc.(map[string]interface{}); ok {
+		doc = obj["jobs"]
+	}
+	list, ok := doc.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected a list of jobs")
+	}
+
+	var jobs []prewarmJob
+	for n, entry := range list {
+		job := prewarmJob{MaxAge: maxAge, Method: method, Headers: map[string]string{}}
+		switch e := entry.(type) {
+		case string:
+			job.URLs = []string{e}
+		case map[string]interface{}:
+			if u, ok := e["url"].(string); ok {
+				job.URLs = append(job.URLs, u)
+			}
+			if us, ok := e["urls"].([]interface{}); ok {
+				for _, u := range us {
+					job.URLs = append(job.URLs, fmt.Sprint(u))
+				}
+			}
+			if age, ok := e["max-age"].(string); ok {
+				if job.MaxAge, err = str2duration.Str2Duration(age); err != nil {
+					return nil, fmt.Errorf("job %d: bad max-age %q: %s", n+1, age, err)
+				}
+			}
+			if m, ok := e["method"].(string); ok {
+				job.Method = strings.ToUpper(m)
+			}
+			if d, ok := e["data"].(string); ok {
+				job.Data = d
+			}
+			if hs, ok := e["headers"].(map[string]interface{}); ok {
+				for k, v := range hs {
+					job.Headers[strings.ToLower(k)] = fmt.Sprint(v)
+				}
+			}
+		}
+		if len(job.URLs) == 0 {
+			return nil, fmt.Errorf("job %d: no url given", n+1)
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+// prewarm fetches every job into the cache, skipping entries which are still
+// fresh, so interactive runs with -C find a warm cache
+func prewarm(file string) {
+	jobs, err := loadJobs(file)
+	if err != nil {
+		log.Fatalf("Error loading jobs file %q: %s", file, err)
+	}
+	var jobURLs []*url.URL
+	for _, job := range jobs {
+		for _, arg := range job.URLs {
+			if u, err := url.Parse(presetURL(fixIPv6Zone(arg))); err == nil {
+				jobURLs = append(jobURLs, u)
+			}
+		}
+	}
+	scopePresetTokens(jobURLs)
+	client := newClient()
+	defer closeBodies()
+	baseHeaders := Headers
+	failed := 0
+
+	for _, job := range jobs {
+		Args = make([]string, len(job.URLs))
+		urls = make([](*url.URL), len(job.URLs))
+		cacheFiles = make([]string, len(job.URLs))
+		fresh := false
+		for i, arg := range job.URLs {
+			Args[i] = presetURL(fixIPv6Zone(arg))
+			if urls[i], err = url.Parse(Args[i]); err != nil {
+				log.Fatalf("Malformed URL %q: %s", arg, err)
+			}
+			if err = idnURL(urls[i]); err != nil {
+				log.Fatalf("Bad host name: %s", err)
+			}
+			Args[i] = urls[i].String()
+			cacheFiles[i] = cacheFileName(Args[i])
+			if stat, err := os.Stat(cacheFiles[i]); err == nil && !flush && since(stat.ModTime()) < job.MaxAge {
+				fresh = true
+			}
+		}
+		if fresh {
+			if debug {
+				log.Println("cache still fresh for", Args[0])
+			}
+			continue
+		}
+
+		Headers = make(map[string]string)
+		for k, v := range baseHeaders {
+			Headers[k] = v
+		}
+		for k, v := range job.Headers {
+			Headers[k] = v
+		}
+		if err := validateRequest(job.Method, Headers, Args); err != nil {
+			fmt.Fprintf(os.Stderr, "Refusing to prewarm %s: %s\n", strings.Join(Args, " "), err)
+			failed++
+			continue
+		}
+		method, postData, useCache, dat = job.Method, job.Data, true, nil
+		fetchURLs(client)
+		if dat == nil {
+			fmt.Fprintf(os.Stderr, "Unable to prewarm %s\n", strings.Join(Args, " "))
+			failed++
+		} else if debug {
+			log.Println("prewarmed", Args[0])
+		}
+	}
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+var (
+	heartbeat    time.Duration
+	progressJSON bool
+)
+
+// reportProgress writes the state of the retry loop to stderr, as a JSON
+// line with --progress-json or as a human readable line with --heartbeat
+func reportProgress(attempt int, target string, lastErr error, next time.Time) {
+	errStr := ""
+	if lastErr != nil {
+		errStr = lastErr.Error()
+	}
+	if progressJSON {
+		byt, _ := json.Marshal(map[string]interface{}{
+			"attempt":    attempt,
+			"max_tries":  maxTries,
+			"url":        target,
+			"error":      errStr,
+			"next_retry": next.Format(time.RFC3339),
+		})
+		fmt.Fprintf(os.Stderr, "%s\n", byt)
+	} else if heartbeat > 0 {
+		fmt.Fprintf(os.Stderr, "jqurl: attempt %d/%d to %s failed: %s, next try at %s\n",
+			attempt, maxTries, target, errStr, next.Format("15:04:05"))
+	}
+}
+
+// retryWait reports a failed attempt and sleeps until the next one, repeating
+// the report every heartbeat interval while waiting
+func retryWait(attempt int, target string, lastErr error, wait time.Duration) {
+	next := clock.Now().Add(wait)
+	reportProgress(attempt, target, lastErr, next)
+	for heartbeat > 0 && next.Sub(clock.Now()) > heartbeat {
+		clock.Sleep(heartbeat)
+		reportProgress(attempt, target, lastErr, next)
+	}
+	clock.Sleep(next.Sub(clock.Now()))
+}
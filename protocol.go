@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+var http11, http2, http2PriorKnowledge bool
+
+// applyProtocols pins the HTTP version of the transport to the one asked
+// for, where the default is HTTP/2 when the server offers it over TLS and
+// HTTP/1.1 otherwise
+func applyProtocols(transport *http.Transport) error {
+	n := 0
+	for _, set := range []bool{http11, http2, http2PriorKnowledge} {
+		if set {
+			n++
+		}
+	}
+	if n > 1 {
+		return fmt.Errorf("use only one of --http1.1, --http2 and --http2-prior-knowledge")
+	}
+	p := new(http.Protocols)
+	switch {
+	case http11:
+		p.SetHTTP1(true)
+	case http2:
+		// plain http:// URLs stay on HTTP/1.1, there being no ALPN to agree
+		// on HTTP/2 without TLS
+		p.SetHTTP2(true)
+	case http2PriorKnowledge:
+		// h2c for http:// URLs, without an Upgrade from HTTP/1.1 first
+		p.SetHTTP2(true)
+		p.SetUnencryptedHTTP2(true)
+	default:
+		return nil
+	}
+	transport.Protocols = p
+	return nil
+}
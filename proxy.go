@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+var (
+	proxyURL string
+	noProxy  string
+)
+
+// firstEnvOf returns the first of the variables which is set, upper case
+// names are checked before lower case ones
+func firstEnvOf(names ...string) string {
+	for _, n := range names {
+		for _, name := range []string{strings.ToUpper(n), strings.ToLower(n)} {
+			if v := os.Getenv(name); v != "" {
+				return v
+			}
+		}
+	}
+	return ""
+}
+
+// parseProxy reads a proxy address, http:// is assumed when no scheme is
+// given and socks5h:// is taken as socks5://, which lets the proxy resolve
+// host names
+func parseProxy(s string) (*url.URL, error) {
+	if !strings.Contains(s, "://") {
+		s = "http://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	case "socks5h":
+		u.Scheme = "socks5"
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+	}
+	return u, nil
+}
+
+// proxyFunc picks the proxy for each request.  --proxy is used for every
+// request, otherwise HTTPS_PROXY, HTTP_PROXY and ALL_PROXY are used as curl
+// does, skipping loopback hosts.  --noproxy, or else NO_PROXY, lists hosts to
+// reach directly.
+func proxyFunc() (func(*http.Request) (*url.URL, error), error) {
+	var fixed *url.URL
+	if proxyURL != "" {
+		var err error
+		if fixed, err = parseProxy(proxyURL); err != nil {
+			return nil, fmt.Errorf("--proxy %q: %s", proxyURL, err)
+		}
+	}
+	skip := noProxy
+	if skip == "" {
+		skip = firstEnvOf("NO_PROXY")
+	}
+	return func(req *http.Request) (*url.URL, error) {
+		if bypassProxy(skip, req.URL) {
+			return nil, nil
+		}
+		if fixed != nil {
+			return fixed, nil
+		}
+		if isLoopback(req.URL.Hostname()) {
+			return nil, nil
+		}
+		var env string
+		if req.URL.Scheme == "https" {
+			env = firstEnvOf("HTTPS_PROXY")
+		} else if env = os.Getenv("http_proxy"); env == "" && os.Getenv("REQUEST_METHOD") == "" {
+			// under CGI HTTP_PROXY can come from a request's Proxy: header
+			env = os.Getenv("HTTP_PROXY")
+		}
+		if env == "" {
+			env = firstEnvOf("ALL_PROXY")
+		}
+		if env == "" {
+			return nil, nil
+		}
+		return parseProxy(env)
+	}, nil
+}
+
+// isLoopback reports if a host is localhost or a loopback address, which
+// proxies from the environment are not used for
+func isLoopback(host string) bool {
+	if strings.EqualFold(host, "localhost") || strings.HasSuffix(strings.ToLower(host), ".localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// bypassProxy matches a URL against a NO_PROXY style list of host names,
+// domains (a leading dot is optional), IP addresses, CIDR ranges, each with
+// an optional :port, or "*" for everything
+func bypassProxy(list string, u *url.URL) bool {
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	port := u.Port()
+	ip := net.ParseIP(host)
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if entry == "*" {
+			return true
+		}
+		if h, p, err := net.SplitHostPort(entry); err == nil {
+			if p != port {
+				continue
+			}
+			entry = h
+		}
+		entry = strings.Trim(entry, "[]")
+		if _, cidr, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && cidr.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if eip := net.ParseIP(entry); eip != nil {
+			if ip != nil && eip.Equal(ip) {
+				return true
+			}
+			continue
+		}
+		entry = strings.TrimPrefix(entry, "*")
+		entry = strings.TrimPrefix(entry, ".")
+		if host == entry || strings.HasSuffix(host, "."+entry) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+)
+
+var (
+	purgeToken    string
+	purgeOnSignal string
+
+	// servePurged has the data fetched again whatever its age, until that
+	// succeeds
+	servePurged bool
+)
+
+// loadPurgeToken reads a --purge-token given as @FILE, or from
+// $JQURL_PURGE_TOKEN, so it needn't show in ps
+func loadPurgeToken() error {
+	if purgeToken == "" {
+		purgeToken = os.Getenv("JQURL_PURGE_TOKEN")
+	}
+	if strings.HasPrefix(purgeToken, "@") {
+		if err := checkRead(purgeToken[1:]); err != nil {
+			return err
+		}
+		byt, err := ioutil.ReadFile(purgeToken[1:])
+		if err != nil {
+			return err
+		}
+		purgeToken = strings.TrimSpace(string(byt))
+		if purgeToken == "" {
+			return fmt.Errorf("empty --purge-token file")
+		}
+	}
+	return nil
+}
+
+// purgeServed forgets the served data and the cached copies of the URLs, so
+// they are fetched afresh, and starts that fetch.  On failure the old data is
+// still served, as with any refresh.
+func purgeServed(client *http.Client, why string) {
+	serveMu.Lock()
+	servePurged = true
+	if useCache {
+		for _, file := range cacheFiles {
+			os.Remove(file)
+			os.Remove(file + ".meta")
+		}
+	}
+	serveMu.Unlock()
+	serveLog(prioInfo, "Cache purged by %s", why)
+
+	go func() {
+		serveMu.Lock()
+		defer serveMu.Unlock()
+		refreshServed(client)
+	}()
+}
+
+// servePurge answers POST /purge carrying the --purge-token as a bearer token
+func servePurge(w http.ResponseWriter, r *http.Request, client *http.Client) int {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return http.StatusMethodNotAllowed
+	}
+	// a bare token is refused, the scheme's name is in any case (RFC 7235)
+	auth := r.Header.Get("Authorization")
+	token := ""
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		token = auth[7:]
+	}
+	if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(purgeToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="jqurl"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return http.StatusUnauthorized
+	}
+	purgeServed(client, "/purge from "+r.RemoteAddr)
+	w.WriteHeader(http.StatusAccepted)
+	return http.StatusAccepted
+}
+
+// watchPurgeSignal purges on --purge-on-signal, such as SIGHUP
+func watchPurgeSignal(client *http.Client) error {
+	if purgeOnSignal == "" {
+		return nil
+	}
+	name := strings.TrimPrefix(strings.ToUpper(purgeOnSignal), "SIG")
+	sig, ok := purgeSignals[name]
+	if !ok {
+		return fmt.Errorf("unsupported signal %q for --purge-on-signal", purgeOnSignal)
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sig)
+	go func() {
+		for range ch {
+			purgeServed(client, "SIG"+name)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+var (
+	rawBody bool
+	noJQ    bool
+)
+
+// checkRawBody makes sure a --raw-body run has nothing to do with the body
+// but write it out
+func checkRawBody() {
+	if !rawBody {
+		return
+	}
+	if strings.TrimSpace(JQString) != "." {
+		log.Fatalf("--raw-body writes the body as it is, give the query . or use --no-jq rather than %q", JQString)
+	}
+	if fetchAllURLs || serveAddr != "" || watchInterval > 0 || jsonLines || sseMode || arrayStream ||
+		followPages || len(thenURLs) > 0 || mapExec != "" || splitBy != "" {
+		log.Fatal("--raw-body can't be used with --all, --serve, --watch, streaming, paging, --then, --map-exec or --split-by")
+	}
+	// the body may be an artifact of any size, so it is never held whole
+	useCache = false
+}
+
+// writeRawBody streams the body of the first URL to answer to the output
+// without parsing it, as curl -o does, for binaries and other files which
+// are not JSON
+func writeRawBody(client *http.Client) {
+	opts := fetchOptions(client)
+	opts.Stream = true
+	verifyOptions(&opts)
+	res, err := fetchDo(opts)
+	failExit(err)
+	if err != nil {
+		log.Fatalf("Error fetching: %s", err)
+	}
+	body := res.Response.Body
+	defer body.Close()
+
+	output = dataOut
+	if name := outputPath(); name != "" {
+		f, err := createOutput(name)
+		if err != nil {
+			log.Fatalf("Error creating output file: %s", err)
+		}
+		output = f
+	}
+	if _, err := io.Copy(output, saveStream(body)); err != nil {
+		verifyExit(err)
+		log.Fatalf("Error writing body of %s: %s", res.URL, err)
+	}
+	keepTrailers(res.Response)
+	finishQuery()
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"log"
+
+	"github.com/itchyny/gojq"
+)
+
+var (
+	reduceExpr string
+	reduceCode *gojq.Code
+	reduceAcc  interface{}
+	reduced    bool
+)
+
+// reduceResult folds a query result into the --reduce accumulator, the
+// expression runs on the accumulator (null at first) with the result as
+// $item, so with paging only the running total is held rather than every
+// page
+func reduceResult(v interface{}) {
+	if reduceCode == nil {
+		var err error
+		if reduceCode, err = compileJQ(reduceExpr, "$item"); err != nil {
+			log.Fatalf("Error in --reduce: %s", err)
+		}
+	}
+	acc, ok := runJQ(reduceCode, reduceAcc, v).Next()
+	if !ok {
+		acc = nil
+	}
+	if err, ok := acc.(error); ok {
+		log.Fatalf("Error running --reduce %q: %s", reduceExpr, err)
+	}
+	reduceAcc, reduced = acc, true
+}
+
+// flushReduce writes out the --reduce accumulator once all input is in
+func flushReduce() {
+	if reduceExpr == "" || !reduced {
+		return
+	}
+	emitResult(reduceAcc)
+	reduced = false
+}
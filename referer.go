@@ -0,0 +1,38 @@
+package main
+
+import (
+	"log"
+	"net/url"
+	"strings"
+)
+
+var (
+	referer     string
+	autoReferer bool
+	origin      string
+)
+
+// applyReferer sets the Referer and Origin headers from -e and --origin.  A
+// referer ending in ";auto" (or just ";auto") also sets the Referer of each
+// redirect to the URL redirected from, as curl does.
+func applyReferer() {
+	if strings.HasSuffix(referer, ";auto") {
+		autoReferer = true
+		referer = strings.TrimSuffix(referer, ";auto")
+	}
+	if referer != "" {
+		if _, ok := Headers["referer"]; !ok {
+			Headers["referer"] = referer
+		}
+	}
+	if origin != "" {
+		// an Origin is only the scheme, host and port
+		u, err := url.Parse(origin)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			log.Fatalf("Invalid origin %q, use scheme://host[:port]", origin)
+		}
+		if _, ok := Headers["origin"]; !ok {
+			Headers["origin"] = u.Scheme + "://" + u.Host
+		}
+	}
+}
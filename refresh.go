@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/pschou/jqURL/pkg/jqurl"
+)
+
+// refreshEnv marks the detached process which finishes a slow cache refresh
+const refreshEnv = "JQURL_BACKGROUND_REFRESH"
+
+var (
+	refreshTimeout time.Duration
+	refreshChild   bool
+	staleDat       interface{}
+)
+
+// refreshOrStale waits up to --refresh-timeout for fresh data, after which
+// the expired cache entry is used and the refresh is handed off to a detached
+// copy of this process so the cache is up to date for the next run
+func refreshOrStale(client *http.Client) interface{} {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		fetchURLsContext(ctx, client)
+		close(done)
+	}()
+	select {
+	case <-done:
+		if dat != nil {
+			return dat
+		}
+		return staleDat
+	case <-time.After(refreshTimeout):
+	}
+	// stop the refresh before the stale data is used, so nothing it does
+	// runs along with the query
+	cancel()
+	<-done
+	if dat != nil {
+		// it finished as it was stopped
+		return dat
+	}
+	if debug {
+		log.Println("refresh timed out, using stale cache")
+	}
+	if !jqurl.Idempotent(method, Headers) {
+		// refreshing in the background would send the request again
+		return staleDat
+	}
+	exe, err := os.Executable()
+	if err == nil {
+		cmd := exec.Command(exe, os.Args[1:]...)
+		cmd.Env = append(os.Environ(), refreshEnv+"=1")
+		err = cmd.Start()
+	}
+	if err != nil && debug {
+		log.Println("unable to start background refresh:", err)
+	}
+	return staleDat
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pschou/jqURL/pkg/jqurl"
+)
+
+var (
+	retryBackoff      bool
+	retryMaxDelay     time.Duration
+	retryOn           string
+	retryCheck        func(resp *http.Response, err error) bool
+	retryPolicyScript string
+	retryPolicy       jqurl.RetryPolicy
+)
+
+// retryOnFunc turns the --retry-on list into the check of which failures
+// are tried again.  The list holds status codes, classes such as 5xx, and
+// "conn" for connection errors, "timeout" for timed out tries and "invalid"
+// for successful replies which are not JSON.  An empty list retries every
+// failure.
+func retryOnFunc() (func(resp *http.Response, err error) bool, error) {
+	if retryOn == "" {
+		return nil, nil
+	}
+	codes := map[int]bool{}
+	classes := map[int]bool{}
+	var conn, timeouts, invalid bool
+	for _, item := range strings.Split(retryOn, ",") {
+		switch item = strings.ToLower(strings.TrimSpace(item)); {
+		case item == "":
+		case item == "conn":
+			conn = true
+		case item == "timeout":
+			timeouts = true
+		case item == "invalid":
+			invalid = true
+		case len(item) == 3 && strings.HasSuffix(item, "xx") && item[0] >= '1' && item[0] <= '5':
+			classes[int(item[0]-'0')] = true
+		default:
+			code, err := strconv.Atoi(item)
+			if err != nil || code < 100 || code > 599 {
+				return nil, fmt.Errorf("unknown --retry-on entry %q, use status codes, 4xx, 5xx, conn, timeout or invalid", item)
+			}
+			codes[code] = true
+		}
+	}
+	return func(resp *http.Response, err error) bool {
+		if resp != nil {
+			if resp.StatusCode/100 == 2 {
+				return invalid
+			}
+			return codes[resp.StatusCode] || classes[resp.StatusCode/100]
+		}
+		var netErr net.Error
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) ||
+			errors.As(err, &netErr) && netErr.Timeout() {
+			return timeouts
+		}
+		var opErr *net.OpError
+		if errors.As(err, &opErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return conn
+		}
+		return false
+	}, nil
+}
+
+// retryFailure is what --retry-policy-script is given on stdin about a
+// failed try
+type retryFailure struct {
+	Tries   int               `json:"tries"`
+	Method  string            `json:"method"`
+	URL     string            `json:"url,omitempty"`
+	Status  int               `json:"status,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Error   string            `json:"error"`
+}
+
+// retryDecision is what the script answers on stdout, the delay being a
+// duration such as "1.5s" or a number of seconds
+type retryDecision struct {
+	Retry bool            `json:"retry"`
+	Delay json.RawMessage `json:"delay"`
+}
+
+// scriptRetryPolicy runs the --retry-policy-script after each failed try to
+// decide if there is another and how long to wait for it.  The command line
+// is split on spaces and run directly, not through a shell.  A script which
+// fails or answers with something else than a decision ends the retries.
+func scriptRetryPolicy() jqurl.RetryPolicy {
+	args := strings.Fields(retryPolicyScript)
+	if len(args) == 0 {
+		return nil
+	}
+	return jqurl.RetryPolicyFunc(func(tries int, resp *http.Response, err error) (bool, time.Duration) {
+		if errors.Is(err, errEncoding) || errors.Is(err, errBodyTooLarge) || errors.Is(err, errVerify) ||
+			errors.Is(err, errOffline) {
+			return false, 0
+		}
+		f := retryFailure{Tries: tries, Method: method, Error: err.Error()}
+		var urlErr *url.Error
+		if resp != nil {
+			f.Status = resp.StatusCode
+			f.Headers = make(map[string]string)
+			for key, vals := range resp.Header {
+				f.Headers[strings.ToLower(key)] = strings.Join(vals, ", ")
+			}
+			if resp.Request != nil {
+				f.URL = resp.Request.URL.String()
+			}
+		} else if errors.As(err, &urlErr) {
+			f.URL = urlErr.URL
+		}
+		in, _ := json.Marshal(f)
+
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Stdin = bytes.NewReader(in)
+		cmd.Stderr = os.Stderr
+		out, cmdErr := cmd.Output()
+		if cmdErr != nil {
+			fmt.Fprintf(os.Stderr, "Retry policy script %q: %s, not retrying\n", args[0], cmdErr)
+			return false, 0
+		}
+		var d retryDecision
+		if cmdErr = json.Unmarshal(out, &d); cmdErr != nil {
+			fmt.Fprintf(os.Stderr, "Retry policy script %q answered %q, not retrying\n", args[0], strings.TrimSpace(string(out)))
+			return false, 0
+		}
+		if !d.Retry {
+			return false, 0
+		}
+		wait, cmdErr := decisionDelay(d.Delay)
+		if cmdErr != nil {
+			fmt.Fprintf(os.Stderr, "Retry policy script %q: %s, not retrying\n", args[0], cmdErr)
+			return false, 0
+		}
+		if retryMaxDelay > 0 && wait > retryMaxDelay {
+			wait = retryMaxDelay
+		}
+		return true, wait
+	})
+}
+
+// decisionDelay reads the delay of a retry decision, none when left out
+func decisionDelay(raw json.RawMessage) (time.Duration, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return 0, nil
+	}
+	var secs float64
+	if json.Unmarshal(raw, &secs) == nil {
+		if secs < 0 {
+			return 0, fmt.Errorf("negative delay %v", secs)
+		}
+		return time.Duration(secs * float64(time.Second)), nil
+	}
+	var str string
+	if err := json.Unmarshal(raw, &str); err != nil {
+		return 0, fmt.Errorf("delay %s is neither a duration nor seconds", raw)
+	}
+	if _, err := strconv.ParseFloat(str, 64); err == nil {
+		// seconds as a string, as when passing on a header value
+		str += "s"
+	}
+	d, err := time.ParseDuration(str)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid delay %q", str)
+	}
+	return d, nil
+}
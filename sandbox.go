@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var readAllow, writeAllow []string
+
+// realPath makes a path absolute with its symlinks resolved, as far as it
+// exists, so a link can't lead outside an allowed directory
+func realPath(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	rest := ""
+	for {
+		if real, err := filepath.EvalSymlinks(abs); err == nil {
+			return filepath.Join(real, rest)
+		}
+		parent := filepath.Dir(abs)
+		if parent == abs {
+			return filepath.Join(abs, rest)
+		}
+		rest = filepath.Join(filepath.Base(abs), rest)
+		abs = parent
+	}
+}
+
+// pathIn reports whether a path is one of, or under one of, the allowed paths
+func pathIn(allowed []string, path string) bool {
+	real := realPath(path)
+	for _, dir := range allowed {
+		rel, err := filepath.Rel(realPath(dir), real)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRead refuses a file outside --read-allow, when given.  What may be
+// written may be read back too.
+func checkRead(path string) error {
+	if len(readAllow) == 0 && len(writeAllow) == 0 || path == "-" {
+		return nil
+	}
+	if !pathIn(readAllow, path) && !pathIn(writeAllow, path) {
+		return fmt.Errorf("reading %q is not allowed by --read-allow", path)
+	}
+	return nil
+}
+
+// checkWrite refuses a file outside --write-allow, when given
+func checkWrite(path string) error {
+	if len(writeAllow) == 0 && len(readAllow) == 0 || path == "-" {
+		return nil
+	}
+	if !pathIn(writeAllow, path) {
+		return fmt.Errorf("writing %q is not allowed by --write-allow", path)
+	}
+	return nil
+}
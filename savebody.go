@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+)
+
+var (
+	saveBody string
+
+	saveMu   sync.Mutex
+	saveFile *os.File
+
+	// rawBodies are the bodies as received, before --input or --body-filter
+	// turned them into JSON, by response
+	rawBodies sync.Map
+)
+
+// rawBodyFilter notes each body as received before passing it on to filter
+func rawBodyFilter(filter func(*http.Response, []byte) ([]byte, error)) func(*http.Response, []byte) ([]byte, error) {
+	return func(resp *http.Response, body []byte) ([]byte, error) {
+		rawBodies.Store(resp, body)
+		return filter(resp, body)
+	}
+}
+
+// saveFileWriter opens the --save-body file on first use, so a failed fetch
+// leaves none behind
+func saveFileWriter() io.Writer {
+	if saveFile == nil {
+		f, err := createOutput(saveBody)
+		if err != nil {
+			log.Fatalf("Error creating --save-body file: %s", err)
+		}
+		saveFile = f
+	}
+	return saveFile
+}
+
+// saveResponseBody writes the body which answered to --save-body, as it was
+// received when known.  Several bodies, as with --all, follow one another.
+func saveResponseBody(resp *http.Response, byt []byte) {
+	if saveBody == "" {
+		return
+	}
+	if resp != nil {
+		if raw, ok := rawBodies.Load(resp); ok {
+			byt = raw.([]byte)
+			rawBodies.Delete(resp)
+		}
+	}
+	saveMu.Lock()
+	defer saveMu.Unlock()
+	if _, err := saveFileWriter().Write(byt); err != nil {
+		log.Fatalf("Error writing --save-body file: %s", err)
+	}
+}
+
+// saveStream copies a streamed body to --save-body as it is read
+func saveStream(body io.Reader) io.Reader {
+	if saveBody == "" {
+		return body
+	}
+	return io.TeeReader(body, saveFileWriter())
+}
+
+// closeSaveBody flushes the --save-body file to disk
+func closeSaveBody() {
+	if saveFile == nil {
+		return
+	}
+	if err := saveFile.Close(); err != nil {
+		log.Fatalf("Error closing --save-body file: %s", err)
+	}
+	saveFile = nil
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+var (
+	// updateReleases is the GitHub releases API of the repository
+	// self-update installs from, forks and mirrors set their own with
+	// -ldflags "-X main.updateReleases=..."
+	updateReleases = "https://api.github.com/repos/pschou/jqURL/releases"
+
+	// updateKey is the signify public key, base64, the checksums of a
+	// release must be signed with, set at build time with
+	// -ldflags "-X main.updateKey=..."
+	updateKey = ""
+
+	// unsignedUpdate lets a build without an update key self-update anyway
+	unsignedUpdate bool
+)
+
+// ghRelease is what self-update reads of a GitHub release
+type ghRelease struct {
+	TagName string `json:"tag_name"`
+	Assets  []struct {
+		Name string `json:"name"`
+		URL  string `json:"browser_download_url"`
+	} `json:"assets"`
+}
+
+// selfUpdate handles "self-update [TAG]", replacing the running binary with
+// the build of the latest, or the given, release for this system
+func selfUpdate(args []string) {
+	if len(args) > 1 {
+		log.Fatal("Usage: self-update [TAG]")
+	}
+	if updateKey == "" && !unsignedUpdate {
+		// the checksums come from the same place as the binary, so alone
+		// they only catch a broken download
+		log.Fatal("This build has no update key to verify releases with, use --unsigned-update to install one checked against its checksums only")
+	}
+	// release downloads redirect to a storage host
+	followRedirects = true
+	client := newClient()
+
+	target := updateReleases + "/latest"
+	if len(args) == 1 {
+		target = updateReleases + "/tags/" + args[0]
+	}
+	byt, err := updateFetch(client, target, "application/vnd.github+json")
+	if err != nil {
+		log.Fatalf("Error looking up the release: %s", err)
+	}
+	var rel ghRelease
+	if err = json.Unmarshal(byt, &rel); err != nil {
+		log.Fatalf("Error reading the release: %s", err)
+	}
+	if strings.TrimPrefix(rel.TagName, "v") == strings.TrimPrefix(version, "v") {
+		fmt.Fprintf(os.Stderr, "jqurl %s is the latest release\n", version)
+		return
+	}
+
+	assets := map[string]string{}
+	var binName, sumsName string
+	for _, a := range rel.Assets {
+		assets[a.Name] = a.URL
+		if updateAssetFor(a.Name) && binName == "" {
+			binName = a.Name
+		}
+		switch strings.ToLower(a.Name) {
+		case "sha256sums", "sha256sums.txt", "checksums.txt":
+			sumsName = a.Name
+		}
+	}
+	if binName == "" {
+		log.Fatalf("Release %s has no build for %s/%s", rel.TagName, runtime.GOOS, runtime.GOARCH)
+	}
+	if sumsName == "" {
+		if _, ok := assets[binName+".sha256"]; !ok {
+			log.Fatalf("Release %s has no checksums to verify %s with", rel.TagName, binName)
+		}
+		sumsName = binName + ".sha256"
+	}
+
+	sums, err := updateFetch(client, assets[sumsName], "application/octet-stream")
+	if err != nil {
+		log.Fatalf("Error fetching %s: %s", sumsName, err)
+	}
+	if updateKey != "" {
+		sigURL, ok := assets[sumsName+".sig"]
+		if !ok {
+			log.Fatalf("Release %s has no signature %s.sig", rel.TagName, sumsName)
+		}
+		sig, err := updateFetch(client, sigURL, "application/octet-stream")
+		if err == nil {
+			err = verifySignify(updateKey, sums, sig)
+		}
+		if err != nil {
+			log.Fatalf("Error verifying the signature of %s: %s", sumsName, err)
+		}
+	} else {
+		fmt.Fprintln(os.Stderr, "Warning: --unsigned-update, checking the download against the release checksums only")
+	}
+	want, err := checksumFor(sums, binName)
+	if err != nil {
+		log.Fatalf("Error reading %s: %s", sumsName, err)
+	}
+
+	fmt.Fprintf(os.Stderr, "Downloading %s %s\n", rel.TagName, binName)
+	bin, err := updateFetch(client, assets[binName], "application/octet-stream")
+	if err != nil {
+		log.Fatalf("Error fetching %s: %s", binName, err)
+	}
+	if sum := sha256.Sum256(bin); !bytes.Equal(sum[:], want) {
+		log.Fatalf("SHA-256 of %s is %x rather than %x, not installing it", binName, sum, want)
+	}
+	if bin, err = unpackUpdate(binName, bin); err != nil {
+		log.Fatalf("Error unpacking %s: %s", binName, err)
+	}
+	exe, err := os.Executable()
+	if err == nil {
+		exe, err = filepath.EvalSymlinks(exe)
+	}
+	if err == nil {
+		err = replaceExecutable(exe, bin)
+	}
+	if err != nil {
+		log.Fatalf("Error installing %s: %s", rel.TagName, err)
+	}
+	fmt.Fprintf(os.Stderr, "Updated %s from %s to %s\n", exe, version, rel.TagName)
+}
+
+// updateFetch gets a release file with the usual retries, proxy and CA
+// settings, as any file rather than as JSON
+func updateFetch(client *http.Client, target, accept string) ([]byte, error) {
+	opts := fetchOptions(client)
+	opts.URLs, opts.Method, opts.Body, opts.Stream = []string{target}, "GET", nil, true
+	delete(opts.Headers, "content-type")
+	opts.Headers["accept"] = accept
+	if token := os.Getenv("GITHUB_TOKEN"); token != "" && strings.HasPrefix(target, "https://api.github.com/") {
+		// a token's rate limit is far higher than an address's
+		opts.Headers["authorization"] = "Bearer " + token
+	}
+	res, err := fetchDo(opts)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Response.Body.Close()
+	return ioutil.ReadAll(res.Response.Body)
+}
+
+// updateAssetFor tells if a release file is the build for this system,
+// named with the OS and architecture as Go or uname calls them
+func updateAssetFor(name string) bool {
+	name = strings.ToLower(name)
+	for _, ext := range []string{".sha256", ".sig", ".asc", ".txt", ".sbom", ".json"} {
+		if strings.HasSuffix(name, ext) {
+			return false
+		}
+	}
+	arches := map[string][]string{
+		"amd64": {"amd64", "x86_64"},
+		"arm64": {"arm64", "aarch64"},
+		"386":   {"386", "i386"},
+	}[runtime.GOARCH]
+	if arches == nil {
+		arches = []string{runtime.GOARCH}
+	}
+	if !strings.Contains(name, runtime.GOOS) {
+		return false
+	}
+	for _, arch := range arches {
+		if strings.Contains(name, arch) {
+			return true
+		}
+	}
+	return false
+}
+
+// checksumFor finds a file's hash in a checksum list, in either the
+// sha256sum "HEX  NAME" or the BSD "SHA256 (NAME) = HEX" form
+func checksumFor(sums []byte, name string) ([]byte, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(sums))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		var hexSum, file string
+		if strings.HasPrefix(line, "SHA256 (") {
+			if i := strings.LastIndex(line, ") = "); i > 0 {
+				file, hexSum = line[len("SHA256 ("):i], line[i+len(") = "):]
+			}
+		} else if fields := strings.Fields(line); len(fields) == 1 {
+			// a NAME.sha256 file may hold just the hash
+			hexSum, file = fields[0], name
+		} else if len(fields) == 2 {
+			hexSum, file = fields[0], strings.TrimPrefix(fields[1], "*")
+		}
+		if file != name {
+			continue
+		}
+		sum, err := hex.DecodeString(hexSum)
+		if err != nil || len(sum) != sha256.Size {
+			return nil, fmt.Errorf("bad hash %q for %s", hexSum, name)
+		}
+		return sum, nil
+	}
+	return nil, fmt.Errorf("no hash for %s", name)
+}
+
+// verifySignify checks a detached signify signature, as made by OpenBSD's
+// signify or minisign -l: base64 of "Ed", the 8 byte key number and the
+// Ed25519 key or signature, after an untrusted comment line
+func verifySignify(pubKey string, msg, sig []byte) error {
+	key, err := base64.StdEncoding.DecodeString(signifyData([]byte(pubKey)))
+	if err != nil || len(key) != 2+8+ed25519.PublicKeySize || string(key[:2]) != "Ed" {
+		return fmt.Errorf("bad update key")
+	}
+	raw, err := base64.StdEncoding.DecodeString(signifyData(sig))
+	if err != nil || len(raw) != 2+8+ed25519.SignatureSize || string(raw[:2]) != "Ed" {
+		return fmt.Errorf("malformed signature")
+	}
+	if !bytes.Equal(raw[2:10], key[2:10]) {
+		return fmt.Errorf("signed with key %x, not the update key %x", raw[2:10], key[2:10])
+	}
+	if !ed25519.Verify(ed25519.PublicKey(key[10:]), msg, raw[10:]) {
+		return fmt.Errorf("signature does not match")
+	}
+	return nil
+}
+
+// signifyData is the base64 line of a key or signature file, the first
+// after the untrusted comment
+func signifyData(byt []byte) string {
+	for _, line := range strings.Split(string(byt), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "untrusted comment:") {
+			return line
+		}
+	}
+	return ""
+}
+
+// unpackUpdate takes the binary out of a .gz or .tar.gz release file, a
+// plain binary is taken as it is
+func unpackUpdate(name string, byt []byte) ([]byte, error) {
+	lower := strings.ToLower(name)
+	if !strings.HasSuffix(lower, ".gz") && !strings.HasSuffix(lower, ".tgz") {
+		return byt, nil
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(byt))
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(lower, ".tar.gz") && !strings.HasSuffix(lower, ".tgz") {
+		return ioutil.ReadAll(zr)
+	}
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("no jqurl binary in the archive")
+		} else if err != nil {
+			return nil, err
+		}
+		if base := path.Base(hdr.Name); hdr.Typeflag == tar.TypeReg && (base == "jqurl" || base == "jqurl.exe") {
+			return ioutil.ReadAll(tr)
+		}
+	}
+}
+
+// replaceExecutable swaps in the new binary with a rename, so the path
+// always holds a whole binary, the old or the new
+func replaceExecutable(exe string, bin []byte) error {
+	// the new binary is written beside the old, and on Windows the old one
+	// is moved aside
+	for _, name := range []string{exe, filepath.Join(filepath.Dir(exe), ".jqurl-update-"), exe + ".old"} {
+		if err := checkWrite(name); err != nil {
+			return err
+		}
+	}
+	stat, err := os.Stat(exe)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(exe), ".jqurl-update-")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(bin)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), stat.Mode().Perm()|0111)
+	}
+	if err == nil && runtime.GOOS == "windows" {
+		// a running binary can't be replaced on Windows, but it can be moved
+		os.Remove(exe + ".old")
+		err = os.Rename(exe, exe+".old")
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), exe)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type semver struct {
+	major, minor, patch int
+	pre                 []string
+}
+
+// parseSemver reads a version like v1.2.3-rc.1+build, missing parts are zero
+func parseSemver(s string) (v semver, err error) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "v")
+	if i := strings.IndexByte(s, '+'); i >= 0 {
+		s = s[:i]
+	}
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		v.pre = strings.Split(s[i+1:], ".")
+		s = s[:i]
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) > 3 || parts[0] == "" {
+		return v, fmt.Errorf("invalid version %q", s)
+	}
+	nums := []*int{&v.major, &v.minor, &v.patch}
+	for i, p := range parts {
+		if *nums[i], err = strconv.Atoi(p); err != nil {
+			return v, fmt.Errorf("invalid version %q", s)
+		}
+	}
+	return v, nil
+}
+
+func (a semver) compare(b semver) int {
+	for _, d := range []int{a.major - b.major, a.minor - b.minor, a.patch - b.patch} {
+		if d != 0 {
+			return sign(d)
+		}
+	}
+	// a version without a pre-release has a higher precedence
+	switch {
+	case len(a.pre) == 0 && len(b.pre) == 0:
+		return 0
+	case len(a.pre) == 0:
+		return 1
+	case len(b.pre) == 0:
+		return -1
+	}
+	for i := 0; i < len(a.pre) && i < len(b.pre); i++ {
+		an, aErr := strconv.Atoi(a.pre[i])
+		bn, bErr := strconv.Atoi(b.pre[i])
+		switch {
+		case aErr == nil && bErr == nil:
+			if an != bn {
+				return sign(an - bn)
+			}
+		case aErr == nil:
+			return -1
+		case bErr == nil:
+			return 1
+		default:
+			if c := strings.Compare(a.pre[i], b.pre[i]); c != 0 {
+				return c
+			}
+		}
+	}
+	return sign(len(a.pre) - len(b.pre))
+}
+
+func sign(i int) int {
+	switch {
+	case i < 0:
+		return -1
+	case i > 0:
+		return 1
+	}
+	return 0
+}
+
+// semverSatisfies checks a version against an npm style range, such as
+// "^1.2", "~1.2.3", ">=1.0 <2", "1.2.3 - 2.3", "1.x" or "1.2 || 2.0".  As
+// with npm a pre-release only matches a set of comparators where one of them
+// is a pre-release of the same major.minor.patch.
+func semverSatisfies(v semver, constraint string) (bool, error) {
+	for _, alt := range strings.Split(constraint, "||") {
+		var checks []string
+		fields := strings.Fields(alt)
+		for i := 0; i < len(fields); i++ {
+			if i+2 < len(fields) && fields[i+1] == "-" {
+				// a hyphen range, both ends taken in
+				lo, hi := fields[i], fields[i+2]
+				if strings.ContainsAny(lo[:1]+hi[:1], "^~<>=") {
+					return false, fmt.Errorf("invalid hyphen range %q", strings.Join(fields[i:i+3], " "))
+				}
+				checks = append(checks, ">="+lo, "<="+hi)
+				i += 2
+			} else if fields[i] == "-" {
+				return false, fmt.Errorf("invalid hyphen range in %q", strings.TrimSpace(alt))
+			} else {
+				checks = append(checks, fields[i])
+			}
+		}
+		ok := true
+		for _, c := range checks {
+			match, err := semverMatch(v, c)
+			if err != nil {
+				return false, err
+			}
+			ok = ok && match
+		}
+		if ok && (len(v.pre) == 0 || preAllowed(v, checks)) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// preAllowed tells if a pre-release may match a set of comparators, by one
+// of them being a pre-release of the same major.minor.patch
+func preAllowed(v semver, checks []string) bool {
+	for _, c := range checks {
+		b, err := parseSemver(strings.TrimLeft(c, "^~<>="))
+		if err == nil && len(b.pre) > 0 && b.major == v.major && b.minor == v.minor && b.patch == v.patch {
+			return true
+		}
+	}
+	return false
+}
+
+func semverMatch(v semver, c string) (bool, error) {
+	op := c[:len(c)-len(strings.TrimLeft(c, "^~<>="))]
+	ver := strings.TrimPrefix(c[len(op):], "v")
+
+	// count the given parts, treating x and * as wildcards
+	parts := strings.Split(strings.SplitN(ver, "-", 2)[0], ".")
+	given := 0
+	for _, p := range parts {
+		if p == "x" || p == "X" || p == "*" || p == "" {
+			break
+		}
+		given++
+	}
+	if given == 0 {
+		return true, nil
+	}
+	if given < len(parts) {
+		ver = strings.Join(parts[:given], ".")
+	}
+	base, err := parseSemver(ver)
+	if err != nil {
+		return false, err
+	}
+
+	// upper bound for partial, caret and tilde ranges
+	upper := func(part int) semver {
+		switch part {
+		case 0:
+			return semver{major: base.major + 1, pre: []string{"0"}}
+		case 1:
+			return semver{major: base.major, minor: base.minor + 1, pre: []string{"0"}}
+		}
+		return semver{major: base.major, minor: base.minor, patch: base.patch + 1, pre: []string{"0"}}
+	}
+	inRange := func(hi semver) bool { return v.compare(base) >= 0 && v.compare(hi) < 0 }
+
+	switch op {
+	case "^":
+		switch {
+		case base.major > 0 || given == 1:
+			return inRange(upper(0)), nil
+		case base.minor > 0 || given == 2:
+			return inRange(upper(1)), nil
+		}
+		return inRange(upper(2)), nil
+	case "~":
+		if given == 1 {
+			return inRange(upper(0)), nil
+		}
+		return inRange(upper(1)), nil
+	case ">":
+		if given < 3 {
+			return v.compare(upper(given-1)) >= 0, nil
+		}
+		return v.compare(base) > 0, nil
+	case ">=":
+		return v.compare(base) >= 0, nil
+	case "<":
+		return v.compare(base) < 0, nil
+	case "<=":
+		if given < 3 {
+			return v.compare(upper(given-1)) < 0, nil
+		}
+		return v.compare(base) <= 0, nil
+	case "", "=":
+		if given < 3 {
+			return inRange(upper(given - 1)), nil
+		}
+		return v.compare(base) == 0, nil
+	}
+	return false, fmt.Errorf("unknown range operator %q", op)
+}
+
+func funcSemverCmp(v interface{}, args []interface{}) interface{} {
+	as, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("semver_cmp cannot be applied to: %#v", v)
+	}
+	bs, ok := args[0].(string)
+	if !ok {
+		return fmt.Errorf("semver_cmp: expected a version string, got %#v", args[0])
+	}
+	a, err := parseSemver(as)
+	if err != nil {
+		return fmt.Errorf("semver_cmp: %s", err)
+	}
+	b, err := parseSemver(bs)
+	if err != nil {
+		return fmt.Errorf("semver_cmp: %s", err)
+	}
+	return a.compare(b)
+}
+
+func funcSemverSatisfies(v interface{}, args []interface{}) interface{} {
+	s, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("semver_satisfies cannot be applied to: %#v", v)
+	}
+	constraint, ok := args[0].(string)
+	if !ok {
+		return fmt.Errorf("semver_satisfies: expected a range string, got %#v", args[0])
+	}
+	ver, err := parseSemver(s)
+	if err != nil {
+		return fmt.Errorf("semver_satisfies: %s", err)
+	}
+	match, err := semverSatisfies(ver, constraint)
+	if err != nil {
+		return fmt.Errorf("semver_satisfies: %s", err)
+	}
+	return match
+}
@@ -0,0 +1,47 @@
+package main
+
+import "testing"
+
+func TestSemverSatisfies(t *testing.T) {
+	for _, c := range []struct {
+		version, constraint string
+		want                bool
+	}{
+		{"1.2.3", "^1.2", true},
+		{"2.0.0", "^1.2", false},
+
+		// hyphen ranges take both ends in, a partial upper end as npm does
+		{"1.2.2", "1.2.3 - 2.3.4", false},
+		{"1.2.3", "1.2.3 - 2.3.4", true},
+		{"2.3.4", "1.2.3 - 2.3.4", true},
+		{"2.3.5", "1.2.3 - 2.3.4", false},
+		{"2.3.9", "1.2 - 2.3", true},
+		{"2.4.0", "1.2 - 2.3", false},
+		{"1.5.0", "1.0 - 2 || 5", true},
+
+		// a pre-release only matches a range naming one of the same version
+		{"1.3.0-beta", "^1.2", false},
+		{"1.3.0-beta", ">=1.2.0 <2", false},
+		{"1.3.0-beta", ">=1.3.0-alpha <2", true},
+		{"1.3.0-beta", ">=1.2.0-alpha <2", false},
+		{"1.3.0-beta", "^1.2 || >=1.3.0-alpha", true},
+		{"1.3.0-beta", "1.3.0-alpha - 1.4", true},
+		{"1.3.0", ">=1.3.0-alpha", true},
+	} {
+		v, err := parseSemver(c.version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := semverSatisfies(v, c.constraint)
+		if err != nil {
+			t.Errorf("%s in %q: %s", c.version, c.constraint, err)
+		} else if got != c.want {
+			t.Errorf("%s in %q = %v, want %v", c.version, c.constraint, got, c.want)
+		}
+	}
+	for _, bad := range []string{"1.0 -", ">1.0 - 2", "- 1.0"} {
+		if _, err := semverSatisfies(semver{major: 1}, bad); err == nil {
+			t.Errorf("%q gave no error", bad)
+		}
+	}
+}
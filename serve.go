@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var (
+	serveAddr       string
+	shutdownTimeout time.Duration
+
+	// serveMu serializes the queries, which share the fetched data and the
+	// output settings
+	serveMu   sync.Mutex
+	fetchedAt time.Time
+
+	serveReady    atomic.Bool
+	serveStopping atomic.Bool
+	stats         = &serveStats{requests: map[int]int64{}}
+)
+
+// serveStats are the counters behind /metrics
+type serveStats struct {
+	sync.Mutex
+	requests     map[int]int64
+	fetches      int64
+	fetchErrors  int64
+	durationSum  float64
+	durationSize int64
+}
+
+func (s *serveStats) request(code int, took time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+	s.requests[code]++
+	s.durationSum += took.Seconds()
+	s.durationSize++
+}
+
+func (s *serveStats) fetch(ok bool) {
+	s.Lock()
+	defer s.Unlock()
+	s.fetches++
+	if !ok {
+		s.fetchErrors++
+	}
+}
+
+// serveQuery answers every request to / with the query results, fetching
+// the URLs again once the data is older than --max-age.  /healthz, /readyz
+// and /metrics are there for systemd and Kubernetes probes, and SIGTERM
+// stops taking new connections and lets the open ones finish.
+func serveQuery(client *http.Client) {
+	if err := loadPurgeToken(); err != nil {
+		log.Fatalf("Error reading purge token: %s", err)
+	}
+	var err error
+	if queryCode, err = compileJQ(JQString); err != nil {
+		log.Fatalf("Error %s", err)
+	}
+	if dat != nil {
+		// loaded from the cache at startup
+		fetchedAt = clock.Now()
+		serveReady.Store(true)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case serveStopping.Load():
+			http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		case !serveReady.Load():
+			http.Error(w, "no data fetched yet", http.StatusServiceUnavailable)
+		default:
+			fmt.Fprintln(w, "ok")
+		}
+	})
+	mux.HandleFunc("/metrics", serveMetrics)
+	if purgeToken != "" {
+		mux.HandleFunc("/purge", func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			code := servePurge(w, r, client)
+			stats.request(code, time.Since(start))
+		})
+	}
+	if err := watchPurgeSignal(client); err != nil {
+		log.Fatal(err)
+	}
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		code := serveResult(w, r, client)
+		stats.request(code, time.Since(start))
+	})
+
+	srv := &http.Server{Addr: serveAddr, Handler: mux}
+	ln, err := activatedListener()
+	if err == nil && ln == nil {
+		ln, err = net.Listen("tcp", serveAddr)
+	}
+	if err != nil {
+		log.Fatalf("Error listening on %q: %s", serveAddr, err)
+	}
+
+	go func() {
+		// get ready before the first request comes in
+		serveMu.Lock()
+		refreshServed(client)
+		serveMu.Unlock()
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+		<-sig
+		serveStopping.Store(true)
+		sdNotify("STOPPING=1")
+		serveLog(prioInfo, "Shutting down, draining connections for up to %s", shutdownTimeout)
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			serveLog(prioWarning, "Shutdown did not finish: %s", err)
+		}
+		close(done)
+	}()
+
+	serveLog(prioInfo, "Serving on %s", ln.Addr())
+	sdNotify("READY=1")
+	sdWatchdog()
+	if err := srv.Serve(ln); err != http.ErrServerClosed {
+		log.Fatalf("Error serving: %s", err)
+	}
+	<-done
+	writeFreeze()
+	saveCookies()
+	if err := saveState(); err != nil {
+		log.Fatalf("Error writing state file %q: %s", stateFile, err)
+	}
+}
+
+// refreshServed fetches the URLs again when the data is older than
+// --max-age, keeping the old data if that fails.  serveMu must be held.
+func refreshServed(client *http.Client) {
+	if dat != nil && !servePurged && since(fetchedAt) < maxAge {
+		return
+	}
+	old := dat
+	dat = nil
+	if fetchAllURLs {
+		dat = fetchAll(client)
+	} else {
+		fetchURLs(client)
+	}
+	stats.fetch(dat != nil)
+	if dat == nil {
+		dat = old
+		serveLog(prioErr, "Error fetching %v, serving the previous data", Args)
+		sdNotify("STATUS=Fetch failed, serving the previous data")
+		return
+	}
+	serveLog(prioDebug, "Fetched %v", Args)
+	sdNotify("STATUS=Serving data fetched " + time.Now().Format(time.RFC3339))
+	fetchedAt = clock.Now()
+	servePurged = false
+	serveReady.Store(true)
+}
+
+// serveResult runs the query for one request and returns the status sent
+func serveResult(w http.ResponseWriter, r *http.Request, client *http.Client) int {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return http.StatusNotFound
+	}
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return http.StatusMethodNotAllowed
+	}
+	serveMu.Lock()
+	defer serveMu.Unlock()
+	// keep what the query set in the state at once, a daemon may end any
+	// way at all
+	defer func() {
+		if err := saveState(); err != nil {
+			serveLog(prioErr, "Error writing state file %q: %s", stateFile, err)
+		}
+	}()
+	refreshServed(client)
+	if dat == nil {
+		http.Error(w, "unable to fetch "+fmt.Sprint(Args), http.StatusBadGateway)
+		return http.StatusBadGateway
+	}
+
+	var buf bytes.Buffer
+	defer delete(yamlStarted, &buf)
+	for _, in := range inputDocs(dat) {
+		iter := runJQ(queryCode, graphqlData(in))
+		for {
+			v, ok := iter.Next()
+			if !ok {
+				break
+			}
+			if err, ok := v.(error); ok {
+				http.Error(w, fmt.Sprintf("jq query: %s", err), http.StatusInternalServerError)
+				return http.StatusInternalServerError
+			}
+			writeResult(&buf, v)
+		}
+	}
+	switch {
+	case raw:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	case outputFormat == "yaml":
+		w.Header().Set("Content-Type", "application/yaml")
+	default:
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.Header().Set("Age", fmt.Sprintf("%d", int(since(fetchedAt).Seconds())))
+	w.Write(buf.Bytes())
+	return http.StatusOK
+}
+
+// serveMetrics writes the counters in the Prometheus text format
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	stats.Lock()
+	defer stats.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintf(w, "# HELP jqurl_requests_total Requests answered, by status code.\n# TYPE jqurl_requests_total counter\n")
+	var codes []int
+	for code := range stats.requests {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		fmt.Fprintf(w, "jqurl_requests_total{code=\"%d\"} %d\n", code, stats.requests[code])
+	}
+	fmt.Fprintf(w, "# HELP jqurl_request_duration_seconds Time taken answering requests.\n# TYPE jqurl_request_duration_seconds summary\n")
+	fmt.Fprintf(w, "jqurl_request_duration_seconds_sum %g\njqurl_request_duration_seconds_count %d\n", stats.durationSum, stats.durationSize)
+	fmt.Fprintf(w, "# HELP jqurl_fetches_total Fetches of the URLs.\n# TYPE jqurl_fetches_total counter\njqurl_fetches_total %d\n", stats.fetches)
+	fmt.Fprintf(w, "# HELP jqurl_fetch_errors_total Fetches of the URLs which failed.\n# TYPE jqurl_fetch_errors_total counter\njqurl_fetch_errors_total %d\n", stats.fetchErrors)
+	ready := 0
+	if serveReady.Load() && !serveStopping.Load() {
+		ready = 1
+	}
+	fmt.Fprintf(w, "# HELP jqurl_ready Whether data is available to serve.\n# TYPE jqurl_ready gauge\njqurl_ready %d\n", ready)
+}
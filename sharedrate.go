@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	sharedRates []string
+	rateLimits  = map[string]float64{}
+)
+
+// parseSharedRates reads the HOST=COUNT/PERIOD limits, such as
+// api.github.com=10/s or *=100/m, into requests per second
+func parseSharedRates() error {
+	for _, spec := range sharedRates {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) < 2 {
+			return fmt.Errorf("shared rate %q is not HOST=COUNT/PERIOD", spec)
+		}
+		rate := strings.SplitN(parts[1], "/", 2)
+		count, err := strconv.ParseFloat(rate[0], 64)
+		if err != nil || count <= 0 {
+			return fmt.Errorf("shared rate %q has a bad count", spec)
+		}
+		period := time.Second
+		if len(rate) == 2 {
+			p := rate[1]
+			if p != "" && strings.IndexAny(p[:1], "0123456789") < 0 {
+				p = "1" + p
+			}
+			if period, err = time.ParseDuration(p); err != nil || period <= 0 {
+				return fmt.Errorf("shared rate %q has a bad period", spec)
+			}
+		}
+		rateLimits[strings.ToLower(parts[0])] = count / period.Seconds()
+	}
+	return nil
+}
+
+// rateTransport holds each request until the token bucket shared by every
+// jqurl process on the machine allows it
+type rateTransport struct {
+	next http.RoundTripper
+}
+
+// rateLimited wraps a transport when --shared-rate limits are set
+func rateLimited(next http.RoundTripper) http.RoundTripper {
+	if len(rateLimits) == 0 {
+		return next
+	}
+	return rateTransport{next: next}
+}
+
+func (t rateTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := strings.ToLower(strings.TrimSuffix(req.URL.Hostname(), "."))
+	rate, ok := rateLimits[host]
+	if !ok {
+		if rate, ok = rateLimits["*"]; !ok {
+			return t.next.RoundTrip(req)
+		}
+	}
+	if err := takeToken(req.Context(), host, rate); err != nil {
+		return nil, err
+	}
+	return t.next.RoundTrip(req)
+}
+
+// bucketState is kept in a file per host, the bucket holds up to one
+// second's worth of requests
+type bucketState struct {
+	Tokens float64 `json:"tokens"`
+	Time   int64   `json:"time"`
+}
+
+// takeToken waits for a token from the host's shared bucket
+func takeToken(ctx context.Context, host string, rate float64) error {
+	file := filepath.Join(cacheDir, "jqurl_rate_"+strings.NewReplacer(":", "_", "/", "_", "\\", "_").Replace(host))
+	burst := rate
+	if burst < 1 {
+		burst = 1
+	}
+	for {
+		wait, err := reserveToken(ctx, file, rate, burst)
+		if err != nil || wait <= 0 {
+			return err
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// reserveToken takes a token if one is available, or returns how long until
+// the next one will be
+func reserveToken(ctx context.Context, file string, rate, burst float64) (time.Duration, error) {
+	if err := checkWrite(file); err != nil {
+		return 0, err
+	}
+	release, err := acquireLock(ctx, file+".lock")
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	now := time.Now()
+	st := bucketState{Tokens: burst, Time: now.UnixNano()}
+	if byt, err := ioutil.ReadFile(file); err == nil {
+		json.Unmarshal(byt, &st)
+	}
+	elapsed := now.Sub(time.Unix(0, st.Time)).Seconds()
+	if elapsed > 0 {
+		st.Tokens += elapsed * rate
+	}
+	if st.Tokens > burst {
+		st.Tokens = burst
+	}
+	st.Time = now.UnixNano()
+
+	var wait time.Duration
+	if st.Tokens >= 1 {
+		st.Tokens--
+	} else {
+		wait = time.Duration((1 - st.Tokens) / rate * float64(time.Second))
+	}
+	byt, _ := json.Marshal(st)
+	return wait, ioutil.WriteFile(file, byt, 0666)
+}
+
+// lockStale is how old a lock file has to be to count as left behind by a
+// crashed process
+const lockStale = 10 * time.Second
+
+// acquireLock creates a lock file, waiting while another process holds it.
+// A lock left behind by a crashed process is broken after ten seconds.
+func acquireLock(ctx context.Context, name string) (release func(), err error) {
+	if err = checkWrite(name); err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return nil, err
+	}
+	for {
+		f, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666)
+		if err == nil {
+			fmt.Fprintf(f, "%d\n", os.Getpid())
+			f.Close()
+			return func() { os.Remove(name) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if stat, err := os.Stat(name); err == nil && since(stat.ModTime()) > lockStale {
+			byt, _ := ioutil.ReadFile(name)
+			if err = takeOver(name, stat, byt); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		select {
+		case <-time.After(2 * time.Millisecond):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// takeOver removes a lock file left behind, unless another process has
+// already taken it over.  Takeovers go one at a time, through a second lock
+// file held only for the check, and only remove the lock while it is still
+// the file, with the content, which was found stale.  So two processes
+// finding the same stale lock can't both break it, the second removing the
+// one the first has just made.
+func takeOver(name string, seen os.FileInfo, stale []byte) error {
+	guard := name + ".takeover"
+	if err := checkWrite(guard); err != nil {
+		return err
+	}
+	for {
+		f, err := os.OpenFile(guard, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666)
+		if err == nil {
+			f.Close()
+			break
+		}
+		if !os.IsExist(err) {
+			return err
+		}
+		// the guard is only held for a moment, an old one was left by a
+		// process which died holding it
+		if stat, err := os.Stat(guard); err == nil && since(stat.ModTime()) > lockStale {
+			os.Remove(guard)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	defer os.Remove(guard)
+	stat, err := os.Stat(name)
+	if err != nil || !os.SameFile(stat, seen) || !stat.ModTime().Equal(seen.ModTime()) {
+		return nil
+	}
+	if byt, err := ioutil.ReadFile(name); err == nil && bytes.Equal(byt, stale) {
+		os.Remove(name)
+	}
+	return nil
+}
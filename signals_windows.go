@@ -0,0 +1,7 @@
+package main
+
+import "os"
+
+// purgeSignals are the signals --purge-on-signal takes, Windows has none to
+// spare, as Ctrl-C and Ctrl-Break both stop the server
+var purgeSignals = map[string]os.Signal{}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var (
+	singleton     string
+	singletonWait time.Duration
+)
+
+// holdSingleton makes sure only one run of the --singleton job is going, so
+// overlapping cron runs against a slow API do not stack up.  A run finding
+// the lock held waits up to --singleton-wait and then exits quietly.  The
+// lock holds the pid of its owner, and is taken over once that process has
+// gone, however it ended.
+func holdSingleton() (release func()) {
+	if singleton == "" || refreshChild {
+		return func() {}
+	}
+	if !validNamespace(singleton) {
+		log.Fatalf("Invalid singleton name %q, use letters, digits, '.', '-' and '_'", singleton)
+	}
+	name := filepath.Join(cacheDir, "jqurl_singleton_"+singleton)
+	if err := checkWrite(name); err != nil {
+		log.Fatal(err)
+	}
+	os.MkdirAll(cacheDir, 0755)
+	deadline := time.Now().Add(singletonWait)
+	for {
+		f, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666)
+		if err == nil {
+			fmt.Fprintf(f, "%d\n", os.Getpid())
+			f.Close()
+			return func() { os.Remove(name) }
+		}
+		if !os.IsExist(err) {
+			log.Fatalf("Error creating singleton lock %q: %s", name, err)
+		}
+		stat, err := os.Stat(name)
+		if err != nil {
+			// released just now
+			continue
+		}
+		byt, _ := ioutil.ReadFile(name)
+		pid, err := strconv.Atoi(strings.TrimSpace(string(byt)))
+		stale := false
+		if err != nil {
+			// half written by a run starting right now, or garbage
+			stale = since(stat.ModTime()) > lockStale
+		} else if !processAlive(pid) {
+			if debug {
+				log.Printf("Taking over singleton lock %q from ended process %d", name, pid)
+			}
+			stale = true
+		}
+		if stale {
+			if err = takeOver(name, stat, byt); err != nil {
+				log.Fatalf("Error taking over singleton lock %q: %s", name, err)
+			}
+			continue
+		}
+		if !time.Now().Before(deadline) {
+			if singletonWait > 0 {
+				fmt.Fprintf(os.Stderr, "Skipping, %q is still running (pid %s) after waiting %s\n", singleton, strings.TrimSpace(string(byt)), singletonWait)
+			} else if debug {
+				log.Printf("Skipping, %q is already running (pid %s)", singleton, strings.TrimSpace(string(byt)))
+			}
+			os.Exit(0)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// processAlive reports if a process id is still running
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	if runtime.GOOS == "windows" {
+		// finding it opened the process, so it exists
+		return true
+	}
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
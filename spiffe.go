@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	useSpiffe      bool
+	spiffeServerID string
+
+	spiffeMu     sync.Mutex
+	spiffeCert   *tls.Certificate
+	spiffeBundle *x509.CertPool
+	spiffeReady  = make(chan struct{})
+)
+
+// spiffeSocket is the Workload API socket of the local SPIRE (or other
+// SPIFFE) agent
+func spiffeSocket() string {
+	addr := os.Getenv("SPIFFE_ENDPOINT_SOCKET")
+	if addr == "" {
+		addr = "unix:///tmp/spire-agent/public/api.sock"
+	}
+	return strings.TrimPrefix(strings.TrimPrefix(addr, "unix://"), "unix:")
+}
+
+// startSpiffe fetches the X.509 SVID of this workload and keeps watching for
+// new ones, as the agent rotates them well before they expire
+func startSpiffe() {
+	go func() {
+		for {
+			err := watchSVIDs()
+			serveLog(prioWarning, "SPIFFE Workload API: %s, reconnecting", err)
+			time.Sleep(delay)
+		}
+	}()
+	select {
+	case <-spiffeReady:
+	case <-time.After(timeout):
+		log.Fatalf("Error getting an X.509 SVID from the SPIFFE Workload API at %q", spiffeSocket())
+	}
+}
+
+// watchSVIDs streams FetchX509SVID replies, a gRPC call made by hand over
+// HTTP/2 on the agent's socket
+func watchSVIDs() error {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", spiffeSocket())
+		},
+		Protocols: new(http.Protocols),
+	}
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	defer transport.CloseIdleConnections()
+
+	// an empty X509SVIDRequest, behind the gRPC message header
+	req, err := http.NewRequest("POST", "http://localhost/SpiffeWorkloadAPI/FetchX509SVID", bytes.NewReader(make([]byte, 5)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	req.Header.Set("workload.spiffe.io", "true")
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("reply %s", resp.Status)
+	}
+
+	for {
+		var head [5]byte
+		if _, err = io.ReadFull(resp.Body, head[:]); err != nil {
+			if status := resp.Trailer.Get("Grpc-Status"); status != "" && status != "0" {
+				return fmt.Errorf("grpc status %s: %s", status, resp.Trailer.Get("Grpc-Message"))
+			}
+			if status := resp.Header.Get("Grpc-Status"); status != "" && status != "0" {
+				return fmt.Errorf("grpc status %s: %s", status, resp.Header.Get("Grpc-Message"))
+			}
+			return fmt.Errorf("stream ended: %v", err)
+		}
+		msg := make([]byte, binary.BigEndian.Uint32(head[1:]))
+		if _, err = io.ReadFull(resp.Body, msg); err != nil {
+			return err
+		}
+		if err = takeSVID(msg); err != nil {
+			return err
+		}
+	}
+}
+
+// takeSVID puts the first SVID of an X509SVIDResponse in use
+func takeSVID(msg []byte) error {
+	var svid []byte
+	err := protoFields(msg, func(num int, val []byte) error {
+		if num == 1 && svid == nil {
+			svid = val
+		}
+		return nil
+	})
+	if err != nil || svid == nil {
+		return fmt.Errorf("reply holds no SVID")
+	}
+
+	var id string
+	var chain, key, bundle []byte
+	err = protoFields(svid, func(num int, val []byte) error {
+		switch num {
+		case 1:
+			id = string(val)
+		case 2:
+			chain = val
+		case 3:
+			key = val
+		case 4:
+			bundle = val
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	certs, err := x509.ParseCertificates(chain)
+	if err != nil || len(certs) == 0 {
+		return fmt.Errorf("bad SVID certificate: %v", err)
+	}
+	priv, err := x509.ParsePKCS8PrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("bad SVID key: %s", err)
+	}
+	roots, err := x509.ParseCertificates(bundle)
+	if err != nil {
+		return fmt.Errorf("bad trust bundle: %s", err)
+	}
+	pool := x509.NewCertPool()
+	for _, c := range roots {
+		pool.AddCert(c)
+	}
+	cert := &tls.Certificate{PrivateKey: priv, Leaf: certs[0]}
+	for _, c := range certs {
+		cert.Certificate = append(cert.Certificate, c.Raw)
+	}
+
+	spiffeMu.Lock()
+	first := spiffeCert == nil
+	spiffeCert, spiffeBundle = cert, pool
+	spiffeMu.Unlock()
+	serveLog(prioDebug, "Got SVID %s, valid until %s", id, certs[0].NotAfter)
+	if first {
+		close(spiffeReady)
+	}
+	return nil
+}
+
+// protoFields calls fn with each length delimited field of a protobuf
+// message, skipping the other wire types
+func protoFields(msg []byte, fn func(num int, val []byte) error) error {
+	for len(msg) > 0 {
+		tag, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return errors.New("bad protobuf tag")
+		}
+		msg = msg[n:]
+		switch tag & 7 {
+		case 0:
+			if _, n = binary.Uvarint(msg); n <= 0 {
+				return errors.New("bad protobuf varint")
+			}
+			msg = msg[n:]
+		case 1, 5:
+			size := 8
+			if tag&7 == 5 {
+				size = 4
+			}
+			if len(msg) < size {
+				return errors.New("short protobuf field")
+			}
+			msg = msg[size:]
+		case 2:
+			size, n := binary.Uvarint(msg)
+			if n <= 0 || uint64(len(msg)-n) < size {
+				return errors.New("short protobuf field")
+			}
+			if err := fn(int(tag>>3), msg[n:n+int(size)]); err != nil {
+				return err
+			}
+			msg = msg[n+int(size):]
+		default:
+			return fmt.Errorf("unknown protobuf wire type %d", tag&7)
+		}
+	}
+	return nil
+}
+
+// spiffeTLS presents the current SVID as the client certificate.  Servers
+// with a SPIFFE ID are checked against the trust bundle, and --spiffe-id if
+// given, others against the usual CAs and host name.
+func spiffeTLS(conf *tls.Config) {
+	conf.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		spiffeMu.Lock()
+		defer spiffeMu.Unlock()
+		return spiffeCert, nil
+	}
+	if conf.InsecureSkipVerify {
+		return
+	}
+	// verified below instead, as SVIDs carry no host names
+	conf.InsecureSkipVerify = true
+	conf.VerifyConnection = func(cs tls.ConnectionState) error {
+		leaf := cs.PeerCertificates[0]
+		opts := x509.VerifyOptions{Roots: conf.RootCAs, DNSName: cs.ServerName, Intermediates: x509.NewCertPool()}
+		for _, c := range cs.PeerCertificates[1:] {
+			opts.Intermediates.AddCert(c)
+		}
+		var id string
+		for _, u := range leaf.URIs {
+			if u.Scheme == "spiffe" {
+				id = u.String()
+			}
+		}
+		if id != "" {
+			spiffeMu.Lock()
+			opts.Roots, opts.DNSName = spiffeBundle, ""
+			spiffeMu.Unlock()
+		}
+		if _, err := leaf.Verify(opts); err != nil {
+			return err
+		}
+		if spiffeServerID != "" && id != spiffeServerID {
+			return fmt.Errorf("server SPIFFE ID %q is not %q", id, spiffeServerID)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/itchyny/gojq"
+)
+
+var (
+	splitBy    string
+	splitDir   string
+	splitCode  *gojq.Code
+	splitFiles = map[string]*os.File{}
+)
+
+// splitName evaluates the --split-by expression on a result and turns the
+// value into a safe file name
+func splitName(v interface{}) (string, error) {
+	if splitCode == nil {
+		var err error
+		if splitCode, err = compileJQ(splitBy); err != nil {
+			return "", fmt.Errorf("--split-by: %s", err)
+		}
+	}
+	key, ok := runJQ(splitCode, v).Next()
+	if !ok {
+		return "", fmt.Errorf("--split-by %q gave no value", splitBy)
+	}
+	if err, ok := key.(error); ok {
+		return "", err
+	}
+	name := strings.Map(func(r rune) rune {
+		if r < ' ' || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, resultString(key))
+	if name == "" || name == "." || name == ".." {
+		name = "_" + name
+	}
+	return name + ".json", nil
+}
+
+// writeSplit appends a result to the file picked by --split-by, files are
+// truncated the first time they are written in a run
+func writeSplit(v interface{}) {
+	name, err := splitName(v)
+	if err != nil {
+		log.Fatalf("Error splitting result: %s", err)
+	}
+	f, ok := splitFiles[name]
+	if !ok {
+		if err = checkWrite(filepath.Join(splitDir, name)); err == nil {
+			err = os.MkdirAll(splitDir, 0755)
+		}
+		if err == nil {
+			f, err = os.Create(filepath.Join(splitDir, name))
+		}
+		if err != nil {
+			log.Fatalf("Error creating split file: %s", err)
+		}
+		splitFiles[name] = f
+	}
+	writeResult(f, v)
+}
+
+// closeSplits closes the files written by writeSplit
+func closeSplits() {
+	for name, f := range splitFiles {
+		if err := f.Close(); err != nil {
+			log.Fatalf("Error writing split file %q: %s", name, err)
+		}
+	}
+}
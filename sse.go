@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/pschou/jqURL/pkg/jqurl"
+)
+
+var sseMode bool
+
+// streamSSE subscribes to a Server-Sent Events endpoint and runs the query
+// on the data of each event as it arrives.  When the stream ends or breaks
+// it reconnects after the retry time, sending Last-Event-ID so the server
+// can carry on where it left off, until the server answers 204.
+func streamSSE(client *http.Client) {
+	lastID := ""
+	retry := delay
+	for {
+		opts := fetchOptions(client)
+		opts.Stream = true
+		opts.Headers["accept"] = "text/event-stream"
+		opts.Headers["cache-control"] = "no-cache"
+		if lastID != "" {
+			opts.Headers["last-event-id"] = lastID
+		}
+		res, err := fetchDo(opts)
+		if err != nil {
+			log.Fatalf("Error opening event stream: %s", err)
+		}
+		resp := res.Response
+		if resp.StatusCode == http.StatusNoContent {
+			resp.Body.Close()
+			break
+		}
+		if mt, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mt != "text/event-stream" {
+			resp.Body.Close()
+			log.Fatalf("%s answered with %q rather than text/event-stream", res.URL, mt)
+		}
+
+		err = readEvents(saveStream(resp.Body), func(ev jqurl.Event) {
+			var v interface{}
+			if json.Unmarshal([]byte(ev.Data), &v) != nil {
+				v = ev.Data
+			}
+			if withMetadata {
+				env := respEnvelope(res.URL, resp, "", v).(map[string]interface{})
+				env["event"], env["id"] = ev.Event, ev.ID
+				queryInput(env)
+				return
+			}
+			queryInput(v)
+		}, &lastID, &retry)
+		resp.Body.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Event stream broke: %s, reconnecting in %s\n", err, retry)
+		} else if debug {
+			log.Printf("Event stream ended, reconnecting in %s", retry)
+		}
+		clock.Sleep(retry)
+	}
+	finishQuery()
+}
+
+// readEvents reads an event stream, calling on for each event, and keeps
+// the last event ID and the retry time the server asked for
+func readEvents(body io.Reader, on func(jqurl.Event), lastID *string, retry *time.Duration) error {
+	events := jqurl.NewEventReader(body)
+	events.LastID, events.Retry = *lastID, *retry
+	defer func() {
+		*lastID, *retry = events.LastID, events.Retry
+	}()
+	for {
+		ev, err := events.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		on(ev)
+	}
+}
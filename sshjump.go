@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"time"
+)
+
+var sshJump string
+
+// sshConn is a connection tunneled through the stdin and stdout of an
+// "ssh -W" process, so the user's keys, agent and ssh_config all apply
+type sshConn struct {
+	cmd    *exec.Cmd
+	r      io.ReadCloser
+	w      io.WriteCloser
+	remote string
+}
+
+// sshDial opens a connection to addr through the --ssh-jump bastion
+func sshDial(ctx context.Context, network, addr string) (net.Conn, error) {
+	cmd := exec.CommandContext(ctx, "ssh", "-W", addr, "-o", "BatchMode=yes", "-o", "ExitOnForwardFailure=yes", sshJump)
+	cmd.Stderr = os.Stderr
+	w, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	r, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &sshConn{cmd: cmd, r: r, w: w, remote: addr}, nil
+}
+
+func (c *sshConn) Read(b []byte) (int, error)  { return c.r.Read(b) }
+func (c *sshConn) Write(b []byte) (int, error) { return c.w.Write(b) }
+func (c *sshConn) Close() error {
+	c.w.Close()
+	if c.cmd.Process != nil {
+		c.cmd.Process.Kill()
+	}
+	return c.cmd.Wait()
+}
+func (c *sshConn) LocalAddr() net.Addr                { return sshAddr(sshJump) }
+func (c *sshConn) RemoteAddr() net.Addr               { return sshAddr(c.remote) }
+func (c *sshConn) SetDeadline(t time.Time) error      { return nil }
+func (c *sshConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *sshConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type sshAddr string
+
+func (a sshAddr) Network() string { return "ssh" }
+func (a sshAddr) String() string  { return string(a) }
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+var (
+	stateFile string
+	stateData map[string]interface{}
+
+	// stateChanged holds the keys set or deleted since the last save
+	stateChanged map[string]bool
+)
+
+// loadState reads the state store from disk on first use
+func loadState() {
+	if stateData != nil {
+		return
+	}
+	if err := checkRead(stateFile); err != nil {
+		log.Fatal(err)
+	}
+	// a run which may not write the state can't take the lock either, the
+	// saves being renames it still never reads half of one
+	if checkWrite(stateFile) == nil {
+		release, err := acquireLock(context.Background(), stateFile+".lock")
+		if err != nil {
+			log.Fatalf("Error locking state file %q: %s", stateFile, err)
+		}
+		defer release()
+	}
+	stateData = readState()
+}
+
+// readState parses the state file, an empty store when there is none
+func readState() map[string]interface{} {
+	data := make(map[string]interface{})
+	byt, err := ioutil.ReadFile(stateFile)
+	if err != nil {
+		return data
+	}
+	if err = json.Unmarshal(byt, &data); err != nil && debug {
+		log.Printf("Error reading state file %q: %s", stateFile, err)
+	}
+	return data
+}
+
+// saveState writes the keys changed by this run back to disk, over what
+// other runs have saved since it was loaded
+func saveState() error {
+	if len(stateChanged) == 0 {
+		return nil
+	}
+	if err := checkWrite(stateFile); err != nil {
+		return err
+	}
+	release, err := acquireLock(context.Background(), stateFile+".lock")
+	if err != nil {
+		return err
+	}
+	defer release()
+	data := readState()
+	for key := range stateChanged {
+		if v, ok := stateData[key]; ok {
+			data[key] = v
+		} else {
+			delete(data, key)
+		}
+	}
+	byt, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if err = writeAtomic(stateFile, byt, 0600); err != nil {
+		return err
+	}
+	stateData, stateChanged = data, nil
+	return nil
+}
+
+// writeAtomic writes a file aside and renames it into place, so readers and
+// other jqurl processes writing it too never see part of one
+func writeAtomic(name string, byt []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(name), "."+filepath.Base(name)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(byt)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), perm)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), name)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func funcStateGet(v interface{}, args []interface{}) interface{} {
+	key, ok := args[0].(string)
+	if !ok {
+		return fmt.Errorf("state_get: key must be a string, got %#v", args[0])
+	}
+	loadState()
+	return stateData[key]
+}
+
+func funcStateSet(v interface{}, args []interface{}) interface{} {
+	key, ok := args[0].(string)
+	if !ok {
+		return fmt.Errorf("state_set: key must be a string, got %#v", args[0])
+	}
+	loadState()
+	if args[1] == nil {
+		delete(stateData, key)
+	} else {
+		stateData[key] = args[1]
+	}
+	if stateChanged == nil {
+		stateChanged = make(map[string]bool)
+	}
+	stateChanged[key] = true
+	return v
+}
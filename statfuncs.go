@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// toFloats converts an array of numbers into a float slice
+func toFloats(name string, v interface{}) ([]float64, error) {
+	a, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s cannot be applied to: %#v", name, v)
+	}
+	out := make([]float64, len(a))
+	for i, e := range a {
+		if out[i], ok = toFloat(e); !ok {
+			return nil, fmt.Errorf("%s requires an array of numbers, got: %#v", name, e)
+		}
+	}
+	return out, nil
+}
+
+func mean(vals []float64) float64 {
+	var sum float64
+	for _, f := range vals {
+		sum += f
+	}
+	return sum / float64(len(vals))
+}
+
+func funcPercentile(v interface{}, args []interface{}) interface{} {
+	vals, err := toFloats("percentile", v)
+	if err != nil {
+		return err
+	}
+	p, ok := toFloat(args[0])
+	if !ok || p < 0 || p > 100 {
+		return fmt.Errorf("percentile: expected a number between 0 and 100, got %#v", args[0])
+	}
+	if len(vals) == 0 {
+		return nil
+	}
+	sort.Float64s(vals)
+	// linear interpolation between the closest ranks
+	rank := p / 100 * float64(len(vals)-1)
+	lo, hi := int(math.Floor(rank)), int(math.Ceil(rank))
+	return vals[lo] + (vals[hi]-vals[lo])*(rank-float64(lo))
+}
+
+func funcVariance(v interface{}, args []interface{}) interface{} {
+	vals, err := toFloats("variance", v)
+	if err != nil {
+		return err
+	}
+	if len(vals) == 0 {
+		return nil
+	}
+	m := mean(vals)
+	var sum float64
+	for _, f := range vals {
+		sum += (f - m) * (f - m)
+	}
+	return sum / float64(len(vals))
+}
+
+func funcStddev(v interface{}, args []interface{}) interface{} {
+	variance := funcVariance(v, args)
+	if f, ok := variance.(float64); ok {
+		return math.Sqrt(f)
+	}
+	return variance
+}
+
+func funcHistogram(v interface{}, args []interface{}) interface{} {
+	vals, err := toFloats("histogram", v)
+	if err != nil {
+		return err
+	}
+	width, ok := toFloat(args[0])
+	if !ok || width <= 0 {
+		return fmt.Errorf("histogram: bucket width must be a positive number, got %#v", args[0])
+	}
+	counts := make(map[float64]int)
+	for _, f := range vals {
+		counts[math.Floor(f/width)*width]++
+	}
+	starts := make([]float64, 0, len(counts))
+	for start := range counts {
+		starts = append(starts, start)
+	}
+	sort.Float64s(starts)
+	out := make([]interface{}, len(starts))
+	for i, start := range starts {
+		out[i] = map[string]interface{}{
+			"start": start,
+			"end":   start + width,
+			"count": counts[start],
+		}
+	}
+	return out
+}
+
+func funcMovingAvg(v interface{}, args []interface{}) interface{} {
+	vals, err := toFloats("moving_avg", v)
+	if err != nil {
+		return err
+	}
+	n, ok := toFloat(args[0])
+	if !ok || n < 1 || n != math.Trunc(n) {
+		return fmt.Errorf("moving_avg: window must be a positive integer, got %#v", args[0])
+	}
+	size := int(n)
+	out := []interface{}{}
+	var sum float64
+	for i, f := range vals {
+		sum += f
+		if i >= size {
+			sum -= vals[i-size]
+		}
+		if i >= size-1 {
+			out = append(out, sum/float64(size))
+		}
+	}
+	return out
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// syslog priorities, as understood by journald in a "<N>" line prefix
+const (
+	prioErr     = 3
+	prioWarning = 4
+	prioInfo    = 6
+	prioDebug   = 7
+)
+
+// underJournal is set when stderr goes to the systemd journal, which stamps
+// each line itself and reads its priority from a "<N>" prefix
+var underJournal = os.Getenv("JOURNAL_STREAM") != ""
+
+// serveLog logs a server message, with its priority when under the journal
+func serveLog(prio int, format string, v ...interface{}) {
+	if prio == prioDebug && !debug {
+		return
+	}
+	if underJournal {
+		fmt.Fprintf(os.Stderr, "<%d>%s\n", prio, fmt.Sprintf(format, v...))
+		return
+	}
+	log.Printf(format, v...)
+}
+
+// activatedListener returns the socket systemd passed in with socket
+// activation (LISTEN_FDS), or nil when not started that way.  Only the first
+// socket is used.
+func activatedListener() (net.Listener, error) {
+	pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	fds, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if pid != os.Getpid() || fds < 1 {
+		return nil, nil
+	}
+	// not passed on to --map-exec commands
+	for _, env := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		os.Unsetenv(env)
+	}
+	if fds > 1 {
+		serveLog(prioWarning, "Given %d sockets, only the first is used", fds)
+	}
+	// the passed sockets start at fd 3
+	f := os.NewFile(3, "LISTEN_FD_3")
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// sdNotify sends a state change, such as READY=1, to systemd for
+// Type=notify units.  It does nothing when not run by systemd.
+func sdNotify(state string) {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if name == "" {
+		return
+	}
+	if strings.HasPrefix(name, "@") {
+		// abstract socket
+		name = "\x00" + name[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		serveLog(prioDebug, "Unable to notify systemd: %s", err)
+		return
+	}
+	defer conn.Close()
+	conn.Write([]byte(state))
+}
+
+// sdWatchdog pings the systemd watchdog at half the WatchdogSec= interval
+// for as long as the process runs
+func sdWatchdog() {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	go func() {
+		for range time.Tick(time.Duration(usec) * time.Microsecond / 2) {
+			sdNotify("WATCHDOG=1")
+		}
+	}()
+}
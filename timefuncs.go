@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+	_ "time/tzdata" // embed the IANA database for hosts without zoneinfo
+
+	"github.com/itchyny/timefmt-go"
+)
+
+var timeZone string
+
+// loadZone resolves an IANA zone name, "" and "UTC" map to UTC
+func loadZone(name string) (*time.Location, error) {
+	switch name {
+	case "", "UTC", "utc", "Z":
+		return time.UTC, nil
+	case "local", "Local":
+		return time.Local, nil
+	}
+	return time.LoadLocation(name)
+}
+
+// toTime converts an epoch number or a broken down time array into a time
+func toTime(v interface{}, loc *time.Location) (time.Time, bool) {
+	if f, ok := toFloat(v); ok {
+		sec, frac := math.Modf(f)
+		return time.Unix(int64(sec), int64(frac*1e9)).In(loc), true
+	}
+	a, ok := v.([]interface{})
+	if !ok || len(a) < 6 {
+		return time.Time{}, false
+	}
+	var parts [6]float64
+	for i := range parts {
+		if parts[i], ok = toFloat(a[i]); !ok {
+			return time.Time{}, false
+		}
+	}
+	sec, frac := math.Modf(parts[5])
+	return time.Date(int(parts[0]), time.Month(parts[1])+1, int(parts[2]),
+		int(parts[3]), int(parts[4]), int(sec), int(frac*1e9), loc), true
+}
+
+func epochSeconds(t time.Time) float64 {
+	return float64(t.Unix()) + float64(t.Nanosecond())/1e9
+}
+
+func funcFromEpochMs(v interface{}, args []interface{}) interface{} {
+	ms, ok := toFloat(v)
+	if !ok {
+		return fmt.Errorf("fromepoch_ms cannot be applied to: %#v", v)
+	}
+	return ms / 1000
+}
+
+func funcToEpochMs(v interface{}, args []interface{}) interface{} {
+	t, ok := toTime(v, time.UTC)
+	if !ok {
+		return fmt.Errorf("toepoch_ms cannot be applied to: %#v", v)
+	}
+	return float64(t.UnixNano() / int64(time.Millisecond))
+}
+
+func funcStrftimeTZ(v interface{}, args []interface{}) interface{} {
+	format, ok := args[0].(string)
+	if !ok {
+		return fmt.Errorf("strftime_tz: format must be a string, got %#v", args[0])
+	}
+	zone, _ := args[1].(string)
+	loc, err := loadZone(zone)
+	if err != nil {
+		return fmt.Errorf("strftime_tz: %s", err)
+	}
+	t, ok := toTime(v, time.UTC)
+	if !ok {
+		return fmt.Errorf("strftime_tz cannot be applied to: %#v", v)
+	}
+	return timefmt.Format(t.In(loc), format)
+}
+
+func funcStrptimeTZ(v interface{}, args []interface{}) interface{} {
+	s, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("strptime_tz cannot be applied to: %#v", v)
+	}
+	format, ok := args[0].(string)
+	if !ok {
+		return fmt.Errorf("strptime_tz: format must be a string, got %#v", args[0])
+	}
+	zone, _ := args[1].(string)
+	loc, err := loadZone(zone)
+	if err != nil {
+		return fmt.Errorf("strptime_tz: %s", err)
+	}
+	t, err := timefmt.ParseInLocation(s, format, loc)
+	if err != nil {
+		return fmt.Errorf("strptime_tz: %s", err)
+	}
+	return epochSeconds(t)
+}
+
+func funcMktimeTZ(v interface{}, args []interface{}) interface{} {
+	zone, _ := args[0].(string)
+	loc, err := loadZone(zone)
+	if err != nil {
+		return fmt.Errorf("mktime_tz: %s", err)
+	}
+	if _, ok := v.([]interface{}); !ok {
+		return fmt.Errorf("mktime_tz requires array of 6 numbers, got: %#v", v)
+	}
+	t, ok := toTime(v, loc)
+	if !ok {
+		return fmt.Errorf("mktime_tz requires array of 6 numbers, got: %#v", v)
+	}
+	return epochSeconds(t)
+}
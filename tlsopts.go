@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+var (
+	caBundleEmbedded string
+	tlsKeyLog        string
+	keyLogWriter     io.Writer
+
+	// embeddedCABundles holds the PEM bundles compiled in with the cabundles
+	// build tag, by name
+	embeddedCABundles = map[string][]byte{}
+)
+
+// loadEmbeddedCABundle adds the named embedded bundle to the trusted roots
+func loadEmbeddedCABundle(name string) error {
+	if name == "list" {
+		var names []string
+		for n := range embeddedCABundles {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		if len(names) == 0 {
+			fmt.Fprintln(dataOut, "No CA bundles embedded, build with -tags cabundles to include cabundles/*.pem")
+		}
+		for _, n := range names {
+			fmt.Fprintln(dataOut, n)
+		}
+		os.Exit(0)
+	}
+	pem, ok := embeddedCABundles[name]
+	if !ok {
+		return fmt.Errorf("no embedded CA bundle named %q, see --ca-bundle-embedded list", name)
+	}
+	if caCertPool == nil {
+		caCertPool = x509.NewCertPool()
+	}
+	if !caCertPool.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("no certificates found in embedded CA bundle %q", name)
+	}
+	return nil
+}
+
+// openKeyLog opens the NSS key log file used to decrypt captured TLS
+// traffic, --tls-keylog takes precedence over $SSLKEYLOGFILE
+func openKeyLog() error {
+	if tlsKeyLog == "" {
+		tlsKeyLog = os.Getenv("SSLKEYLOGFILE")
+	}
+	if tlsKeyLog == "" {
+		return nil
+	}
+	if err := checkWrite(tlsKeyLog); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(tlsKeyLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Warning: writing TLS session keys to %q\n", tlsKeyLog)
+	keyLogWriter = f
+	return nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"crypto/fips140"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+var (
+	tlsPolicy    string
+	tlsMin       string
+	tlsMax       string
+	tlsCiphers   string
+	tlsServer    string
+	pinnedPubkey string
+)
+
+// tlsVersions are the --tls-min and --tls-max values
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// applyTLSPolicy narrows the TLS settings to a named profile, modeled on the
+// Mozilla server side TLS recommendations plus a FIPS 140 approved profile
+func applyTLSPolicy(cfg *tls.Config) error {
+	switch tlsPolicy {
+	case "":
+	case "modern":
+		cfg.MinVersion = tls.VersionTLS13
+	case "intermediate":
+		cfg.MinVersion = tls.VersionTLS12
+		cfg.CipherSuites = []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+		}
+	case "legacy":
+		cfg.MinVersion = tls.VersionTLS10
+		cfg.CipherSuites = nil
+		for _, suites := range [][]*tls.CipherSuite{tls.CipherSuites(), tls.InsecureCipherSuites()} {
+			for _, suite := range suites {
+				cfg.CipherSuites = append(cfg.CipherSuites, suite.ID)
+			}
+		}
+	case "fips":
+		if !fips140.Enabled() {
+			return fmt.Errorf("the fips policy needs FIPS 140-3 mode, build with \"make fips\" or set GODEBUG=fips140=on")
+		}
+		cfg.MinVersion = tls.VersionTLS12
+		cfg.CipherSuites = []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		}
+		cfg.CurvePreferences = []tls.CurveID{tls.CurveP256, tls.CurveP384}
+	default:
+		return fmt.Errorf("unknown TLS policy %q, use fips, modern, intermediate or legacy", tlsPolicy)
+	}
+	return nil
+}
+
+// applyTLSOptions sets the versions, ciphers, server name and key pins given
+// on the command line, over those of --tls-policy
+func applyTLSOptions(cfg *tls.Config) error {
+	for _, v := range []struct {
+		flag, val string
+		set       *uint16
+	}{
+		{"--tls-min", tlsMin, &cfg.MinVersion},
+		{"--tls-max", tlsMax, &cfg.MaxVersion},
+	} {
+		if v.val == "" {
+			continue
+		}
+		version, ok := tlsVersions[v.val]
+		if !ok {
+			return fmt.Errorf("unknown %s %q, use 1.0, 1.1, 1.2 or 1.3", v.flag, v.val)
+		}
+		*v.set = version
+	}
+	if cfg.MaxVersion != 0 && cfg.MinVersion > cfg.MaxVersion {
+		return fmt.Errorf("the TLS version range is empty, the minimum is over --tls-max %s", tlsMax)
+	}
+	if tlsCiphers != "" {
+		known := map[string]uint16{}
+		for _, suites := range [][]*tls.CipherSuite{tls.CipherSuites(), tls.InsecureCipherSuites()} {
+			for _, suite := range suites {
+				known[suite.Name] = suite.ID
+			}
+		}
+		cfg.CipherSuites = nil
+		for _, name := range strings.FieldsFunc(tlsCiphers, func(r rune) bool { return r == ',' || r == ':' || r == ' ' }) {
+			id, ok := known[strings.ToUpper(name)]
+			if !ok {
+				return fmt.Errorf("unknown cipher suite %q, use the IANA names such as TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", name)
+			}
+			cfg.CipherSuites = append(cfg.CipherSuites, id)
+		}
+	}
+	if tlsServer != "" {
+		cfg.ServerName = tlsServer
+	}
+	if pinnedPubkey != "" {
+		pins, err := loadPins(pinnedPubkey)
+		if err != nil {
+			return err
+		}
+		verify := cfg.VerifyConnection
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			if verify != nil {
+				if err := verify(cs); err != nil {
+					return err
+				}
+			}
+			sum := sha256.Sum256(cs.PeerCertificates[0].RawSubjectPublicKeyInfo)
+			for _, pin := range pins {
+				if bytes.Equal(pin, sum[:]) {
+					return nil
+				}
+			}
+			return fmt.Errorf("public key of %s, sha256//%s, is not pinned", cs.ServerName, base64.StdEncoding.EncodeToString(sum[:]))
+		}
+	}
+	return nil
+}
+
+// loadPins reads --pinnedpubkey, as curl takes it: sha256//BASE64 hashes
+// separated by ;, or a PEM or DER file holding the public key or a
+// certificate with it
+func loadPins(spec string) ([][]byte, error) {
+	var pins [][]byte
+	if strings.HasPrefix(spec, "sha256//") {
+		for _, p := range strings.Split(spec, ";") {
+			sum, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(strings.TrimSpace(p), "sha256//"))
+			if err != nil || len(sum) != sha256.Size || !strings.HasPrefix(strings.TrimSpace(p), "sha256//") {
+				return nil, fmt.Errorf("bad --pinnedpubkey hash %q, use sha256//BASE64", p)
+			}
+			pins = append(pins, sum)
+		}
+		return pins, nil
+	}
+	err := checkRead(spec)
+	var byt []byte
+	if err == nil {
+		byt, err = ioutil.ReadFile(spec)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't read --pinnedpubkey: %s", err)
+	}
+	der := byt
+	if block, _ := pem.Decode(byt); block != nil {
+		der = block.Bytes
+		if block.Type == "CERTIFICATE" {
+			c, err := x509.ParseCertificate(der)
+			if err != nil {
+				return nil, fmt.Errorf("bad certificate in --pinnedpubkey %q: %s", spec, err)
+			}
+			der = c.RawSubjectPublicKeyInfo
+		}
+	}
+	if _, err := x509.ParsePKIXPublicKey(der); err != nil {
+		return nil, fmt.Errorf("no public key in --pinnedpubkey %q: %s", spec, err)
+	}
+	sum := sha256.Sum256(der)
+	return append(pins, sum[:]), nil
+}
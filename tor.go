@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var (
+	useTor   bool
+	torProxy string
+)
+
+// torTransport sends every request through the Tor SOCKS port, host names
+// are resolved by Tor so .onion addresses work and DNS does not leak
+func torTransport(t *http.Transport) {
+	t.Proxy = http.ProxyURL(&url.URL{Scheme: "socks5", Host: torProxy})
+}
+
+// checkTor refuses the options which connect some other way than through
+// the Tor SOCKS port, sending the requests around Tor
+func checkTor() error {
+	if useTor && (sshJump != "" || unixSocket != "") {
+		return fmt.Errorf("--tor can't be used with --ssh-jump or --unix-socket, which would bypass Tor")
+	}
+	return nil
+}
+
+// isOnion reports if the URL points at a Tor hidden service
+func isOnion(u *url.URL) bool {
+	return strings.HasSuffix(strings.TrimSuffix(u.Hostname(), "."), ".onion")
+}
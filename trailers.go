@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	trailers   = map[string]interface{}{}
+	trailersMu sync.Mutex
+)
+
+// printHeaders writes a status line and headers to stderr as -i shows them
+func printHeaders(status string, header http.Header) {
+	keys := make([]string, 0, len(header))
+	for key := range header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	fmt.Fprintf(os.Stderr, "%s\n", status)
+	for _, key := range keys {
+		for _, val := range header[key] {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", key, val)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "\n")
+}
+
+// informational shows 1xx responses, such as 103 Early Hints, with -i or
+// --debug
+func informational(code int, header http.Header) {
+	if includeHeader {
+		printHeaders(fmt.Sprintf("%d %s", code, http.StatusText(code)), header)
+	} else if debug {
+		log.Printf("Informational response %d %s %v", code, http.StatusText(code), header)
+	}
+}
+
+// keepTrailers takes the trailers of a response once its body has been read,
+// showing them with -i and making them available to the trailers builtin
+func keepTrailers(resp *http.Response) {
+	if resp == nil || len(resp.Trailer) == 0 {
+		return
+	}
+	if includeHeader {
+		printHeaders("Trailers:", resp.Trailer)
+	} else if debug {
+		log.Printf("Response trailers %v", resp.Trailer)
+	}
+	trailersMu.Lock()
+	defer trailersMu.Unlock()
+	for key, vals := range resp.Trailer {
+		if len(vals) > 0 {
+			trailers[strings.ToLower(key)] = strings.Join(vals, ", ")
+		}
+	}
+}
+
+// funcTrailers returns the trailers of the fetched response as an object
+// with lower case keys, empty when none were sent or the body came from cache
+func funcTrailers(_ interface{}, _ []interface{}) interface{} {
+	trailersMu.Lock()
+	defer trailersMu.Unlock()
+	out := make(map[string]interface{}, len(trailers))
+	for key, val := range trailers {
+		out[key] = val
+	}
+	return out
+}
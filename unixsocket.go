@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+var unixSocket string
+
+// socketDial connects every request to the --unix-socket, while the URL
+// still gives the path and Host header.  A Windows named pipe is given as
+// npipe:////./pipe/NAME, as in DOCKER_HOST, or as \\.\pipe\NAME.
+func socketDial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if pipe, ok := namedPipe(unixSocket); ok {
+		f, err := os.OpenFile(pipe, os.O_RDWR, 0)
+		if err != nil {
+			return nil, err
+		}
+		return &pipeConn{File: f}, nil
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, "unix", unixSocket)
+}
+
+// namedPipe turns the npipe:// form into a Windows pipe path
+func namedPipe(s string) (string, bool) {
+	if strings.HasPrefix(s, "npipe://") {
+		return strings.ReplaceAll(strings.TrimPrefix(s, "npipe://"), "/", `\`), true
+	}
+	return s, strings.HasPrefix(s, `\\.\pipe\`)
+}
+
+// pipeConn is a named pipe opened as a file, which has no deadlines
+type pipeConn struct {
+	*os.File
+}
+
+func (c *pipeConn) LocalAddr() net.Addr                { return pipeAddr(c.Name()) }
+func (c *pipeConn) RemoteAddr() net.Addr               { return pipeAddr(c.Name()) }
+func (c *pipeConn) SetDeadline(t time.Time) error      { return nil }
+func (c *pipeConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *pipeConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return "npipe" }
+func (a pipeAddr) String() string  { return string(a) }
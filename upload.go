@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pschou/jqURL/pkg/jqurl"
+)
+
+var (
+	expect100        bool
+	expect100Timeout time.Duration
+	readBuffer       string
+	writeBuffer      string
+	uploadProgress   bool
+)
+
+// expect100Size is the body size from which --expect100 asks the server
+// first, the same as curl
+const expect100Size = 1 << 20
+
+// parseSize reads a byte count with an optional k, M or G (powers of 1024)
+// suffix, such as 64k
+func parseSize(s string) (int64, error) {
+	mult := int64(1)
+	num := strings.TrimSuffix(strings.TrimSuffix(s, "B"), "i")
+	if num != "" {
+		switch num[len(num)-1] {
+		case 'k', 'K':
+			mult = 1 << 10
+		case 'm', 'M':
+			mult = 1 << 20
+		case 'g', 'G':
+			mult = 1 << 30
+		}
+		if mult > 1 {
+			num = num[:len(num)-1]
+		}
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * mult, nil
+}
+
+// humanSize formats a byte count for progress output
+func humanSize(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1fGB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1fMB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1fkB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%dB", n)
+}
+
+// progressBody reports on stderr how much of a request body has been sent
+type progressBody struct {
+	jqurl.Body
+}
+
+func (b progressBody) Open() (io.ReadCloser, error) {
+	rc, err := b.Body.Open()
+	if err != nil {
+		return nil, err
+	}
+	return &progressReader{ReadCloser: rc, size: b.Len(), verb: "Uploaded"}, nil
+}
+
+// progressReader shows on stderr how much of a body has been read, of its
+// size when known
+type progressReader struct {
+	io.ReadCloser
+	size, sent int64
+	last       time.Time
+	verb       string
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.sent += int64(n)
+	sent := r.sent
+	if time.Since(r.last) >= 500*time.Millisecond || err == io.EOF {
+		r.last = time.Now()
+		if r.size > 0 {
+			fmt.Fprintf(os.Stderr, "\r%s %s of %s (%d%%)", r.verb, humanSize(sent), humanSize(r.size), sent*100/r.size)
+		} else {
+			fmt.Fprintf(os.Stderr, "\r%s %s", r.verb, humanSize(sent))
+		}
+		if err == io.EOF {
+			fmt.Fprintf(os.Stderr, "\n")
+		}
+	}
+	return n, err
+}
+
+// uploadOptions applies --expect100 and --upload-progress to a request body
+func uploadOptions(opts *jqurl.Options) {
+	if opts.Body == nil || opts.Body.Len() == 0 {
+		return
+	}
+	if expect100 && (opts.Body.Len() < 0 || opts.Body.Len() >= expect100Size) {
+		opts.Headers["expect"] = "100-continue"
+	}
+	if uploadProgress {
+		opts.Body = progressBody{Body: opts.Body}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"path"
+	"strings"
+)
+
+var (
+	// only the steps which can't change what a server sees are on by
+	// default, a cleaned path may name another resource to some servers
+	urlNormalize = "host,port"
+	normalizeSet map[string]bool
+)
+
+// urlNormalizeSteps lists what --url-normalize can apply to cache keys
+var urlNormalizeSteps = []string{"host", "port", "path", "query", "fragment"}
+
+// parseURLNormalize reads the --url-normalize list, "all" and "none" are
+// also accepted
+func parseURLNormalize() error {
+	normalizeSet = make(map[string]bool)
+	for _, step := range strings.Split(urlNormalize, ",") {
+		switch step = strings.TrimSpace(strings.ToLower(step)); step {
+		case "", "none":
+		case "all":
+			for _, s := range urlNormalizeSteps {
+				normalizeSet[s] = true
+			}
+		case "host", "port", "path", "query", "fragment":
+			normalizeSet[step] = true
+		default:
+			return fmt.Errorf("unknown --url-normalize step %q, use %s, all or none", step, strings.Join(urlNormalizeSteps, ", "))
+		}
+	}
+	return nil
+}
+
+// fixIPv6Zone escapes the zone of a bracketed IPv6 literal, so
+// http://[fe80::1%eth0]:8080/ can be given as typed rather than with %25
+func fixIPv6Zone(arg string) string {
+	start := strings.Index(arg, "://[")
+	if start < 0 {
+		return arg
+	}
+	start += 4
+	end := strings.IndexByte(arg[start:], ']')
+	if end < 0 {
+		return arg
+	}
+	end += start
+	pct := strings.IndexByte(arg[start:end], '%')
+	if pct < 0 || strings.HasPrefix(arg[start+pct:], "%25") {
+		return arg
+	}
+	return arg[:start+pct] + "%25" + arg[start+pct+1:]
+}
+
+// normalizeURL returns the form of a URL used for its cache key, so that
+// equivalent spellings of the same URL share an entry
+func normalizeURL(arg string) string {
+	if normalizeSet == nil {
+		parseURLNormalize()
+	}
+	u, err := url.Parse(arg)
+	if err != nil || u.Host == "" {
+		return arg
+	}
+	n := *u
+	host, port := u.Hostname(), u.Port()
+	if normalizeSet["host"] {
+		n.Scheme = strings.ToLower(n.Scheme)
+		zone := ""
+		if i := strings.IndexByte(host, '%'); i >= 0 {
+			host, zone = host[:i], host[i:]
+		}
+		host = strings.TrimSuffix(strings.ToLower(host), ".")
+		if addr, err := netip.ParseAddr(host); err == nil {
+			host = addr.String()
+		}
+		host += zone
+	}
+	if normalizeSet["port"] && (n.Scheme == "http" && port == "80" || n.Scheme == "https" && port == "443") {
+		port = ""
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if port != "" {
+		host = net.JoinHostPort(strings.Trim(host, "[]"), port)
+	}
+	n.Host = host
+	if normalizeSet["path"] {
+		if n.Path == "" {
+			n.Path = "/"
+		} else {
+			trailing := strings.HasSuffix(n.Path, "/")
+			n.Path = path.Clean(n.Path)
+			if trailing && n.Path != "/" {
+				n.Path += "/"
+			}
+		}
+		n.RawPath = ""
+	}
+	if normalizeSet["query"] {
+		n.RawQuery = u.Query().Encode()
+	}
+	if normalizeSet["fragment"] {
+		n.Fragment, n.RawFragment = "", ""
+	}
+	return n.String()
+}
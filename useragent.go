@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/user"
+	"strings"
+)
+
+// userAgent is the User-Agent sent unless a request sets its own, it may use
+// {version}, {hostname}, {user}, {pid} and {job}
+var userAgent = "jqURL/{version}"
+
+// expandUserAgent fills in the template variables of --user-agent.  {job} is
+// the --singleton name, or else $JQURL_JOB.
+func expandUserAgent(tmpl string) string {
+	job := singleton
+	if job == "" {
+		job = os.Getenv("JQURL_JOB")
+	}
+	vars := map[string]func() string{
+		"version":  func() string { return version },
+		"hostname": func() string { h, _ := os.Hostname(); return h },
+		"user": func() string {
+			if u, err := user.Current(); err == nil {
+				return u.Username
+			}
+			return ""
+		},
+		"pid": func() string { return fmt.Sprintf("%d", os.Getpid()) },
+		"job": func() string { return job },
+	}
+	out := tmpl
+	for name, val := range vars {
+		if strings.Contains(out, "{"+name+"}") {
+			out = strings.ReplaceAll(out, "{"+name+"}", val())
+		}
+	}
+	if strings.ContainsAny(out, "\r\n") {
+		log.Fatalf("Invalid user agent %q", out)
+	}
+	return out
+}
+
+// uaTransport adds the User-Agent to requests without one, this covers the
+// token, metadata and fetch requests as well as the URLs themselves
+type uaTransport struct {
+	next http.RoundTripper
+	ua   string
+}
+
+func withUserAgent(next http.RoundTripper) http.RoundTripper {
+	return uaTransport{next: next, ua: expandUserAgent(userAgent)}
+}
+
+func (t uaTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if _, ok := req.Header["User-Agent"]; ok {
+		return t.next.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", t.ua)
+	return t.next.RoundTrip(req)
+}
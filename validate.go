@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	maxHeaderValue = 8 << 10
+	maxURLLength   = 16 << 10
+)
+
+// isToken checks for a RFC 7230 token, as used by methods and header names
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c <= ' ' || c >= 0x7f || strings.IndexByte(`"(),/:;<=>?@[\]{}`, c) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// validateRequest rejects methods, headers and URLs which could smuggle extra
+// header lines or requests, as values often come from upstream data
+func validateRequest(method string, headers map[string]string, urls []string) error {
+	if !isToken(method) || len(method) > 32 {
+		return fmt.Errorf("invalid request method %q", method)
+	}
+	for key, val := range headers {
+		if !isToken(key) {
+			return fmt.Errorf("invalid header name %q", key)
+		}
+		if len(val) > maxHeaderValue {
+			return fmt.Errorf("header %q is %d bytes, over the %d byte limit", key, len(val), maxHeaderValue)
+		}
+		for i := 0; i < len(val); i++ {
+			if c := val[i]; (c < ' ' && c != '\t') || c == 0x7f {
+				return fmt.Errorf("header %q contains control character %q", key, c)
+			}
+		}
+	}
+	for _, u := range urls {
+		if len(u) > maxURLLength {
+			return fmt.Errorf("URL is %d bytes, over the %d byte limit", len(u), maxURLLength)
+		}
+		for i := 0; i < len(u); i++ {
+			if c := u[i]; c <= ' ' || c == 0x7f {
+				return fmt.Errorf("URL %q contains whitespace or control character %q", u, c)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/pschou/jqURL/pkg/jqurl"
+)
+
+var (
+	verifySHA256 string
+	verifyHeader string
+	expectSHA256 []byte
+
+	// errVerify is not worth retrying, a body which fails its check is not
+	// one to act on
+	errVerify = errors.New("body failed verification")
+)
+
+// exitVerify is the exit code when a body doesn't match its checksum
+const exitVerify = 8
+
+// checkVerify reads the --verify-sha256 hash and makes sure every body the
+// query sees can be checked before it is used
+func checkVerify() {
+	if verifySHA256 == "" && verifyHeader == "" {
+		return
+	}
+	if verifySHA256 != "" {
+		sum, err := hex.DecodeString(strings.TrimPrefix(strings.ToLower(verifySHA256), "sha256:"))
+		if err != nil || len(sum) != sha256.Size {
+			log.Fatalf("bad --verify-sha256 %q, give the 64 hex digits of the hash", verifySHA256)
+		}
+		expectSHA256 = sum
+	}
+	if jsonLines || arrayStream || sseMode || followPages || len(thenURLs) > 0 || frozen {
+		log.Fatal("--verify-sha256 and --verify-from-header can't be used with streaming, paging, --then or --frozen")
+	}
+	if verifyHeader != "" && compressed {
+		log.Fatal("--verify-from-header can't be used with --compressed, the digest is of the body as sent")
+	}
+	// a cached body would go unchecked
+	useCache = false
+}
+
+// verifyOptions checks the body of each 2xx reply of a fetch as it is read,
+// so reading it fails at the end when it doesn't match
+func verifyOptions(opts *jqurl.Options) {
+	if expectSHA256 == nil && verifyHeader == "" {
+		return
+	}
+	if _, ok := opts.Headers["accept-encoding"]; !ok && verifyHeader != "" {
+		opts.Headers["accept-encoding"] = "identity"
+	}
+	onResponse := opts.OnResponse
+	opts.OnResponse = func(resp *http.Response) bool {
+		if onResponse != nil && onResponse(resp) {
+			return true
+		}
+		if resp.StatusCode/100 != 2 {
+			return false
+		}
+		target := resp.Request.URL.String()
+		if expectSHA256 != nil {
+			resp.Body = &verifiedBody{ReadCloser: resp.Body, target: target, source: "--verify-sha256",
+				alg: "SHA-256", hash: sha256.New(), want: expectSHA256}
+		}
+		if verifyHeader != "" {
+			alg, h, want, err := headerDigest(resp.Header.Values(verifyHeader))
+			if err != nil {
+				err = fmt.Errorf("%w, the %s header of %s %s", errVerify, verifyHeader, target, err)
+			}
+			resp.Body = &verifiedBody{ReadCloser: resp.Body, target: target, source: "the " + verifyHeader + " header",
+				alg: alg, hash: h, want: want, err: err}
+		}
+		return false
+	}
+}
+
+// headerDigest finds the hash to check a body against in a digest header,
+// either Digest: SHA-256=BASE64 (RFC 3230), Content-Digest: sha-256=:BASE64:
+// (RFC 9530) or a bare hex digest as in X-Checksum-Sha256
+func headerDigest(vals []string) (string, hash.Hash, []byte, error) {
+	if len(vals) == 0 {
+		return "", nil, nil, errors.New("is missing")
+	}
+	for _, val := range vals {
+		for _, entry := range strings.Split(val, ",") {
+			entry = strings.TrimSpace(entry)
+			if sum, err := hex.DecodeString(entry); err == nil {
+				switch len(sum) {
+				case sha256.Size:
+					return "SHA-256", sha256.New(), sum, nil
+				case sha512.Size:
+					return "SHA-512", sha512.New(), sum, nil
+				}
+			}
+			i := strings.Index(entry, "=")
+			if i < 0 {
+				continue
+			}
+			var alg string
+			var h hash.Hash
+			switch strings.ToLower(strings.TrimSpace(entry[:i])) {
+			case "sha-256":
+				alg, h = "SHA-256", sha256.New()
+			case "sha-512":
+				alg, h = "SHA-512", sha512.New()
+			default:
+				continue
+			}
+			sum, err := base64.StdEncoding.DecodeString(strings.Trim(strings.TrimSpace(entry[i+1:]), ":"))
+			if err != nil || len(sum) != h.Size() {
+				return "", nil, nil, fmt.Errorf("has a bad %s digest %q", alg, entry[i+1:])
+			}
+			return alg, h, sum, nil
+		}
+	}
+	return "", nil, nil, fmt.Errorf("has no SHA-256 or SHA-512 digest in %q", strings.Join(vals, ", "))
+}
+
+// verifiedBody hashes a body as it is read, failing the read which ends it
+// when the hash is not the one wanted
+type verifiedBody struct {
+	io.ReadCloser
+	target, source, alg string
+
+	hash hash.Hash
+	want []byte
+	err  error
+}
+
+func (b *verifiedBody) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.hash.Write(p[:n])
+	if err == io.EOF {
+		if got := b.hash.Sum(nil); !bytes.Equal(got, b.want) {
+			b.err = fmt.Errorf("%w, the %s of %s is %x rather than %x from %s", errVerify, b.alg, b.target, got, b.want, b.source)
+			return n, b.err
+		}
+	}
+	return n, err
+}
+
+// verifyExit ends the run when a fetch failed on a body which didn't match
+// its checksum
+func verifyExit(err error) {
+	if errors.Is(err, errVerify) {
+		fmt.Fprintf(os.Stderr, "Error fetching: %s\n", err)
+		os.Exit(exitVerify)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/fips140"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os/exec"
+	"runtime"
+	rtdebug "runtime/debug"
+	"strings"
+)
+
+var (
+	versionJSON bool
+
+	// commit and buildDate are set at build time with
+	// -ldflags "-X main.commit=... -X main.buildDate=...", else they are
+	// taken from the VCS details go build stamps into the binary
+	commit, buildDate string
+)
+
+// versionInfo is what --version-json writes, for tooling to tell what the
+// installed binary can do before relying on it
+type versionInfo struct {
+	Version       string          `json:"version"`
+	Commit        string          `json:"commit,omitempty"`
+	BuildDate     string          `json:"build_date,omitempty"`
+	GoVersion     string          `json:"go_version"`
+	OS            string          `json:"os"`
+	Arch          string          `json:"arch"`
+	Features      map[string]bool `json:"features"`
+	InputFormats  []string        `json:"input_formats"`
+	OutputFormats []string        `json:"output_formats"`
+	Encodings     []string        `json:"content_encodings"`
+}
+
+// writeVersionJSON writes the version, build and features of this binary
+func writeVersionJSON() {
+	info := versionInfo{
+		Version:   version,
+		Commit:    commit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+		OS:        runtime.GOOS,
+		Arch:      runtime.GOARCH,
+		Features: map[string]bool{
+			"http2":          true,
+			"http3":          false,
+			"wasm":           false,
+			"netns":          runtime.GOOS == "linux",
+			"certstore":      runtime.GOOS == "windows",
+			"cabundles":      len(embeddedCABundles) > 0,
+			"fips":           fips140.Enabled(),
+			"signed_updates": updateKey != "",
+			"pkcs12":         toolFound(opensslTool),
+			"pkcs11":         toolFound(pkcs11Tool),
+			"doh":            true,
+		},
+		InputFormats:  []string{"json", "yaml", "xml", "jsonl", "sse"},
+		OutputFormats: []string{"json", "yaml"},
+		Encodings:     strings.Split(acceptEncoding(), ", "),
+	}
+	if bi, ok := rtdebug.ReadBuildInfo(); ok {
+		for _, s := range bi.Settings {
+			switch {
+			case s.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = s.Value
+			case s.Key == "vcs.time" && info.BuildDate == "":
+				info.BuildDate = s.Value
+			}
+		}
+	}
+	var byt []byte
+	var err error
+	if pretty {
+		byt, err = json.MarshalIndent(info, "", "  ")
+	} else {
+		byt, err = json.Marshal(info)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Fprintln(dataOut, string(byt))
+}
+
+// toolFound tells if a command line tool a feature hands off to is installed
+func toolFound(name string) bool {
+	_, err := exec.LookPath(name)
+	return err == nil
+}
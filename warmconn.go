@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+var prewarmConns bool
+
+// warmPool holds the connections made up front by --prewarm-connections,
+// each handed to the first request for its host
+type warmPool struct {
+	mu    sync.Mutex
+	conns map[string]net.Conn // by scheme and host:port
+}
+
+// warmConnections resolves and connects to the hosts of the URLs in
+// parallel, with the TLS handshake for https, before the first request is
+// sent.  Hosts reached through a proxy are left alone.
+func warmConnections(transport *http.Transport, urls []string) {
+	pool := &warmPool{conns: make(map[string]net.Conn)}
+	dial := transport.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	seen := make(map[string]bool)
+	for _, target := range urls {
+		u, err := url.Parse(target)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			continue
+		}
+		addr := hostPort(u)
+		key := u.Scheme + "://" + addr
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		if transport.Proxy != nil {
+			if proxy, _ := transport.Proxy(&http.Request{URL: u}); proxy != nil {
+				continue
+			}
+		}
+		wg.Add(1)
+		go func(scheme, host, addr, key string) {
+			defer wg.Done()
+			start := time.Now()
+			conn, err := dial(ctx, "tcp", addr)
+			if err == nil && scheme == "https" {
+				conn, err = warmTLS(ctx, conn, transport.TLSClientConfig, host)
+			}
+			if err != nil {
+				// the request dials again and reports the error then
+				if debug {
+					log.Printf("Prewarming %s: %s", key, err)
+				}
+				return
+			}
+			if debug {
+				log.Printf("Prewarmed %s in %s", key, time.Since(start).Round(time.Millisecond))
+			}
+			pool.mu.Lock()
+			pool.conns[key] = conn
+			pool.mu.Unlock()
+		}(u.Scheme, u.Hostname(), addr, key)
+	}
+	wg.Wait()
+
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if conn := pool.take("http://" + addr); conn != nil {
+			return conn, nil
+		}
+		return dial(ctx, network, addr)
+	}
+	transport.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if conn := pool.take("https://" + addr); conn != nil {
+			return conn, nil
+		}
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		host, _, _ := net.SplitHostPort(addr)
+		return warmTLS(ctx, conn, transport.TLSClientConfig, host)
+	}
+}
+
+// take hands out a warm connection once
+func (p *warmPool) take(key string) net.Conn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	conn := p.conns[key]
+	delete(p.conns, key)
+	return conn
+}
+
+// warmTLS makes the TLS handshake the transport would, offering HTTP/2
+func warmTLS(ctx context.Context, conn net.Conn, config *tls.Config, host string) (net.Conn, error) {
+	cfg := config.Clone()
+	if cfg.ServerName == "" {
+		cfg.ServerName = host
+	}
+	if len(cfg.NextProtos) == 0 {
+		cfg.NextProtos = []string{"h2", "http/1.1"}
+	}
+	tlsConn := tls.Client(conn, cfg)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// hostPort gives the host:port a URL connects to
+func hostPort(u *url.URL) string {
+	if port := u.Port(); port != "" {
+		return net.JoinHostPort(u.Hostname(), port)
+	}
+	if u.Scheme == "https" {
+		return net.JoinHostPort(u.Hostname(), "443")
+	}
+	return net.JoinHostPort(u.Hostname(), "80")
+}
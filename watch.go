@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+var (
+	watchInterval time.Duration
+	changesOnly   bool
+)
+
+// watchQuery fetches the URLs and runs the query every --watch interval
+// until interrupted.  With --changes-only a round's results are only written
+// when they differ from the round before.
+func watchQuery(client *http.Client) {
+	var err error
+	if queryCode, err = compileJQ(JQString); err != nil {
+		log.Fatalf("Error %s", err)
+	}
+	var last []byte
+	for round := 1; ; round++ {
+		if fetchAllURLs {
+			dat = fetchAll(client)
+		} else {
+			fetchURLs(client)
+		}
+		if dat == nil {
+			fmt.Fprintf(os.Stderr, "Error fetching %v, trying again in %s\n", Args, watchInterval)
+		} else if results, err := watchRound(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error running jq query %q: %s\n", JQString, err)
+		} else if byt, _ := json.Marshal(results); !changesOnly || round == 1 || string(byt) != string(last) {
+			last = byt
+			for _, v := range results {
+				emitResult(v)
+			}
+		} else if debug {
+			log.Println("No change in the results")
+		}
+		dat = nil
+		// saved every round, so a watch killed outright loses at most one
+		if err := saveState(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing state file %q: %s\n", stateFile, err)
+		}
+
+		// an interrupt while waiting ends the watch cleanly, one during a
+		// fetch stops right away as usual
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		select {
+		case <-sig:
+			finishQuery()
+			return
+		case <-time.After(watchInterval):
+		}
+		signal.Stop(sig)
+	}
+}
+
+// watchRound gathers the results of the query on the fetched data
+func watchRound() ([]interface{}, error) {
+	var results []interface{}
+	for _, in := range inputDocs(dat) {
+		iter := runJQ(queryCode, graphqlData(in))
+		for {
+			v, ok := iter.Next()
+			if !ok {
+				break
+			}
+			if err, ok := v.(error); ok {
+				return nil, err
+			}
+			results = append(results, v)
+		}
+	}
+	return results, nil
+}
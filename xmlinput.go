@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// xmlUnmarshal converts an XML document into the shape jq works with: each
+// element becomes an object under its name, attributes are "@name" keys and
+// text is "#text".  An element with only text becomes that string, an empty
+// one null, and repeated elements become an array.  Namespace prefixes are
+// dropped and all values are strings.
+func xmlUnmarshal(data []byte) (interface{}, error) {
+	type node struct {
+		name string
+		m    map[string]interface{}
+		text strings.Builder
+	}
+	value := func(n *node) interface{} {
+		text := strings.TrimSpace(n.text.String())
+		if len(n.m) == 0 {
+			if text == "" {
+				return nil
+			}
+			return text
+		}
+		if text != "" {
+			n.m["#text"] = text
+		}
+		return n.m
+	}
+	add := func(m map[string]interface{}, name string, v interface{}) {
+		switch old := m[name].(type) {
+		case nil:
+			if _, ok := m[name]; !ok {
+				m[name] = v
+				return
+			}
+			m[name] = []interface{}{old, v}
+		case []interface{}:
+			m[name] = append(old, v)
+		default:
+			m[name] = []interface{}{old, v}
+		}
+	}
+
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	dec.CharsetReader = xmlCharsetReader
+	root := &node{m: map[string]interface{}{}}
+	stack := []*node{root}
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("xml: %s", err)
+		}
+		top := stack[len(stack)-1]
+		switch t := tok.(type) {
+		case xml.StartElement:
+			n := &node{name: t.Name.Local, m: map[string]interface{}{}}
+			for _, a := range t.Attr {
+				if a.Name.Space == "xmlns" || a.Name.Local == "xmlns" {
+					continue
+				}
+				n.m["@"+a.Name.Local] = a.Value
+			}
+			stack = append(stack, n)
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+			add(stack[len(stack)-1].m, top.name, value(top))
+		case xml.CharData:
+			if len(stack) > 1 {
+				top.text.Write(t)
+			}
+		}
+	}
+	if len(root.m) == 0 {
+		return nil, fmt.Errorf("xml: no root element")
+	}
+	return root.m, nil
+}
+
+// xmlCharsetReader handles the Latin-1 documents older services still
+// send, besides UTF-8
+func xmlCharsetReader(charset string, input io.Reader) (io.Reader, error) {
+	switch strings.ToLower(charset) {
+	case "utf-8", "utf8", "us-ascii", "ascii":
+		return input, nil
+	case "iso-8859-1", "latin1", "latin-1":
+		byt, err := ioutil.ReadAll(input)
+		if err != nil {
+			return nil, err
+		}
+		runes := make([]rune, len(byt))
+		for i, b := range byt {
+			runes[i] = rune(b)
+		}
+		return strings.NewReader(string(runes)), nil
+	}
+	return nil, fmt.Errorf("unsupported charset %q", charset)
+}
@@ -0,0 +1,624 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// A small YAML decoder covering the block and flow styles found in config
+// and API documents: mappings, sequences, plain and quoted scalars, literal
+// (|) and folded (>) blocks, comments and "---" document markers.  Anchors,
+// aliases, tags and directives are refused rather than read as strings, and
+// multi-line flow collections are not supported.
+
+type yamlLine struct {
+	num    int
+	indent int
+	text   string
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+// yamlUnmarshal decodes a YAML file holding a single document
+func yamlUnmarshal(data []byte) (interface{}, error) {
+	docs, err := yamlDocuments(data)
+	switch {
+	case err != nil:
+		return nil, err
+	case len(docs) > 1:
+		return nil, fmt.Errorf("yaml: %d documents, expected one", len(docs))
+	case len(docs) == 1:
+		return docs[0], nil
+	}
+	return nil, nil
+}
+
+// yamlDocuments decodes each document of a YAML stream, empty ones left out
+func yamlDocuments(data []byte) ([]interface{}, error) {
+	p := &yamlParser{}
+	for i, raw := range strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n") {
+		trimmed := strings.TrimLeft(raw, " ")
+		if strings.HasPrefix(trimmed, "\t") {
+			return nil, fmt.Errorf("yaml: line %d: tabs are not allowed for indentation", i+1)
+		}
+		p.lines = append(p.lines, yamlLine{num: i + 1, indent: len(raw) - len(trimmed), text: strings.TrimRight(raw, " \t")})
+	}
+	var docs []interface{}
+	for p.skipBlank(); p.pos < len(p.lines); p.skipBlank() {
+		line := p.lines[p.pos]
+		switch {
+		case line.indent == 0 && yamlMarker(line.text, "---"):
+			if rest := stripYamlComment(strings.TrimSpace(line.text[3:])); rest != "" {
+				return nil, fmt.Errorf("yaml: line %d: content after --- is not supported", line.num)
+			}
+			p.pos++
+			continue
+		case line.indent == 0 && yamlMarker(line.text, "..."):
+			p.pos++
+			continue
+		case line.indent == 0 && strings.HasPrefix(line.text, "%"):
+			return nil, fmt.Errorf("yaml: line %d: directives are not supported", line.num)
+		}
+		v, err := p.parseBlock(line.indent)
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, v)
+		p.skipBlank()
+		if p.pos < len(p.lines) && !yamlMarker(p.lines[p.pos].text, "---") && !yamlMarker(p.lines[p.pos].text, "...") {
+			return nil, fmt.Errorf("yaml: line %d: unexpected content", p.lines[p.pos].num)
+		}
+	}
+	return docs, nil
+}
+
+// yamlMarker tells if a line is the --- or ... document marker
+func yamlMarker(text, marker string) bool {
+	return text == marker || strings.HasPrefix(text, marker+" ")
+}
+
+// skipBlank moves past empty lines and comments
+func (p *yamlParser) skipBlank() {
+	for p.pos < len(p.lines) {
+		t := strings.TrimSpace(p.lines[p.pos].text)
+		if t != "" && !strings.HasPrefix(t, "#") {
+			return
+		}
+		p.pos++
+	}
+}
+
+func (p *yamlParser) parseBlock(indent int) (interface{}, error) {
+	line := p.lines[p.pos]
+	content := line.text[line.indent:]
+	if content == "-" || strings.HasPrefix(content, "- ") {
+		return p.parseSeq(indent)
+	}
+	if _, _, ok := splitYamlKey(content); ok {
+		return p.parseMap(indent)
+	}
+	p.pos++
+	return parseYamlScalar(content, line.num)
+}
+
+func (p *yamlParser) parseSeq(indent int) (interface{}, error) {
+	out := []interface{}{}
+	for p.skipBlank(); p.pos < len(p.lines); p.skipBlank() {
+		line := p.lines[p.pos]
+		content := line.text[line.indent:]
+		if line.indent < indent || !(content == "-" || strings.HasPrefix(content, "- ")) {
+			break
+		}
+		if line.indent > indent {
+			return nil, fmt.Errorf("yaml: line %d: bad indentation", line.num)
+		}
+		rest := strings.TrimLeft(strings.TrimPrefix(content, "-"), " ")
+		if rest == "" {
+			p.pos++
+			v, err := p.parseNested(indent)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, v)
+			continue
+		}
+		var v interface{}
+		var err error
+		if rest[0] == '|' || rest[0] == '>' {
+			p.pos++
+			v, err = p.parseBlockText(rest, line.indent)
+		} else {
+			// the entry continues on the same line, re-parse it as a block
+			// indented to where its content starts
+			childIndent := line.indent + len(content) - len(rest)
+			p.lines[p.pos] = yamlLine{num: line.num, indent: childIndent, text: strings.Repeat(" ", childIndent) + rest}
+			v, err = p.parseBlock(childIndent)
+		}
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+	}
+	return out, nil
+}
+
+func (p *yamlParser) parseMap(indent int) (interface{}, error) {
+	out := map[string]interface{}{}
+	for p.skipBlank(); p.pos < len(p.lines); p.skipBlank() {
+		line := p.lines[p.pos]
+		if line.indent < indent {
+			break
+		}
+		if line.indent > indent {
+			return nil, fmt.Errorf("yaml: line %d: bad indentation", line.num)
+		}
+		content := line.text[line.indent:]
+		if yamlMarker(content, "---") || yamlMarker(content, "...") {
+			break
+		}
+		key, rest, ok := splitYamlKey(content)
+		if !ok {
+			return nil, fmt.Errorf("yaml: line %d: expected a key", line.num)
+		}
+		k, err := parseYamlScalar(key, line.num)
+		if err != nil {
+			return nil, err
+		}
+		key = fmt.Sprint(k)
+		p.pos++
+		var v interface{}
+		switch {
+		case rest == "":
+			v, err = p.parseNested(indent)
+		case rest[0] == '|' || rest[0] == '>':
+			v, err = p.parseBlockText(rest, indent)
+		default:
+			v, err = parseYamlScalar(rest, line.num)
+		}
+		if err != nil {
+			return nil, err
+		}
+		out[key] = v
+	}
+	return out, nil
+}
+
+// parseNested reads the value of a key or dash which starts on the next line,
+// a sequence may sit at the same indentation as its parent key
+func (p *yamlParser) parseNested(parent int) (interface{}, error) {
+	p.skipBlank()
+	if p.pos >= len(p.lines) {
+		return nil, nil
+	}
+	line := p.lines[p.pos]
+	content := line.text[line.indent:]
+	if line.indent > parent || (line.indent == parent && strings.HasPrefix(content, "- ")) {
+		return p.parseBlock(line.indent)
+	}
+	return nil, nil
+}
+
+// parseBlockText reads a literal (|) or folded (>) block scalar
+func (p *yamlParser) parseBlockText(header string, parent int) (interface{}, error) {
+	folded := header[0] == '>'
+	chomp := ""
+	if strings.Contains(header, "-") {
+		chomp = "-"
+	} else if strings.Contains(header, "+") {
+		chomp = "+"
+	}
+	var lines []string
+	indent := -1
+	for p.pos < len(p.lines) {
+		line := p.lines[p.pos]
+		if strings.TrimSpace(line.text) == "" {
+			lines = append(lines, "")
+			p.pos++
+			continue
+		}
+		if line.indent <= parent {
+			break
+		}
+		if indent < 0 {
+			indent = line.indent
+		}
+		if line.indent < indent {
+			break
+		}
+		lines = append(lines, line.text[indent:])
+		p.pos++
+	}
+	// hand trailing blank lines back, they belong to the chomping
+	trailing := 0
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+		trailing++
+	}
+	var text string
+	if folded {
+		var b strings.Builder
+		for i, l := range lines {
+			switch {
+			case i == 0:
+			case l == "" || lines[i-1] == "":
+				b.WriteString("\n")
+			default:
+				b.WriteString(" ")
+			}
+			b.WriteString(l)
+		}
+		text = b.String()
+	} else {
+		text = strings.Join(lines, "\n")
+	}
+	switch chomp {
+	case "-":
+	case "+":
+		text += strings.Repeat("\n", trailing+1)
+	default:
+		if len(lines) > 0 {
+			text += "\n"
+		}
+	}
+	return text, nil
+}
+
+// splitYamlKey finds a "key: value" separator outside of any quotes
+func splitYamlKey(s string) (key, rest string, ok bool) {
+	if strings.HasPrefix(s, "[") || strings.HasPrefix(s, "{") {
+		return "", "", false
+	}
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case (c == '"' || c == '\'') && i == 0:
+			quote = c
+		case c == '#' && i > 0 && s[i-1] == ' ':
+			return "", "", false
+		case c == ':' && (i+1 == len(s) || s[i+1] == ' '):
+			return strings.TrimSpace(s[:i]), strings.TrimSpace(stripYamlComment(s[i+1:])), true
+		}
+	}
+	return "", "", false
+}
+
+// stripYamlComment removes a trailing "# comment" outside of quotes
+func stripYamlComment(s string) string {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case (c == '"' || c == '\'') && (i == 0 || strings.IndexByte(" [{,:", s[i-1]) >= 0):
+			quote = c
+		case c == '#' && (i == 0 || s[i-1] == ' '):
+			return strings.TrimSpace(s[:i])
+		}
+	}
+	return s
+}
+
+// parseYamlScalar converts a plain, quoted or flow value
+func parseYamlScalar(s string, num int) (interface{}, error) {
+	s = strings.TrimSpace(stripYamlComment(s))
+	if s == "" {
+		return nil, nil
+	}
+	switch s[0] {
+	case '"':
+		v, err := yamlUnquote(s)
+		if err != nil {
+			return nil, fmt.Errorf("yaml: line %d: bad double quoted string: %s", num, err)
+		}
+		return v, nil
+	case '\'':
+		if len(s) < 2 || s[len(s)-1] != '\'' {
+			return nil, fmt.Errorf("yaml: line %d: bad single quoted string", num)
+		}
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+	case '[', '{':
+		v, rest, err := parseYamlFlow(s)
+		if err == nil && strings.TrimSpace(rest) != "" {
+			err = errors.New("trailing characters")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("yaml: line %d: %s", num, err)
+		}
+		return v, nil
+	}
+	if strings.IndexByte("&*!%@`", s[0]) >= 0 {
+		// anchors, aliases and tags, or characters YAML reserves
+		return nil, fmt.Errorf("yaml: line %d: anchors, aliases and tags are not supported: %s", num, s)
+	}
+	switch s {
+	case "~", "null", "Null", "NULL":
+		return nil, nil
+	case "true", "True", "TRUE":
+		return true, nil
+	case "false", "False", "FALSE":
+		return false, nil
+	}
+	if v, ok := yamlNumber(s); ok {
+		return v, nil
+	}
+	return s, nil
+}
+
+var (
+	yamlInt   = regexp.MustCompile(`^[-+]?[0-9]+$`)
+	yamlHex   = regexp.MustCompile(`^0x[0-9a-fA-F]+$`)
+	yamlOct   = regexp.MustCompile(`^0o[0-7]+$`)
+	yamlFloat = regexp.MustCompile(`^[-+]?(\.[0-9]+|[0-9]+(\.[0-9]*)?)([eE][-+]?[0-9]+)?$`)
+)
+
+// yamlNumber reads an integer or float as the YAML 1.2 core schema has
+// them.  Integers stay exact as a json.Number however long, a leading zero
+// is decimal rather than octal, and .inf and .nan, having no JSON form, are
+// left as strings.
+func yamlNumber(s string) (interface{}, bool) {
+	base := 10
+	switch {
+	case yamlInt.MatchString(s):
+	case yamlHex.MatchString(s):
+		s, base = s[2:], 16
+	case yamlOct.MatchString(s):
+		s, base = s[2:], 8
+	case yamlFloat.MatchString(s):
+		f, err := strconv.ParseFloat(s, 64)
+		return f, err == nil
+	default:
+		return nil, false
+	}
+	n, ok := new(big.Int).SetString(strings.TrimPrefix(s, "+"), base)
+	if !ok {
+		return nil, false
+	}
+	return json.Number(n.String()), true
+}
+
+// yamlEscapes are the single character escapes of double quoted scalars
+var yamlEscapes = map[byte]rune{
+	'0': 0, 'a': '\a', 'b': '\b', 't': '\t', '\t': '\t', 'n': '\n', 'v': '\v',
+	'f': '\f', 'r': '\r', 'e': 0x1b, ' ': ' ', '"': '"', '/': '/', '\\': '\\',
+	'N': 0x85, '_': 0xa0, 'L': 0x2028, 'P': 0x2029,
+}
+
+// yamlUnquote decodes a double quoted scalar, with the escapes of YAML
+// rather than of Go
+func yamlUnquote(s string) (string, error) {
+	if len(s) < 2 || s[len(s)-1] != '"' {
+		return "", errors.New("missing closing quote")
+	}
+	s = s[1 : len(s)-1]
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			return "", errors.New("unescaped quote")
+		case '\\':
+		default:
+			b.WriteByte(s[i])
+			continue
+		}
+		if i++; i == len(s) {
+			return "", errors.New("backslash at the end")
+		}
+		if r, ok := yamlEscapes[s[i]]; ok {
+			b.WriteRune(r)
+			continue
+		}
+		size := map[byte]int{'x': 2, 'u': 4, 'U': 8}[s[i]]
+		if size == 0 || i+size >= len(s) {
+			return "", fmt.Errorf("unknown escape \\%c", s[i])
+		}
+		r, err := strconv.ParseUint(s[i+1:i+1+size], 16, 32)
+		if err != nil || !utf8.ValidRune(rune(r)) {
+			return "", fmt.Errorf("bad escape \\%s", s[i:i+1+size])
+		}
+		b.WriteRune(rune(r))
+		i += size
+	}
+	return b.String(), nil
+}
+
+// parseYamlFlow reads a single line [..] or {..} collection
+func parseYamlFlow(s string) (interface{}, string, error) {
+	s = strings.TrimLeft(s, " ")
+	if s == "" {
+		return nil, s, errors.New("unexpected end of flow collection")
+	}
+	switch s[0] {
+	case '[':
+		out := []interface{}{}
+		s = strings.TrimLeft(s[1:], " ")
+		for {
+			if strings.HasPrefix(s, "]") {
+				return out, s[1:], nil
+			}
+			v, rest, err := parseYamlFlow(s)
+			if err != nil {
+				return nil, s, err
+			}
+			out = append(out, v)
+			if s = strings.TrimLeft(rest, " "); strings.HasPrefix(s, ",") {
+				s = strings.TrimLeft(s[1:], " ")
+			}
+		}
+	case '{':
+		out := map[string]interface{}{}
+		s = strings.TrimLeft(s[1:], " ")
+		for {
+			if strings.HasPrefix(s, "}") {
+				return out, s[1:], nil
+			}
+			k, rest, err := parseYamlFlow(s)
+			if err != nil {
+				return nil, s, err
+			}
+			rest = strings.TrimLeft(rest, " ")
+			if !strings.HasPrefix(rest, ":") {
+				return nil, rest, errors.New("expected ':' in flow mapping")
+			}
+			v, rest, err := parseYamlFlow(rest[1:])
+			if err != nil {
+				return nil, s, err
+			}
+			out[fmt.Sprint(k)] = v
+			if s = strings.TrimLeft(rest, " "); strings.HasPrefix(s, ",") {
+				s = strings.TrimLeft(s[1:], " ")
+			}
+		}
+	case '"', '\'':
+		end := 1
+		for end < len(s) && s[end] != s[0] {
+			if s[0] == '"' && s[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(s) {
+			return nil, s, errors.New("unterminated string")
+		}
+		v, err := parseYamlScalar(s[:end+1], 0)
+		return v, s[end+1:], err
+	}
+	end := strings.IndexAny(s, ",]}:")
+	for end >= 0 && s[end] == ':' && end+1 < len(s) && s[end+1] != ' ' {
+		next := strings.IndexAny(s[end+1:], ",]}:")
+		if next < 0 {
+			end = -1
+			break
+		}
+		end += 1 + next
+	}
+	if end < 0 {
+		return nil, "", errors.New("unterminated flow collection")
+	}
+	v, err := parseYamlScalar(s[:end], 0)
+	return v, s[end:], err
+}
+
+// yamlMarshal encodes a decoded JSON value as a block style YAML document
+func yamlMarshal(v interface{}) []byte {
+	var b bytes.Buffer
+	writeYaml(&b, v, 0)
+	return b.Bytes()
+}
+
+// writeYaml writes a node whose first line has already been positioned at
+// the given indentation
+func writeYaml(b *bytes.Buffer, v interface{}, indent int) {
+	pad := strings.Repeat(" ", indent)
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if len(v) == 0 {
+			b.WriteString("{}\n")
+			return
+		}
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for i, k := range keys {
+			if i > 0 {
+				b.WriteString(pad)
+			}
+			b.WriteString(yamlScalar(k, indent))
+			b.WriteString(":")
+			writeYamlValue(b, v[k], indent)
+		}
+	case []interface{}:
+		if len(v) == 0 {
+			b.WriteString("[]\n")
+			return
+		}
+		for i, item := range v {
+			if i > 0 {
+				b.WriteString(pad)
+			}
+			b.WriteString("- ")
+			writeYaml(b, item, indent+2)
+		}
+	default:
+		b.WriteString(yamlScalar(v, indent))
+		b.WriteString("\n")
+	}
+}
+
+// writeYamlValue writes the value of a mapping key, collections go on the
+// following lines
+func writeYamlValue(b *bytes.Buffer, v interface{}, indent int) {
+	switch c := v.(type) {
+	case map[string]interface{}:
+		if len(c) > 0 {
+			b.WriteString("\n" + strings.Repeat(" ", indent+2))
+			writeYaml(b, v, indent+2)
+			return
+		}
+	case []interface{}:
+		if len(c) > 0 {
+			b.WriteString("\n" + strings.Repeat(" ", indent+2))
+			writeYaml(b, v, indent+2)
+			return
+		}
+	}
+	b.WriteString(" ")
+	writeYaml(b, v, indent)
+}
+
+// yamlScalar formats a scalar, strings are left plain when they would read
+// back unchanged, multi-line strings become literal blocks
+func yamlScalar(v interface{}, indent int) string {
+	s, ok := v.(string)
+	if !ok {
+		if v == nil {
+			return "null"
+		}
+		byt, _ := json.Marshal(v)
+		return string(byt)
+	}
+	if strings.Contains(s, "\n") && !strings.HasPrefix(s, " ") && !strings.HasSuffix(s, "\n\n") &&
+		strings.IndexFunc(s, func(r rune) bool { return r < ' ' && r != '\n' }) < 0 {
+		header := "|-"
+		if strings.HasSuffix(s, "\n") {
+			header, s = "|", strings.TrimSuffix(s, "\n")
+		}
+		pad := strings.Repeat(" ", indent+2)
+		lines := strings.Split(s, "\n")
+		for i, l := range lines {
+			if l != "" {
+				lines[i] = pad + l
+			}
+		}
+		return header + "\n" + strings.Join(lines, "\n")
+	}
+	if s == "" || strings.TrimSpace(s) != s || strings.ContainsAny(s[:1], "-?:,[]{}#&*!|>'\"%@`") ||
+		strings.Contains(s, ": ") || strings.Contains(s, " #") || strings.HasSuffix(s, ":") ||
+		strings.IndexFunc(s, func(r rune) bool { return r < ' ' || r == 0x7f }) >= 0 {
+		return strconv.Quote(s)
+	}
+	if back, err := parseYamlScalar(s, 0); err != nil || back != s {
+		return strconv.Quote(s)
+	}
+	return s
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestYamlScalars(t *testing.T) {
+	for _, c := range []struct {
+		yaml string
+		want interface{}
+	}{
+		{`v: 01234`, 1234},
+		{`v: 1_000`, "1_000"},
+		{`v: 0b1`, "0b1"},
+		{`v: 0x1F`, 31},
+		{`v: 0o17`, 15},
+		{`v: 9007199254740993`, json.Number("9007199254740993")},
+		{`v: -1.5e3`, -1500},
+		{`v: .inf`, ".inf"},
+		{`v: "a\/b\e\N\_\L\x41é\"\\"`, "a/b\x1b\u0085  Aé\"\\"},
+		{`v: [ "x\\", "y" ]`, []interface{}{`x\`, "y"}},
+	} {
+		v, err := yamlUnmarshal([]byte(c.yaml))
+		if err != nil {
+			t.Errorf("%s: %s", c.yaml, err)
+			continue
+		}
+		got, _ := json.Marshal(v)
+		want, _ := json.Marshal(map[string]interface{}{"v": c.want})
+		if string(got) != string(want) {
+			t.Errorf("%s = %s, want %s", c.yaml, got, want)
+		}
+	}
+	for _, bad := range []string{`v: "\q"`, `v: "\x4"`, `v: "a"b"`} {
+		if _, err := yamlUnmarshal([]byte(bad)); err == nil {
+			t.Errorf("%s gave no error", bad)
+		}
+	}
+}